@@ -76,7 +76,7 @@ echo -e "${BLUE}Sending test messages...${NC}"
 tmux send-keys -t $SESSION:relay.1 "Hello everyone! I am Alice." C-m
 
 # Bob whispers to Alice
-tmux send-keys -t $SESSION:relay.2 "@alice-secret Hello Alice!" C-m
+tmux send-keys -t $SESSION:relay.2 "@alice Hello Alice, just for you!" C-m
 
 # Charlie sends a broadcast
 tmux send-keys -t $SESSION:relay.3 "Hi all — Charlie here." C-m
@@ -0,0 +1,281 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	libhost "github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"pqchat/src/internal/chat"
+	"pqchat/src/internal/cli"
+	"pqchat/src/internal/dht"
+	"pqchat/src/internal/mailbox"
+	"pqchat/src/internal/manager"
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/room"
+)
+
+// How long /connect and /nick wait for a handshake.
+const connectTimeout = 30 * time.Second
+
+// app is what the commands act on. Apart from the handshake states, it is
+// only used from the input loop.
+type app struct {
+	ctx   context.Context
+	h     libhost.Host
+	id    *pqc.Identity
+	mgr   *manager.Manager
+	ui    frontend
+	relay peer.ID // empty without -relay
+
+	mail    *mailbox.Client // nil without -relay
+	prekeys *mailbox.Keys   // set with mail
+	dht     *dht.DHT        // nil without -dht
+
+	mu         sync.Mutex
+	rooms      *room.Rooms       // set with mgr
+	handshakes map[peer.ID]error // nil while in progress, else why it failed
+}
+
+/* -----------------------------------------------------------
+This registers the slash commands
+-----------------------------------------------------------*/
+
+func (a *app) commands() *cli.Dispatcher {
+	d := cli.NewDispatcher()
+	d.Words = func() []string { return append(mentions(), a.roomWords()...) }
+	peerNames := func(n int) []string {
+		if n == 0 {
+			return chat.Names()
+		}
+		return nil
+	}
+
+	d.Register(&cli.Command{
+		Name: "connect", Args: "<multiaddr|peer|user_id>", Help: "open a session with a peer, looked up in the DHT by full user_id or known peer unless given by multiaddr",
+		MinArgs: 1, MaxArgs: 1, Complete: peerNames,
+		Run: func(args []string) error { return a.connect(args[0]) },
+	})
+	d.Register(&cli.Command{
+		Name: "disconnect", Args: "<peer>", Help: "close the session with a peer",
+		MinArgs: 1, MaxArgs: 1, Complete: peerNames,
+		Run: func(args []string) error {
+			p, err := chat.Resolve(args[0])
+			if err != nil {
+				return err
+			}
+			return a.mgr.Disconnect(p.UserID)
+		},
+	})
+	d.Register(&cli.Command{
+		Name: "peers", Help: "list known peers and sessions",
+		Run: func([]string) error { a.peers(); return nil },
+	})
+	d.Register(&cli.Command{
+		Name: "whoami", Help: "show your identity and addresses",
+		Run: func([]string) error { a.whoami(); return nil },
+	})
+	d.Register(&cli.Command{
+		Name: "msg", Args: "<peer> <text>", Help: "send text to one peer, like @peer text",
+		MinArgs: 2, MaxArgs: 2, Rest: true, Complete: peerNames,
+		Run: func(args []string) error {
+			p, err := chat.Resolve(args[0])
+			if err != nil {
+				return err
+			}
+			a.say([]string{p.UserID}, args[1])
+			return nil
+		},
+	})
+	d.Register(&cli.Command{
+		Name: "mail", Args: "<peer|user_id> <text>", Help: "leave text on the relay for a peer who is offline",
+		MinArgs: 2, MaxArgs: 2, Rest: true, Complete: peerNames,
+		Run: func(args []string) error { return a.leaveMail(args[0], args[1]) },
+	})
+	d.Register(&cli.Command{
+		Name: "nick", Args: "<pseudo>", Help: "change your pseudo (and user ID), reconnecting to peers",
+		MinArgs: 1, MaxArgs: 1,
+		Run: func(args []string) error { return a.nick(args[0]) },
+	})
+	d.Register(&cli.Command{
+		Name: "fingerprint", Args: "[peer]", Help: "show your key fingerprint, or a peer's",
+		MaxArgs: 1, Complete: peerNames,
+		Run: func(args []string) error {
+			if len(args) == 0 {
+				fmt.Fprintln(a.ui, "Your fingerprint:", a.identity().Fingerprint())
+				return nil
+			}
+			p, err := chat.Resolve(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(a.ui, "Fingerprint of %s: %s\n", chat.Handle(p), pqc.Fingerprint(p.Pub))
+			return nil
+		},
+	})
+	d.Register(&cli.Command{
+		Name: "verify", Args: "<peer> <fingerprint>", Help: "mark a peer trusted once its fingerprint matches",
+		MinArgs: 2, MaxArgs: 2, Rest: true, Complete: peerNames,
+		Run: func(args []string) error { return a.verify(args[0], args[1]) },
+	})
+	d.Register(a.roomCommand())
+	d.Register(&cli.Command{
+		Name: "quit", Help: "close every session and exit",
+		Run: func([]string) error { return cli.ErrQuit },
+	})
+	d.Register(&cli.Command{
+		Name: "help", Args: "[command]", Help: "list commands, or describe one",
+		MaxArgs: 1,
+		Complete: func(n int) []string {
+			var names []string
+			for _, c := range d.Commands() {
+				names = append(names, c.Name)
+			}
+			return names
+		},
+		Run: func(args []string) error {
+			name := ""
+			if len(args) > 0 {
+				name = args[0]
+			} else {
+				fmt.Fprintln(a.ui, "Commands (start a chat line with // to send a leading /):")
+			}
+			return d.Help(a.ui, name)
+		},
+	})
+	return d
+}
+
+// mentions completes @mentions in chat lines.
+func mentions() []string {
+	names := chat.Names()
+	for i, n := range names {
+		names[i] = "@" + n
+	}
+	return names
+}
+
+func (a *app) peers() {
+	known := chat.AllPeers()
+	if len(known) == 0 {
+		fmt.Fprintln(a.ui, "No known peer")
+		return
+	}
+	for _, p := range known {
+		status := "offline"
+		if c, ok := a.mgr.Lookup(p.UserID); ok {
+			side := "in"
+			if c.Outbound {
+				side = "out"
+			}
+			status = fmt.Sprintf("%s, %s, %s", side, c.Version, c.Session.Kex)
+		}
+		trust := ""
+		if p.Trusted {
+			trust = ", trusted"
+		}
+		fmt.Fprintf(a.ui, "  %-24s %s  %s (%s%s)\n", chat.Handle(p), p.PeerID, status, p.Alg, trust)
+	}
+}
+
+func (a *app) whoami() {
+	id := a.identity()
+	fmt.Fprintln(a.ui, "Pseudo:     ", id.Pseudo)
+	fmt.Fprintln(a.ui, "User ID:    ", id.UserID)
+	fmt.Fprintln(a.ui, "Algorithm:  ", id.Alg)
+	fmt.Fprintln(a.ui, "Fingerprint:", id.Fingerprint())
+	fmt.Fprintln(a.ui, "PeerID:     ", a.h.ID())
+	for _, addr := range a.h.Addrs() {
+		fmt.Fprintf(a.ui, "    %s/p2p/%s\n", addr, a.h.ID())
+	}
+}
+
+func (a *app) verify(name, fingerprint string) error {
+	p, err := chat.Resolve(name)
+	if err != nil {
+		return err
+	}
+	norm := func(s string) string {
+		return strings.ToUpper(strings.Join(strings.Fields(s), ""))
+	}
+	if norm(fingerprint) != norm(pqc.Fingerprint(p.Pub)) {
+		return fmt.Errorf("fingerprint mismatch for %s, not trusted", chat.Handle(p))
+	}
+	chat.Trust(p.UserID)
+	fmt.Fprintln(a.ui, chat.Handle(p), "is now trusted")
+	a.ui.refresh()
+	return nil
+}
+
+// nick renames the identity. The user ID commits to the pseudo and every
+// session is bound to the identity it was opened with, so sessions are
+// opened again.
+func (a *app) nick(pseudo string) error {
+	if pseudo == a.identity().Pseudo {
+		return nil
+	}
+	if len(a.rooms.Names()) > 0 {
+		return errors.New("room members are listed by user ID, leave your rooms first")
+	}
+	a.mu.Lock()
+	old := a.id
+	id := old.Renamed(pseudo)
+	a.id = id
+	a.mu.Unlock()
+	// Sessions opened under the old identity are gone once we return
+	defer old.Close()
+	a.mgr.SetIdentity(id)
+	chat.SetLocalUser(id.UserID)
+	fmt.Fprintf(a.ui, "You are now %s [%s]\n", id.Pseudo, id.UserID)
+
+	ctx, cancel := context.WithTimeout(a.ctx, connectTimeout)
+	defer cancel()
+
+	var errs []error
+	for _, c := range a.mgr.Conns() {
+		info := a.h.Peerstore().PeerInfo(c.PeerID())
+		_ = a.mgr.Disconnect(c.UserID())
+		if _, err := a.mgr.ConnectPeer(ctx, info); err != nil {
+			errs = append(errs, fmt.Errorf("reconnect %s: %w", c.Pseudo(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// identity returns our identity, which /nick may replace meanwhile.
+func (a *app) identity() *pqc.Identity {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.id
+}
+
+func (a *app) setHandshake(p peer.ID, err error) {
+	a.mu.Lock()
+	a.handshakes[p] = err
+	a.mu.Unlock()
+}
+
+func (a *app) clearHandshake(p peer.ID) {
+	a.mu.Lock()
+	delete(a.handshakes, p)
+	a.mu.Unlock()
+}
@@ -0,0 +1,123 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+const prompt = "> "
+
+// frontend is the interactive side of pqchat: the line console or the TUI.
+type frontend interface {
+	io.Writer
+	ReadLine() (string, error)
+	notify(fn func()) // fn prints from another goroutine
+	refresh()         // state shown besides the output changed
+	Close()
+}
+
+// notifyf prints a single message from another goroutine.
+func notifyf(ui frontend, format string, a ...any) {
+	ui.notify(func() { fmt.Fprintf(ui, format, a...) })
+}
+
+/* -----------------------------------------------------------
+The console reads input lines and prints what happens meanwhile.
+On a terminal it has line editing, history and tab completion;
+otherwise (pipes, scripts) it reads plain lines from stdin.
+-----------------------------------------------------------*/
+
+type console struct {
+	t       *term.Terminal // nil when not on a terminal
+	restore func()
+	in      *bufio.Scanner
+	mu      sync.Mutex // serializes notifications in plain mode
+}
+
+type completeFunc func(line string, pos int, key rune) (string, int, bool)
+
+func newConsole(complete completeFunc) *console {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) && term.IsTerminal(int(os.Stdout.Fd())) {
+		if old, err := term.MakeRaw(fd); err == nil {
+			rw := struct {
+				io.Reader
+				io.Writer
+			}{os.Stdin, os.Stdout}
+			t := term.NewTerminal(rw, prompt)
+			t.AutoCompleteCallback = complete
+			if w, h, err := term.GetSize(fd); err == nil && w > 0 {
+				_ = t.SetSize(w, h)
+			}
+			return &console{t: t, restore: func() { _ = term.Restore(fd, old) }}
+		}
+	}
+	return &console{in: bufio.NewScanner(os.Stdin)}
+}
+
+// ReadLine returns the next input line, io.EOF on Ctrl+D or Ctrl+C.
+func (c *console) ReadLine() (string, error) {
+	if c.t != nil {
+		return c.t.ReadLine()
+	}
+	c.mu.Lock()
+	fmt.Print(prompt)
+	c.mu.Unlock()
+	if !c.in.Scan() {
+		if err := c.in.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return c.in.Text(), nil
+}
+
+// Write prints above the line being typed.
+func (c *console) Write(p []byte) (int, error) {
+	if c.t != nil {
+		return c.t.Write(p)
+	}
+	return os.Stdout.Write(p)
+}
+
+// notify runs fn, which prints to the console from another goroutine
+// while a line may be being typed.
+func (c *console) notify(fn func()) {
+	if c.t != nil {
+		fn()
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Println()
+	fn()
+	fmt.Print(prompt)
+}
+
+// refresh does nothing, the console only shows its output.
+func (c *console) refresh() {}
+
+func (c *console) Close() {
+	if c.restore != nil {
+		c.restore()
+	}
+}
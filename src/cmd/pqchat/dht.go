@@ -0,0 +1,150 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"pqchat/src/internal/chat"
+	"pqchat/src/internal/dht"
+	"pqchat/src/internal/manager"
+	"pqchat/src/internal/pqc"
+)
+
+// Our peer record is advertised again well before it expires, and within
+// dhtPoll of /nick. dhtTimeout bounds joining the DHT and advertising.
+const (
+	advertiseInterval = dht.RecordTTL / 4
+	dhtPoll           = time.Minute
+	dhtTimeout        = time.Minute
+)
+
+/* -----------------------------------------------------------
+This joins the DHT, where peers find each other by user ID
+-----------------------------------------------------------*/
+
+// dhtBootstrap parses the bootstrap nodes of the DHT, a comma-separated
+// list of multiaddrs.
+func dhtBootstrap(list string) ([]peer.AddrInfo, error) {
+	var peers []peer.AddrInfo
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		info, err := peer.AddrInfoFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap multiaddr: %w", err)
+		}
+		peers = append(peers, *info)
+	}
+	if len(peers) == 0 {
+		return nil, errors.New("no bootstrap peer, use -dht-bootstrap or -relay")
+	}
+	return peers, nil
+}
+
+// startDHT joins the DHT the host was built with, then advertises our peer
+// record in the background.
+func (a *app) startDHT() {
+	ctx, cancel := context.WithTimeout(a.ctx, dhtTimeout)
+	defer cancel()
+	_ = a.dht.Bootstrap(ctx) // before -connect, pollDHT reports failures
+	go a.pollDHT()
+}
+
+// pollDHT keeps our peer record fresh until we quit. Failures are reported
+// once, until advertising works again.
+func (a *app) pollDHT() {
+	t := time.NewTicker(dhtPoll)
+	defer t.Stop()
+	var (
+		advertised string // user ID our record is out for
+		at         time.Time
+		failing    bool
+	)
+	for {
+		if id := a.identity(); id.UserID != advertised || time.Since(at) >= advertiseInterval {
+			err := a.advertise(id)
+			switch {
+			case err == nil:
+				advertised, at = id.UserID, time.Now()
+			case !failing:
+				notifyf(a.ui, "[!] Not advertised in the DHT: %v\n", err)
+			}
+			failing = err != nil
+		}
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// advertise stores our peer record in the DHT, joining it again first if
+// we lost every node.
+func (a *app) advertise(id *pqc.Identity) error {
+	ctx, cancel := context.WithTimeout(a.ctx, dhtTimeout)
+	defer cancel()
+	if a.dht.Size() == 0 {
+		if err := a.dht.Bootstrap(ctx); err != nil {
+			return err
+		}
+	}
+	return a.dht.Advertise(ctx, id)
+}
+
+/* -----------------------------------------------------------
+This connects to a peer by its name or user ID
+-----------------------------------------------------------*/
+
+// dialUser finds a peer, known or given by its full user ID, in the DHT
+// and opens a session with it. The record is signed by the user, the
+// handshake then proves the peer is still that user. The DHT is not looked
+// up by pseudo: pseudos are not unique, anyone could claim one.
+func (a *app) dialUser(ctx context.Context, name string) (*manager.Conn, error) {
+	if a.dht == nil {
+		return nil, errors.New("not a multiaddr, and the DHT is off (run with -dht)")
+	}
+	userID := strings.ToLower(name)
+	if p, err := chat.Resolve(name); err == nil {
+		userID = p.UserID
+	} else if !isUserID(userID) {
+		return nil, fmt.Errorf("%w, give the full user_id of a peer never met", err)
+	}
+	if userID == a.identity().UserID {
+		return nil, errors.New("cannot connect to yourself")
+	}
+
+	r, info, err := a.dht.Resolve(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(a.ui, "Found %s in the DHT, connecting to peer: %s\n", r.Pseudo, info.ID)
+	c, err := a.mgr.ConnectPeer(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	if c.UserID() != userID {
+		return nil, fmt.Errorf("peer %s is now %s, not %s", info.ID, c.Pseudo(), r.Pseudo)
+	}
+	return c, nil
+}
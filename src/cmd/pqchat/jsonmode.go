@@ -0,0 +1,468 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"pqchat/src/internal/chat"
+	"pqchat/src/internal/manager"
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/room"
+)
+
+// jsonSchema is bumped on incompatible changes to the commands or events.
+const jsonSchema = 1
+
+// Longest command line accepted on stdin.
+const jsonMaxLine = 1 << 20
+
+/* -----------------------------------------------------------
+In -json mode, stdin takes one command per line and stdout
+gets one event per line. Both are JSON objects.
+-----------------------------------------------------------*/
+
+// jsonCommand is a line of stdin.
+type jsonCommand struct {
+	Cmd    string   `json:"cmd"`              // send, mail, connect, disconnect, peers, room, rooms, quit
+	ID     string   `json:"id,omitempty"`     // echoed in the reply
+	To     []string `json:"to,omitempty"`     // send: pseudos, handles or user_id prefixes, none to broadcast
+	Room   string   `json:"room,omitempty"`   // send: to this room instead, room: the room
+	Body   string   `json:"body,omitempty"`   // send, mail
+	Addr   string   `json:"addr,omitempty"`   // connect: peer multiaddr
+	Peer   string   `json:"peer,omitempty"`   // mail, connect, disconnect, room invite and kick: as in to, or a full user_id for mail and connect
+	Action string   `json:"action,omitempty"` // room: create, invite, accept, kick or leave
+}
+
+// jsonHeader starts every event. ID is the id of the command replied to.
+type jsonHeader struct {
+	Event string `json:"event"`
+	Time  int64  `json:"time"` // Unix milliseconds
+	ID    string `json:"id,omitempty"`
+}
+
+func header(event, id string) jsonHeader {
+	return jsonHeader{Event: event, Time: time.Now().UnixMilli(), ID: id}
+}
+
+type jsonPeer struct {
+	UserID      string `json:"user_id"`
+	Pseudo      string `json:"pseudo"`
+	PeerID      string `json:"peer_id"`
+	Alg         string `json:"alg"`
+	Fingerprint string `json:"fingerprint"`
+	Online      bool   `json:"online"`
+	Trusted     bool   `json:"trusted"`
+	Protocol    string `json:"protocol,omitempty"` // when online
+	Kex         string `json:"kex,omitempty"`      // when online
+}
+
+// "ready": emitted once at startup.
+type jsonReady struct {
+	jsonHeader
+	Schema      int      `json:"schema"`
+	UserID      string   `json:"user_id"`
+	Pseudo      string   `json:"pseudo"`
+	Alg         string   `json:"alg"`
+	Fingerprint string   `json:"fingerprint"`
+	PeerID      string   `json:"peer_id"`
+	Addrs       []string `json:"addrs"`
+}
+
+// "handshake": the result of a handshake, either way.
+type jsonHandshake struct {
+	jsonHeader
+	PeerID  string    `json:"peer_id"`
+	Inbound bool      `json:"inbound"`
+	OK      bool      `json:"ok"`
+	Error   string    `json:"error,omitempty"`
+	Peer    *jsonPeer `json:"peer,omitempty"` // when ok
+}
+
+// "peer_joined" and "peer_left": a session went up or down.
+type jsonPeerEvent struct {
+	jsonHeader
+	Peer   jsonPeer `json:"peer"`
+	Reason string   `json:"reason,omitempty"` // peer_left: "closed" or the error
+}
+
+// "message": a CHAT message was received.
+type jsonMessage struct {
+	jsonHeader
+	From       string   `json:"from"` // user ID
+	FromPseudo string   `json:"from_pseudo"`
+	To         []string `json:"to,omitempty"`   // user IDs, none for a broadcast
+	Room       string   `json:"room,omitempty"` // sent to this room
+	Body       string   `json:"body"`
+	Timestamp  int64    `json:"timestamp"` // sender's clock, Unix seconds
+	Verified   bool     `json:"verified"`
+	Trusted    bool     `json:"trusted"`
+	Offline    bool     `json:"offline,omitempty"` // fetched from the relay's mailbox
+}
+
+// "sent": reply to send.
+type jsonSent struct {
+	jsonHeader
+	To     []string          `json:"to,omitempty"`     // user IDs, none for a broadcast
+	Failed map[string]string `json:"failed,omitempty"` // user ID → error
+}
+
+// "peers": reply to peers.
+type jsonPeers struct {
+	jsonHeader
+	Peers []jsonPeer `json:"peers"`
+}
+
+type jsonRoom struct {
+	Name    string   `json:"name"`
+	Owner   string   `json:"owner"` // user ID
+	Epoch   uint64   `json:"epoch"`
+	Members []string `json:"members"` // user IDs
+}
+
+// "rooms": reply to rooms.
+type jsonRooms struct {
+	jsonHeader
+	Rooms []jsonRoom `json:"rooms"`
+}
+
+// "room": the members of a room changed.
+type jsonRoomEvent struct {
+	jsonHeader
+	Room *jsonRoom `json:"room,omitempty"` // none once we are out
+	Name string    `json:"name"`
+	Text string    `json:"text"`
+}
+
+// "ok": reply to mail, connect, disconnect, room and quit.
+type jsonOK struct {
+	jsonHeader
+	Cmd  string    `json:"cmd"`
+	Peer *jsonPeer `json:"peer,omitempty"`
+}
+
+// "error": a command failed, or something went wrong.
+type jsonError struct {
+	jsonHeader
+	Cmd   string `json:"cmd,omitempty"`
+	Error string `json:"error"`
+}
+
+// "log": any other notice, as the line mode would print it.
+type jsonLog struct {
+	jsonHeader
+	Text string `json:"text"`
+}
+
+// jsonUI is the frontend of -json mode: output written to it becomes log
+// events.
+type jsonUI struct {
+	in *bufio.Scanner
+
+	mu      sync.Mutex
+	enc     *json.Encoder
+	partial string
+}
+
+func newJSONUI(w io.Writer, r io.Reader) *jsonUI {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	in := bufio.NewScanner(r)
+	in.Buffer(make([]byte, 0, 64*1024), jsonMaxLine)
+	return &jsonUI{in: in, enc: enc}
+}
+
+func (j *jsonUI) emit(ev any) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_ = j.enc.Encode(ev)
+}
+
+func (j *jsonUI) ReadLine() (string, error) {
+	if !j.in.Scan() {
+		if err := j.in.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return j.in.Text(), nil
+}
+
+// Write turns complete lines into log events.
+func (j *jsonUI) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	lines := strings.Split(j.partial+string(p), "\n")
+	j.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		if line = strings.TrimSpace(line); line != "" {
+			_ = j.enc.Encode(jsonLog{jsonHeader: header("log", ""), Text: line})
+		}
+	}
+	return len(p), nil
+}
+
+func (j *jsonUI) notify(fn func()) { fn() }
+func (j *jsonUI) refresh()         {}
+func (j *jsonUI) Close()           {}
+
+/* -----------------------------------------------------------
+This turns what happens into events
+-----------------------------------------------------------*/
+
+func (a *app) jsonReady(j *jsonUI) {
+	id := a.identity()
+	ev := jsonReady{
+		jsonHeader:  header("ready", ""),
+		Schema:      jsonSchema,
+		UserID:      id.UserID,
+		Pseudo:      id.Pseudo,
+		Alg:         id.Alg,
+		Fingerprint: id.Fingerprint(),
+		PeerID:      a.h.ID().String(),
+		Addrs:       []string{},
+	}
+	for _, addr := range a.h.Addrs() {
+		ev.Addrs = append(ev.Addrs, fmt.Sprintf("%s/p2p/%s", addr, a.h.ID()))
+	}
+	j.emit(ev)
+}
+
+func jsonConnected(j *jsonUI, c *manager.Conn) {
+	p := connPeer(c)
+	j.emit(jsonHandshake{jsonHeader: header("handshake", ""), PeerID: p.PeerID, Inbound: !c.Outbound, OK: true, Peer: &p})
+	j.emit(jsonPeerEvent{jsonHeader: header("peer_joined", ""), Peer: p})
+}
+
+func jsonDisconnected(j *jsonUI, c *manager.Conn, err error) {
+	reason := "closed"
+	if err != nil {
+		reason = err.Error()
+	}
+	p := connPeer(c)
+	p.Online = false
+	j.emit(jsonPeerEvent{jsonHeader: header("peer_left", ""), Peer: p, Reason: reason})
+}
+
+func jsonFailed(j *jsonUI, p peer.ID, in bool, err error) {
+	j.emit(jsonHandshake{jsonHeader: header("handshake", ""), PeerID: p.String(), Inbound: in, Error: err.Error()})
+}
+
+func jsonDisplay(j *jsonUI) func(m *chat.Message) {
+	return func(m *chat.Message) {
+		j.emit(jsonMessage{
+			jsonHeader: header("message", ""),
+			From:       m.From,
+			FromPseudo: chat.DisplayName(m.From),
+			To:         m.To,
+			Room:       m.Room,
+			Body:       m.Body,
+			Timestamp:  m.Timestamp,
+			Verified:   m.Verified,
+			Trusted:    m.Trusted,
+			Offline:    m.Offline,
+		})
+	}
+}
+
+func jsonRoomNotice(j *jsonUI, rooms *room.Rooms, name, text string) {
+	ev := jsonRoomEvent{jsonHeader: header("room", ""), Name: name, Text: text}
+	if info, ok := rooms.Get(name); ok {
+		r := roomOf(info)
+		ev.Room = &r
+	}
+	j.emit(ev)
+}
+
+func roomOf(info room.Info) jsonRoom {
+	r := jsonRoom{Name: info.Name, Owner: info.Owner, Epoch: info.Epoch, Members: []string{}}
+	for _, m := range info.Members {
+		r.Members = append(r.Members, m.UserID)
+	}
+	return r
+}
+
+func connPeer(c *manager.Conn) jsonPeer {
+	sess := c.Session
+	p := jsonPeer{
+		UserID:      sess.RemoteUserID,
+		Pseudo:      sess.RemotePseudo,
+		PeerID:      c.PeerID().String(),
+		Alg:         sess.RemoteSigAlg,
+		Fingerprint: pqc.Fingerprint(sess.RemotePub),
+		Online:      true,
+		Protocol:    c.Version.String(),
+		Kex:         sess.Kex.String(),
+	}
+	if known, ok := chat.LookupPeer(p.UserID); ok {
+		p.Trusted = known.Trusted
+	}
+	return p
+}
+
+/* -----------------------------------------------------------
+This runs the commands read from stdin
+-----------------------------------------------------------*/
+
+func (a *app) serveJSON(j *jsonUI) {
+	for {
+		line, err := j.ReadLine()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				j.emit(jsonError{jsonHeader: header("error", ""), Error: err.Error()})
+			}
+			return
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var c jsonCommand
+		if err := json.Unmarshal([]byte(line), &c); err != nil {
+			j.emit(jsonError{jsonHeader: header("error", ""), Error: "malformed command: " + err.Error()})
+			continue
+		}
+		ev, err := a.runJSON(&c)
+		if err != nil {
+			j.emit(jsonError{jsonHeader: header("error", c.ID), Cmd: c.Cmd, Error: err.Error()})
+			continue
+		}
+		j.emit(ev)
+		if c.Cmd == "quit" {
+			return
+		}
+	}
+}
+
+// runJSON runs a command and returns its reply event.
+func (a *app) runJSON(c *jsonCommand) (any, error) {
+	switch c.Cmd {
+	case "send":
+		if c.Body == "" {
+			return nil, errors.New("empty body")
+		}
+		if c.Room != "" {
+			if len(c.To) > 0 {
+				return nil, errors.New("to and room are exclusive")
+			}
+			if err := a.rooms.Send(c.Room, c.Body); err != nil {
+				return nil, err
+			}
+			return jsonOK{jsonHeader: header("ok", c.ID), Cmd: c.Cmd}, nil
+		}
+		to, err := a.recipients(c.To)
+		if err != nil {
+			return nil, err
+		}
+		failed, err := a.send(to, c.Body)
+		if err != nil {
+			return nil, err
+		}
+		ev := jsonSent{jsonHeader: header("sent", c.ID), To: to}
+		for userID, err := range failed {
+			if ev.Failed == nil {
+				ev.Failed = make(map[string]string)
+			}
+			ev.Failed[userID] = err.Error()
+		}
+		return ev, nil
+
+	case "mail":
+		if c.Body == "" {
+			return nil, errors.New("empty body")
+		}
+		if err := a.leaveMail(c.Peer, c.Body); err != nil {
+			return nil, err
+		}
+		return jsonOK{jsonHeader: header("ok", c.ID), Cmd: c.Cmd}, nil
+
+	case "connect":
+		ctx, cancel := context.WithTimeout(a.ctx, connectTimeout)
+		defer cancel()
+		var (
+			conn *manager.Conn
+			err  error
+		)
+		switch {
+		case c.Addr != "":
+			conn, err = a.mgr.Connect(ctx, c.Addr)
+		case c.Peer != "":
+			conn, err = a.dialUser(ctx, c.Peer)
+		default:
+			return nil, errors.New("missing addr or peer")
+		}
+		if err != nil {
+			return nil, err
+		}
+		p := connPeer(conn)
+		return jsonOK{jsonHeader: header("ok", c.ID), Cmd: c.Cmd, Peer: &p}, nil
+
+	case "disconnect":
+		p, err := chat.Resolve(c.Peer)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.mgr.Disconnect(p.UserID); err != nil {
+			return nil, err
+		}
+		return jsonOK{jsonHeader: header("ok", c.ID), Cmd: c.Cmd}, nil
+
+	case "peers":
+		ev := jsonPeers{jsonHeader: header("peers", c.ID), Peers: []jsonPeer{}}
+		for _, p := range chat.AllPeers() {
+			if conn, ok := a.mgr.Lookup(p.UserID); ok {
+				ev.Peers = append(ev.Peers, connPeer(conn))
+				continue
+			}
+			ev.Peers = append(ev.Peers, jsonPeer{
+				UserID:      p.UserID,
+				Pseudo:      p.Pseudo,
+				PeerID:      p.PeerID.String(),
+				Alg:         p.Alg,
+				Fingerprint: pqc.Fingerprint(p.Pub),
+				Trusted:     p.Trusted,
+			})
+		}
+		return ev, nil
+
+	case "room":
+		if err := a.roomAction(c.Action, c.Room, c.Peer); err != nil {
+			return nil, err
+		}
+		return jsonOK{jsonHeader: header("ok", c.ID), Cmd: c.Cmd}, nil
+
+	case "rooms":
+		ev := jsonRooms{jsonHeader: header("rooms", c.ID), Rooms: []jsonRoom{}}
+		for _, info := range a.rooms.List() {
+			ev.Rooms = append(ev.Rooms, roomOf(info))
+		}
+		return ev, nil
+
+	case "quit":
+		return jsonOK{jsonHeader: header("ok", c.ID), Cmd: c.Cmd}, nil
+	}
+	return nil, fmt.Errorf("unknown command %q", c.Cmd)
+}
@@ -0,0 +1,208 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"pqchat/src/internal/chat"
+	"pqchat/src/internal/mailbox"
+	"pqchat/src/internal/protocol"
+)
+
+// How often the relay's mailbox is checked, and how long a request to it
+// may take.
+const (
+	mailboxPoll    = time.Minute
+	mailboxTimeout = 30 * time.Second
+)
+
+/* -----------------------------------------------------------
+This sets up the mailbox of the relay, when there is one
+-----------------------------------------------------------*/
+
+// startMailbox loads our prekeys, saved next to the private key file,
+// then publishes them and fetches our mail in the background.
+func (a *app) startMailbox(privPath string) error {
+	if a.relay == "" {
+		return nil
+	}
+	path := ""
+	if privPath != "" {
+		path = privPath + ".prekeys"
+	}
+	keys, err := mailbox.LoadKeys(a.id, path)
+	if err != nil {
+		return err
+	}
+	a.prekeys = keys
+	a.mail = mailbox.NewClient(a.h, a.relay)
+	go a.pollMailbox()
+	return nil
+}
+
+// pollMailbox checks the mailbox until we quit. A relay without one is
+// only reported once.
+func (a *app) pollMailbox() {
+	t := time.NewTicker(mailboxPoll)
+	defer t.Stop()
+	published := ""               // user ID our prekeys are published for
+	kept := make(map[string]bool) // mail we could not open, reported once
+	for first := true; ; first = false {
+		if err := a.checkMailbox(&published, kept); err != nil && first {
+			notifyf(a.ui, "[!] No mailbox on the relay: %v\n", err)
+			return
+		}
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// checkMailbox shows and acknowledges our mail, and publishes our prekeys
+// when they changed or the relayer runs short of one-time prekeys. Mail we
+// cannot open is left on the relay, and reported once.
+func (a *app) checkMailbox(published *string, kept map[string]bool) error {
+	ctx, cancel := context.WithTimeout(a.ctx, mailboxTimeout)
+	defer cancel()
+
+	id := a.identity()
+	mails, oneTime, err := a.mail.Fetch(ctx, id)
+	if err != nil {
+		return err
+	}
+	rotated, err := a.prekeys.Rotate()
+	if err != nil {
+		return err
+	}
+	pending, err := a.prekeys.Replenish(oneTime)
+	if err != nil {
+		return err
+	}
+	if rotated || pending || *published != id.UserID {
+		b, err := a.prekeys.Bundle(id)
+		if err != nil {
+			return err
+		}
+		if err := a.mail.Publish(ctx, b); err != nil {
+			return err
+		}
+		if err := a.prekeys.Published(b); err != nil {
+			return err
+		}
+		*published = id.UserID
+	}
+
+	if len(mails) == 0 {
+		return nil
+	}
+	var ids []string
+	for _, sm := range mails {
+		received := time.Unix(sm.Received, 0).Format("Jan 2 15:04")
+		msg, err := a.prekeys.Open(id.UserID, &sm.Mail)
+		switch {
+		case errors.Is(err, mailbox.ErrReplayed), errors.Is(err, mailbox.ErrStaleMail):
+			// Shown already, or too old to trust: nothing to keep
+			ids = append(ids, sm.ID)
+			notifyf(a.ui, "[!] Dropped mail left on %s: %v\n", received, err)
+			continue
+		case err != nil:
+			if !kept[sm.ID] {
+				kept[sm.ID] = true
+				notifyf(a.ui, "[!] Cannot open mail left on %s, kept on the relay: %v\n", received, err)
+			}
+			continue
+		}
+		ids = append(ids, sm.ID)
+		learnSender(msg)
+		a.ui.notify(func() { chat.HandleMail(msg) })
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return a.mail.Ack(ctx, id, ids)
+}
+
+// learnSender adds the sender of a mail to the directory when we have
+// never met it, so it is shown by its pseudo and can be answered.
+func learnSender(msg *protocol.ChatMessage) {
+	if _, ok := chat.LookupPeer(msg.From); ok {
+		return
+	}
+	pub, err := base64.StdEncoding.DecodeString(msg.Pub)
+	if err != nil {
+		return
+	}
+	chat.RegisterPeer(msg.From, msg.Pseudo, msg.Alg, pub, "")
+}
+
+/* -----------------------------------------------------------
+This leaves mail for a peer who is offline
+-----------------------------------------------------------*/
+
+// leaveMail encrypts body to the prekeys of a peer, known or given by its
+// full user ID, and leaves it on the relay.
+func (a *app) leaveMail(name, body string) error {
+	if a.mail == nil {
+		return errors.New("no mailbox, run with -relay")
+	}
+	id := a.identity()
+	userID := strings.ToLower(name)
+	if p, err := chat.Resolve(name); err == nil {
+		userID = p.UserID
+	} else if !isUserID(userID) {
+		return err
+	}
+	if userID == id.UserID {
+		return errors.New("no mail to yourself")
+	}
+
+	ctx, cancel := context.WithTimeout(a.ctx, mailboxTimeout)
+	defer cancel()
+	b, err := a.mail.Prekeys(ctx, userID)
+	if err != nil {
+		return err
+	}
+	_, raw, err := protocol.BuildMailChat(id, userID, body)
+	if err != nil {
+		return err
+	}
+	m, err := mailbox.Seal(b, raw)
+	if err != nil {
+		return err
+	}
+	if err := a.mail.Put(ctx, m); err != nil {
+		return err
+	}
+	if m.OneTime == "" {
+		fmt.Fprintf(a.ui, "Mail for %s left on the relay (no one-time prekey left, sealed to the signed prekey only)\n", b.Pseudo)
+		return nil
+	}
+	fmt.Fprintf(a.ui, "Mail for %s left on the relay\n", b.Pseudo)
+	return nil
+}
+
+func isUserID(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 32
+}
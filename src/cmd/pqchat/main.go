@@ -15,48 +15,145 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
 	"syscall"
+	"time"
 
+	libp2p "github.com/libp2p/go-libp2p"
 	libhost "github.com/libp2p/go-libp2p/core/host"
-	"github.com/libp2p/go-libp2p/core/network"
 	peer "github.com/libp2p/go-libp2p/core/peer"
 
+	"pqchat/src/internal/chat"
+	"pqchat/src/internal/cli"
+	"pqchat/src/internal/dht"
+	"pqchat/src/internal/manager"
 	p2pnet "pqchat/src/internal/net"
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/protocol"
 	"pqchat/src/internal/session"
 )
 
 var (
 	flagRelay   = flag.String("relay", "", "relay multiaddr, e.g. /ip4/1.2.3.4/tcp/4001/p2p/<id>")
-	flagConnect = flag.String("connect", "", "peer multiaddr to connect to (optional)")
+	flagConnect = flag.String("connect", "", "peer multiaddr, or peer user ID with -dht, to connect to (optional)")
+	flagPseudo  = flag.String("pseudo", "", "user pseudo (optional)")
+	flagPriv    = flag.String("ml-dsa-priv", "", "ML-DSA private key file (created if missing)")
+	flagPub     = flag.String("ml-dsa-pub", "", "ML-DSA public key file (created if missing)")
+	flagPass    = flag.String("passphrase", "prompt", "private key passphrase source: prompt, env:NAME or fd:N")
+	flagNewPass = flag.String("new-passphrase", "prompt", "new passphrase source for -change-passphrase")
+	flagChPass  = flag.Bool("change-passphrase", false, "re-encrypt the -ml-dsa-priv key file and exit")
+	flagUnverif = flag.String("unverified", "drop", "what to do with unverified messages: drop or flag")
+	flagKex     = flag.String("kex", "any", "key exchange: hybrid (X25519+ML-KEM), mlkem (pure ML-KEM) or any")
+	flagKems    = flag.String("kems", "", "key exchange preference list, e.g. ML-KEM-512,ML-KEM-768 (overrides -kex)")
+	flagMinLvl  = flag.Int("min-level", 3, "minimum NIST security level accepted for KEM and peer signatures")
+	flagSigAlg  = flag.String("sig-alg", pqc.SigAlgorithm, "signature algorithm of the identity, new or in the key files")
+	flagRkMsgs  = flag.Uint64("rekey-msgs", 100, "take a KEM ratchet step after sending this many messages (0: never)")
+	flagRkBytes = flag.Uint64("rekey-bytes", 1<<20, "take a KEM ratchet step after sending this many bytes (0: never)")
+	flagRkTime  = flag.Duration("rekey-interval", 10*time.Minute, "take a KEM ratchet step after this long (0: never)")
+	flagMaxFrm  = flag.Int("max-frame", p2pnet.DefaultMaxFrameSize, "maximum size of a received frame, in bytes")
+	flagMaxMsg  = flag.Int("max-message", p2pnet.DefaultMaxMessageSize, "maximum size of a received message, in bytes")
+	flagProtos  = flag.String("protocols", "", "protocol versions to speak, e.g. 2.0 (default: all supported)")
+	flagTUI     = flag.Bool("tui", false, "full-screen terminal UI instead of line mode")
+	flagJSON    = flag.Bool("json", false, "JSON commands on stdin and JSON events on stdout, for scripts and bots")
+	flagGossip  = flag.Bool("gossip", false, "publish room messages over GossipSub instead of every session (all room members must use it)")
+	flagDHT     = flag.Bool("dht", false, "join the DHT, to be found and find peers by user ID")
+	flagDHTBoot = flag.String("dht-bootstrap", "", "comma-separated multiaddrs of DHT nodes to join through (default: the relay)")
 )
 
 func main() {
 	flag.Parse()
 
+	// In -json mode stdout only carries events, anything else goes to stderr
+	events := os.Stdout
+	if *flagJSON {
+		if *flagTUI {
+			fmt.Fprintln(os.Stderr, "-json and -tui are exclusive")
+			os.Exit(2)
+		}
+		os.Stdout = os.Stderr
+	}
+
+	if *flagChPass {
+		if err := changePassphrase(*flagPriv, *flagPass, *flagNewPass); err != nil {
+			fmt.Println("Cannot change passphrase:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Passphrase changed for", *flagPriv)
+		return
+	}
+
+	policy, err := chat.ParsePolicy(*flagUnverif)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	chat.SetUnverifiedPolicy(policy)
+
+	hsCfg, err := handshakeConfig()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	if err := p2pnet.SetLimits(*flagMaxFrm, *flagMaxMsg); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	versions, err := p2pnet.ParseVersions(*flagProtos)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
 	if *flagRelay == "" {
 		fmt.Println("⚠️ No relay configured, running in direct TCP mode.")
 	}
 
+	id, err := loadIdentity(*flagPseudo, *flagSigAlg, *flagPriv, *flagPub, *flagPass)
+	if err != nil {
+		fmt.Println("Cannot load identity:", err)
+		return
+	}
+	chat.SetLocalUser(id.UserID)
+	fmt.Printf("Your PQ identity (%s): %s\n", id.Alg, id.UserID)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// gestion Ctrl+C
+	// Ctrl+C stops what is in progress, the ui reports it once it is up
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	interrupted := make(chan struct{})
 	go func() {
 		<-sigCh
-		fmt.Println("\n[!] Interrupt, shutting down…")
+		close(interrupted)
 		cancel()
 	}()
 
-	h, err := p2pnet.NewHost("/ip4/0.0.0.0/tcp/0")
+	var (
+		hostOpts []libp2p.Option
+		node     *dht.DHT
+	)
+	if *flagDHT {
+		bootstrap := *flagDHTBoot
+		if bootstrap == "" {
+			bootstrap = *flagRelay
+		}
+		if peers, err := dhtBootstrap(bootstrap); err != nil {
+			fmt.Println("DHT disabled:", err)
+		} else {
+			hostOpts = append(hostOpts, dht.Routing(ctx, false, peers, &node))
+		}
+	}
+	h, err := p2pnet.NewHost("/ip4/0.0.0.0/tcp/0", hostOpts...)
 	if err != nil {
 		fmt.Println("Cannot create host:", err)
 		return
@@ -73,95 +170,280 @@ func main() {
 		return
 	}
 
-	// Handler for incoming streams
-	h.SetStreamHandler("/pqchat/1.0.0", func(s network.Stream) {
-		fmt.Println("\nIncoming connection from", s.Conn().RemotePeer())
+	var gossip *p2pnet.Gossip
+	if *flagGossip {
+		if gossip, err = p2pnet.NewGossip(ctx, h); err != nil {
+			fmt.Println("Cannot start GossipSub:", err)
+			return
+		}
+	}
+
+	a := &app{ctx: ctx, h: h, id: id, dht: node, handshakes: make(map[peer.ID]error)}
+	defer func() { a.id.Close() }()
+	if info, err := peer.AddrInfoFromString(*flagRelay); err == nil {
+		a.relay = info.ID
+	}
+	cmds := a.commands()
 
-		sess, err := session.ServerHandshake(s)
-		if err != nil {
-			fmt.Println("Handshake (server) failed:", err)
-			_ = s.Reset()
+	var (
+		ui frontend
+		js *jsonUI
+	)
+	switch {
+	case *flagJSON:
+		js = newJSONUI(events, os.Stdin)
+		ui = js
+		chat.SetDisplay(jsonDisplay(js))
+	case *flagTUI:
+		if ui, err = newTUI(cmds.Complete, a.status); err != nil {
+			fmt.Println("Cannot start the TUI:", err)
 			return
 		}
-		fmt.Println("PQC session established (server side)")
+	default:
+		ui = newConsole(cmds.Complete)
+	}
+	defer ui.Close()
+	a.ui = ui
+	chat.SetOutput(ui)
 
-		rd := bufio.NewReader(s)
+	// Printing under the TUI would corrupt its screen, tell the ui instead
+	stopped, reported := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(reported)
+		select {
+		case <-interrupted:
+			notifyf(ui, "[!] Interrupt, shutting down…\n")
+		case <-stopped:
+		}
+	}()
+	defer func() {
+		close(stopped)
+		<-reported
+	}()
+	switch {
+	case *flagJSON:
+		a.jsonReady(js)
+	case *flagTUI:
+		a.whoami()
+	}
 
-		for {
-			frame, err := p2pnet.ReadFrame(rd)
-			if err != nil {
-				// stream fermé
+	// Sessions with every peer, whoever dialed
+	mgr := manager.New(h, id, hsCfg, versions, manager.Handlers{
+		Handshaking: func(p peer.ID, in bool) {
+			a.setHandshake(p, nil)
+			ui.refresh()
+		},
+		Connected: func(c *manager.Conn) {
+			side := "server"
+			if c.Outbound {
+				side = "client"
+			}
+			sess := c.Session
+			chat.RegisterPeer(sess.RemoteUserID, sess.RemotePseudo, sess.RemoteSigAlg, sess.RemotePub, sess.RemotePeer)
+			a.clearHandshake(c.PeerID())
+			if js != nil {
+				jsonConnected(js, c)
 				return
 			}
-
-			pt, err := sess.Decrypt(frame)
-			if err != nil {
-				fmt.Println("Decrypt failed:", err)
+			notifyf(ui, "PQC session established (%s side, protocol %s, %s/%s) with %s [%s]\n", side, c.Version, sess.Kex, sess.RemoteSigAlg, sess.RemotePseudo, sess.RemoteUserID)
+		},
+		Disconnected: func(c *manager.Conn, err error) {
+			switch {
+			case js != nil:
+				jsonDisconnected(js, c, err)
+			case err != nil:
+				notifyf(ui, "Session with %s lost: %v\n", c.Pseudo(), err)
+			default:
+				notifyf(ui, "Session with %s closed\n", c.Pseudo())
+			}
+		},
+		Frame: func(c *manager.Conn, f *p2pnet.Frame) {
+			if f.Type == p2pnet.FrameRoom {
+				a.roomFrame(c, f.Payload)
 				return
 			}
-
-			fmt.Printf("\n[%s] %s\n> ", s.Conn().RemotePeer(), string(pt))
-		}
+			ui.notify(func() { chat.HandleIncoming(c.PeerID(), c.UserID(), f) })
+		},
+		Failed: func(p peer.ID, in bool, err error) {
+			a.setHandshake(p, err)
+			switch {
+			case js != nil:
+				jsonFailed(js, p, in, err)
+			case in:
+				notifyf(ui, "Handshake (server) with %s failed: %v\n", p, err)
+			default:
+				ui.refresh()
+			}
+		},
 	})
+	a.mu.Lock()
+	a.mgr = mgr
+	a.rooms = a.newRooms(mgr, js)
+	if gossip != nil {
+		a.rooms.UseTopics(gossip)
+	}
+	a.mu.Unlock()
 
-	// If we have a destination peer, connect to it immediately
-	var (
-		activeSess *session.Session
-		activeStrm network.Stream
-	)
+	if err := a.startMailbox(*flagPriv); err != nil {
+		fmt.Fprintln(ui, "Mailbox disabled:", err)
+	}
+	if a.prekeys != nil {
+		defer a.prekeys.Close()
+	}
 
+	if a.dht != nil {
+		defer a.dht.Close()
+		a.startDHT()
+	}
+
+	// If we have a destination peer, connect to it immediately
 	if *flagConnect != "" {
-		activeSess, activeStrm, err = connectToPeer(ctx, h, *flagConnect)
-		if err != nil {
-			fmt.Println("Initial peer connect failed:", err)
+		if err := a.connect(*flagConnect); err != nil {
+			fmt.Fprintln(ui, "Initial peer connect failed:", err)
 		}
 	}
 
-	// Interactive loop
-	reader := bufio.NewScanner(os.Stdin)
-	fmt.Print("> ")
-	for reader.Scan() {
-		line := strings.TrimSpace(reader.Text())
+	if js != nil {
+		a.serveJSON(js)
+	} else {
+		a.serveLines(cmds)
+	}
+
+	// fin: say goodbye and let peers drain their streams before the host goes
+	a.rooms.Close()
+	if gossip != nil {
+		gossip.Close()
+	}
+	mgr.Close()
+	_ = h.Close()
+}
+
+/* -----------------------------------------------------------
+This is the interactive loop: commands, or chat lines
+-----------------------------------------------------------*/
+
+func (a *app) serveLines(cmds *cli.Dispatcher) {
+	for {
+		line, err := a.ui.ReadLine()
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
 		if line == "" {
-			fmt.Print("> ")
 			continue
 		}
 
-		// If no active session, try to connect now
-		if activeSess == nil || activeStrm == nil {
-			if *flagConnect == "" {
-				fmt.Println("No peer connected. Start pqchat with -connect <multiaddr>")
-				fmt.Print("> ")
-				continue
+		if cli.IsCommand(line) {
+			err := cmds.Run(line)
+			if errors.Is(err, cli.ErrQuit) {
+				return
 			}
-			activeSess, activeStrm, err = connectToPeer(ctx, h, *flagConnect)
 			if err != nil {
-				fmt.Println("Cannot connect to peer:", err)
-				fmt.Print("> ")
-				continue
+				fmt.Fprintln(a.ui, err)
 			}
+			continue
 		}
 
-		ct, err := activeSess.Encrypt([]byte(line))
-		if err != nil {
-			fmt.Println("Encrypt failed:", err)
-			fmt.Print("> ")
+		if strings.HasPrefix(line, "#") {
+			a.roomLine(line)
 			continue
 		}
+		if rest, ok := strings.CutPrefix(line, `\#`); ok {
+			line = "#" + rest
+		}
 
-		if err := p2pnet.WriteFrame(activeStrm, ct); err != nil {
-			fmt.Println("Send failed:", err)
-			activeSess = nil
-			activeStrm = nil
-			fmt.Print("> ")
-			continue
+		// If nobody is connected, try to connect now
+		if len(a.mgr.Conns()) == 0 {
+			if *flagConnect == "" {
+				fmt.Fprintln(a.ui, "No peer connected. Use /connect <multiaddr|peer|user_id>")
+				continue
+			}
+			if err := a.connect(*flagConnect); err != nil {
+				fmt.Fprintln(a.ui, "Cannot connect to peer:", err)
+				continue
+			}
 		}
 
-		fmt.Print("> ")
+		a.sendChat(cli.Unescape(line))
 	}
+}
 
-	// fin
-	_ = h.Close()
+/* -----------------------------------------------------------
+This loads the ML-DSA identity, creating it if needed
+-----------------------------------------------------------*/
+
+func loadIdentity(pseudo, alg, privPath, pubPath, passSpec string) (*pqc.Identity, error) {
+	if privPath == "" && pubPath == "" {
+		fmt.Println("⚠️ No identity files given, using an ephemeral identity.")
+		return pqc.NewIdentity(pseudo, alg)
+	}
+	if privPath == "" || pubPath == "" {
+		return nil, fmt.Errorf("both -ml-dsa-priv and -ml-dsa-pub are required")
+	}
+
+	pass, wipe, err := passphraseSource(passSpec, "Identity")
+	if err != nil {
+		return nil, err
+	}
+	defer wipe()
+
+	id, created, err := pqc.LoadOrCreateIdentity(pseudo, alg, privPath, pubPath, pass)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		fmt.Println("⚠️ New identity created, keys saved to", privPath, "and", pubPath)
+	}
+	if !id.Sealed() {
+		fmt.Println("⚠️ Private key is stored in plaintext, run with -change-passphrase to encrypt it.")
+	}
+	return id, nil
+}
+
+/* -----------------------------------------------------------
+This builds the handshake policy from the command line
+-----------------------------------------------------------*/
+
+func handshakeConfig() (*session.Config, error) {
+	cfg := session.DefaultConfig()
+	cfg.MinLevel = *flagMinLvl
+	cfg.Rekey = session.RekeyPolicy{
+		Messages: *flagRkMsgs,
+		Bytes:    *flagRkBytes,
+		Interval: *flagRkTime,
+	}
+
+	var err error
+	if *flagKems != "" {
+		cfg.KexModes, err = session.ParseKexList(*flagKems)
+	} else {
+		cfg.KexModes, err = session.ParseKexPolicy(*flagKex)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+/* -----------------------------------------------------------
+This re-encrypts the private key file under a new passphrase
+-----------------------------------------------------------*/
+
+func changePassphrase(privPath, oldSpec, newSpec string) error {
+	if privPath == "" {
+		return fmt.Errorf("-ml-dsa-priv is required")
+	}
+	oldPass, wipeOld, err := passphraseSource(oldSpec, "Current")
+	if err != nil {
+		return err
+	}
+	defer wipeOld()
+	newPass, wipeNew, err := passphraseSource(newSpec, "New")
+	if err != nil {
+		return err
+	}
+	defer wipeNew()
+	return pqc.ChangePassphrase(privPath, oldPass, newPass)
 }
 
 /* -----------------------------------------------------------
@@ -187,32 +469,97 @@ func connectRelay(ctx context.Context, h libhost.Host, maddrStr string) error {
 }
 
 /* -----------------------------------------------------------
-This connectx to a peer and make the handshake
+This connects to a peer and makes the handshake
 -----------------------------------------------------------*/
 
-func connectToPeer(ctx context.Context, h libhost.Host, maddrStr string) (*session.Session, network.Stream, error) {
-	info, err := peer.AddrInfoFromString(maddrStr)
+// connect takes a multiaddr, or a peer to look up in the DHT.
+func (a *app) connect(target string) error {
+	ctx, cancel := context.WithTimeout(a.ctx, connectTimeout)
+	defer cancel()
+	if !strings.HasPrefix(target, "/") {
+		_, err := a.dialUser(ctx, target)
+		return err
+	}
+	fmt.Fprintln(a.ui, "Connecting to peer:", target)
+	_, err := a.mgr.Connect(ctx, target)
+	return err
+}
+
+/* -----------------------------------------------------------
+This sends a chat line: broadcast, or to the @mentioned users only
+-----------------------------------------------------------*/
+
+func (a *app) sendChat(line string) {
+	names, body := chat.ParseMentions(line)
+	if body == "" {
+		fmt.Fprintln(a.ui, "Nothing to send")
+		return
+	}
+	to, err := a.recipients(names)
 	if err != nil {
-		return nil, nil, fmt.Errorf("invalid peer multiaddr: %w", err)
+		fmt.Fprintln(a.ui, "Not sent:", err)
+		return
 	}
+	a.say(to, body)
+}
 
-	fmt.Println("Connecting to peer:", info.ID)
-	if err := h.Connect(ctx, *info); err != nil {
-		return nil, nil, fmt.Errorf("peer connect: %w", err)
+// recipients resolves names to user IDs, leaving ourselves out. Every
+// name must resolve, a typo never turns into a partial send.
+func (a *app) recipients(names []string) ([]string, error) {
+	id := a.identity()
+	var to []string
+	for _, name := range names {
+		if strings.EqualFold(name, id.Pseudo) {
+			continue
+		}
+		p, err := chat.Resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		if p.UserID != id.UserID && !slices.Contains(to, p.UserID) {
+			to = append(to, p.UserID)
+		}
+	}
+	if len(names) > 0 && len(to) == 0 {
+		return nil, errors.New("no recipient besides yourself")
 	}
+	return to, nil
+}
 
-	s, err := h.NewStream(ctx, info.ID, "/pqchat/1.0.0")
+// say sends body and reports the failures.
+func (a *app) say(to []string, body string) {
+	failed, err := a.send(to, body)
 	if err != nil {
-		return nil, nil, fmt.Errorf("open stream: %w", err)
+		fmt.Fprintln(a.ui, "Sign failed:", err)
+		return
+	}
+	for userID, err := range failed {
+		fmt.Fprintf(a.ui, "Send to %s failed: %v\n", chat.DisplayName(userID), err)
 	}
+}
 
-	fmt.Println("Running PQC client handshake…")
-	sess, err := session.ClientHandshake(s)
+// send signs body for the given users (none: everybody) and gives each
+// session its own encrypted copy. It returns the failures by user ID, the
+// sessions concerned being closed.
+func (a *app) send(to []string, body string) (map[string]error, error) {
+	_, raw, err := protocol.BuildChat(a.identity(), to, body, false)
 	if err != nil {
-		_ = s.Reset()
-		return nil, nil, fmt.Errorf("pqc handshake: %w", err)
+		return nil, err
 	}
-
-	fmt.Println("PQC session established (client side)")
-	return sess, s, nil
+	f := &p2pnet.Frame{Type: p2pnet.FrameChat, Payload: raw}
+
+	failed := map[string]error{}
+	if len(to) == 0 {
+		failed = a.mgr.Broadcast(f)
+	} else {
+		for _, userID := range to {
+			if err := a.mgr.Send(userID, f); err != nil {
+				failed[userID] = err
+			}
+		}
+	}
+	for userID := range failed {
+		_ = a.mgr.Disconnect(userID)
+	}
+	return failed, nil
 }
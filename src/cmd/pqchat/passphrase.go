@@ -0,0 +1,115 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+
+	"pqchat/src/internal/pqc"
+)
+
+/* -----------------------------------------------------------
+This returns a passphrase source from a -passphrase flag value:
+  prompt     ask on the terminal (default)
+  env:NAME   read the NAME environment variable
+  fd:N       read the first line of file descriptor N
+The returned wipe function clears what the source keeps in memory, call it
+once the passphrase is no longer needed.
+-----------------------------------------------------------*/
+
+func passphraseSource(spec, what string) (pass pqc.PassphraseFunc, wipe func(), err error) {
+	switch {
+	case spec == "" || spec == "prompt":
+		return func(confirm bool) ([]byte, error) {
+			return promptPassphrase(what, confirm)
+		}, func() {}, nil
+
+	case strings.HasPrefix(spec, "env:"):
+		name := strings.TrimPrefix(spec, "env:")
+		return func(bool) ([]byte, error) {
+			v, ok := os.LookupEnv(name)
+			if !ok || v == "" {
+				return nil, fmt.Errorf("environment variable %s is not set", name)
+			}
+			return []byte(v), nil
+		}, func() {}, nil
+
+	case strings.HasPrefix(spec, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(spec, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, nil, fmt.Errorf("invalid passphrase fd %q", spec)
+		}
+		// The descriptor can only be read once, keep the result
+		var cached []byte
+		pass = func(bool) ([]byte, error) {
+			if cached == nil {
+				f := os.NewFile(uintptr(fd), "passphrase-fd")
+				if f == nil {
+					return nil, fmt.Errorf("bad file descriptor %d", fd)
+				}
+				line, err := bufio.NewReader(f).ReadBytes('\n')
+				f.Close()
+				if err != nil && len(line) == 0 {
+					return nil, fmt.Errorf("read passphrase fd: %w", err)
+				}
+				cached = bytes.TrimRight(line, "\r\n")
+			}
+			return bytes.Clone(cached), nil
+		}
+		wipe = func() {
+			pqc.Wipe(cached)
+			cached = nil
+		}
+		return pass, wipe, nil
+	}
+
+	return nil, nil, fmt.Errorf("invalid passphrase source %q (want prompt, env:NAME or fd:N)", spec)
+}
+
+func promptPassphrase(what string, confirm bool) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("stdin is not a terminal, use env:NAME or fd:N")
+	}
+
+	fmt.Fprintf(os.Stderr, "%s passphrase: ", what)
+	p1, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if !confirm {
+		return p1, nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Repeat %s passphrase: ", strings.ToLower(what))
+	p2, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(p1, p2) {
+		return nil, errors.New("passphrases do not match")
+	}
+	return p1, nil
+}
@@ -0,0 +1,237 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"pqchat/src/internal/chat"
+	"pqchat/src/internal/cli"
+	"pqchat/src/internal/manager"
+	"pqchat/src/internal/protocol"
+	"pqchat/src/internal/room"
+)
+
+// Sub-commands of /room.
+var roomActions = []string{"create", "invite", "accept", "kick", "leave", "list"}
+
+/* -----------------------------------------------------------
+This sets up the rooms, once the session manager exists
+-----------------------------------------------------------*/
+
+func (a *app) newRooms(mgr *manager.Manager, js *jsonUI) *room.Rooms {
+	return room.New(mgr.Identity, mgr, roomPeer, room.Handlers{
+		Message: func(msg *protocol.ChatMessage) {
+			a.learnMember(msg)
+			a.ui.notify(func() { chat.HandleChat(msg, true) })
+		},
+		Notice: func(name, text string) {
+			if js != nil {
+				jsonRoomNotice(js, a.rooms, name, text)
+				return
+			}
+			notifyf(a.ui, "[#%s] %s\n", name, text)
+			a.ui.refresh()
+		},
+		Invite: func(name, pseudo string) {
+			if js != nil {
+				jsonRoomNotice(js, a.rooms, name, pseudo+" invited you")
+				return
+			}
+			notifyf(a.ui, "[#%s] %s invites you, %sroom accept #%[1]s to join\n", name, pseudo, cli.Prefix)
+		},
+	})
+}
+
+// roomPeer gives the rooms the keys of the peers we have a session with.
+func roomPeer(userID string) (room.Peer, bool) {
+	p, ok := chat.LookupPeer(userID)
+	if !ok {
+		return room.Peer{}, false
+	}
+	return room.Peer{Pseudo: p.Pseudo, Alg: p.Alg, Pub: p.Pub}, true
+}
+
+// learnMember adds the sender of a room message to the directory when we
+// have never had a session with it, so it is shown by its pseudo.
+func (a *app) learnMember(msg *protocol.ChatMessage) {
+	if _, ok := chat.LookupPeer(msg.From); ok {
+		return
+	}
+	info, _ := a.rooms.Get(msg.Room)
+	for _, m := range info.Members {
+		if m.UserID != msg.From {
+			continue
+		}
+		if pub, _, err := m.Keys(); err == nil {
+			chat.RegisterPeer(m.UserID, m.Pseudo, m.Alg, pub, "")
+		}
+	}
+}
+
+// roomFrame handles a room frame from a session. It may come before the
+// rooms are set up.
+func (a *app) roomFrame(c *manager.Conn, payload []byte) {
+	a.mu.Lock()
+	rooms := a.rooms
+	a.mu.Unlock()
+	if rooms == nil {
+		return
+	}
+	if err := rooms.Handle(c.UserID(), payload); err != nil {
+		fmt.Fprintf(a.ui, "[!] Rejected room message from %s: %v\n", c.Pseudo(), err)
+	}
+}
+
+/* -----------------------------------------------------------
+This is the /room command
+-----------------------------------------------------------*/
+
+func (a *app) roomCommand() *cli.Command {
+	return &cli.Command{
+		Name: "room", Args: "<create|invite|accept|kick|leave|list> [#room] [peer]",
+		Help:    "manage group rooms, then send with #room text",
+		MinArgs: 1, MaxArgs: 3,
+		Complete: func(n int) []string {
+			switch n {
+			case 0:
+				return roomActions
+			case 1:
+				return a.roomWords()
+			case 2:
+				return chat.Names()
+			}
+			return nil
+		},
+		Run: func(args []string) error {
+			if args[0] == "list" {
+				a.listRooms()
+				return nil
+			}
+			if len(args) < 2 {
+				return fmt.Errorf("%w, usage: %sroom %s #room", cli.ErrUsage, cli.Prefix, args[0])
+			}
+			peer := ""
+			if len(args) > 2 {
+				peer = args[2]
+			}
+			return a.roomAction(args[0], args[1], peer)
+		},
+	}
+}
+
+// roomAction runs a /room sub-command, or the JSON room command.
+func (a *app) roomAction(action, name, peer string) error {
+	name, err := room.Normalize(name)
+	if err != nil {
+		return err
+	}
+	needPeer := action == "invite" || action == "kick"
+	switch {
+	case needPeer && peer == "":
+		return fmt.Errorf("%w, usage: %sroom %s #room <peer>", cli.ErrUsage, cli.Prefix, action)
+	case !needPeer && peer != "":
+		return fmt.Errorf("%w, usage: %sroom %s #room", cli.ErrUsage, cli.Prefix, action)
+	}
+	var userID string
+	if needPeer {
+		p, err := chat.Resolve(peer)
+		if err != nil {
+			return err
+		}
+		userID = p.UserID
+	}
+
+	switch action {
+	case "create":
+		if err := a.rooms.Create(name); err != nil {
+			return err
+		}
+		fmt.Fprintf(a.ui, "Room #%s created, %sroom invite #%[1]s <peer> to add members\n", name, cli.Prefix)
+	case "invite":
+		if err := a.rooms.Invite(name, userID); err != nil {
+			return err
+		}
+		fmt.Fprintln(a.ui, "Invited", chat.DisplayName(userID))
+	case "accept":
+		if err := a.rooms.Accept(name); err != nil {
+			return err
+		}
+		fmt.Fprintf(a.ui, "Joining #%s\n", name)
+	case "kick":
+		return a.rooms.Kick(name, userID)
+	case "leave":
+		if err := a.rooms.Leave(name); err != nil {
+			return err
+		}
+		fmt.Fprintf(a.ui, "Left #%s\n", name)
+	default:
+		return fmt.Errorf("%w: unknown action %q, try one of %s", cli.ErrUsage, action, strings.Join(roomActions, ", "))
+	}
+	a.ui.refresh()
+	return nil
+}
+
+func (a *app) listRooms() {
+	list, invites := a.rooms.List(), a.rooms.Invitations()
+	if len(list) == 0 && len(invites) == 0 {
+		fmt.Fprintln(a.ui, "No room, /room create #name to make one")
+		return
+	}
+	for _, r := range list {
+		names := make([]string, len(r.Members))
+		for i, m := range r.Members {
+			names[i] = m.Pseudo
+			if m.UserID == r.Owner {
+				names[i] += "*"
+			}
+		}
+		fmt.Fprintf(a.ui, "  #%-16s epoch %-4d %s\n", r.Name, r.Epoch, strings.Join(names, ", "))
+	}
+	for _, inv := range invites {
+		fmt.Fprintf(a.ui, "  #%-16s invited by %s, %sroom accept #%[1]s to join\n", inv.Room, inv.Pseudo, cli.Prefix)
+	}
+}
+
+// roomWords completes room names, those we are invited to included.
+func (a *app) roomWords() []string {
+	names := a.rooms.Names()
+	for i, n := range names {
+		names[i] = "#" + n
+	}
+	for _, inv := range a.rooms.Invitations() {
+		names = append(names, "#"+inv.Room)
+	}
+	return names
+}
+
+// roomLine sends "#room text" to a room. A line for a room we are not in
+// is not sent anywhere else: it may not be meant for everybody.
+func (a *app) roomLine(line string) {
+	name, body, _ := strings.Cut(line, " ")
+	if _, ok := a.rooms.Get(name); !ok {
+		fmt.Fprintf(a.ui, "Not in room %s, not sent (start with \\# for a leading #)\n", name)
+		return
+	}
+	body = strings.TrimSpace(body)
+	if body == "" {
+		fmt.Fprintln(a.ui, "Nothing to send")
+		return
+	}
+	if err := a.rooms.Send(name, body); err != nil {
+		fmt.Fprintln(a.ui, "Not sent:", err)
+	}
+}
@@ -0,0 +1,501 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/rivo/uniseg"
+
+	"pqchat/src/internal/chat"
+)
+
+const (
+	tuiScrollback = 2000            // lines kept in the message pane
+	tuiHistory    = 100             // input lines kept for up/down
+	tuiSideWidth  = 26              // sidebar width, hidden on narrow terminals
+	tuiTick       = 2 * time.Second // status refresh, e.g. for the relay
+)
+
+// presence is the state of a peer shown in the sidebar.
+type presence int
+
+const (
+	presOffline   presence = iota // known, no session
+	presOnline                    // session up
+	presHandshake                 // handshake in progress
+	presFailed                    // last handshake failed
+)
+
+// sideItem is a line of the sidebar.
+type sideItem struct {
+	name    string
+	state   presence
+	trusted bool // fingerprint checked with /verify
+}
+
+// statusFunc returns the status bar and the sidebar.
+type statusFunc func() (string, []sideItem)
+
+/* -----------------------------------------------------------
+The TUI is a full-screen frontend: a status bar, a scrolling
+message pane, a peer sidebar and an input line with history
+and tab completion.
+-----------------------------------------------------------*/
+
+type tui struct {
+	s        tcell.Screen
+	complete completeFunc
+	status   statusFunc
+	lines    chan string // submitted input
+	quit     chan struct{}
+	eofOnce  sync.Once
+
+	mu      sync.Mutex
+	out     []string // message pane, without newlines
+	partial bool     // the last line of out is not terminated yet
+	scroll  int      // rows scrolled back from the bottom
+	input   []rune
+	pos     int // cursor, in runes
+	history []string
+	hist    int // browsed history entry, len(history) when editing
+	saved   []rune
+}
+
+func newTUI(complete completeFunc, status statusFunc) (*tui, error) {
+	s, err := tcell.NewScreen()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Init(); err != nil {
+		return nil, err
+	}
+	s.EnablePaste()
+
+	t := &tui{
+		s:        s,
+		complete: complete,
+		status:   status,
+		lines:    make(chan string, 16),
+		quit:     make(chan struct{}),
+	}
+	t.draw()
+	go t.events()
+	go t.ticker()
+	return t, nil
+}
+
+// ReadLine returns the next submitted line, io.EOF on Ctrl+C or Ctrl+D.
+func (t *tui) ReadLine() (string, error) {
+	select {
+	case line := <-t.lines:
+		return line, nil
+	case <-t.quit:
+		return "", io.EOF
+	}
+}
+
+// Write appends to the message pane.
+func (t *tui) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	t.mu.Lock()
+	parts := strings.Split(strings.ReplaceAll(string(p), "\r", ""), "\n")
+	for i, part := range parts {
+		last := i == len(parts)-1
+		if last && part == "" {
+			// Ended with a newline, the next write starts a new line
+			t.partial = false
+			break
+		}
+		if i == 0 && t.partial {
+			t.out[len(t.out)-1] += part
+		} else {
+			t.out = append(t.out, part)
+		}
+		t.partial = last
+	}
+	if n := len(t.out) - tuiScrollback; n > 0 {
+		t.out = slices.Delete(t.out, 0, n)
+	}
+	t.mu.Unlock()
+
+	t.draw()
+	return len(p), nil
+}
+
+func (t *tui) notify(fn func()) {
+	fn()
+}
+
+func (t *tui) refresh() {
+	t.draw()
+}
+
+func (t *tui) Close() {
+	t.eof()
+	t.s.Fini()
+}
+
+func (t *tui) eof() {
+	t.eofOnce.Do(func() { close(t.quit) })
+}
+
+// events handles the keyboard until the screen is closed.
+func (t *tui) events() {
+	for {
+		switch ev := t.s.PollEvent().(type) {
+		case nil:
+			return
+		case *tcell.EventResize:
+			t.s.Sync()
+			t.draw()
+		case *tcell.EventKey:
+			if !t.key(ev) {
+				t.eof()
+				return
+			}
+			t.draw()
+		}
+	}
+}
+
+func (t *tui) ticker() {
+	tick := time.NewTicker(tuiTick)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			t.draw()
+		case <-t.quit:
+			return
+		}
+	}
+}
+
+// key applies a key press, it returns false when the user wants to leave.
+func (t *tui) key(ev *tcell.EventKey) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, h := t.s.Size()
+	page := max(1, (h-2)/2)
+
+	switch ev.Key() {
+	case tcell.KeyCtrlC:
+		return false
+	case tcell.KeyCtrlD:
+		if len(t.input) == 0 {
+			return false
+		}
+		t.input = slices.Delete(t.input, t.pos, min(t.pos+1, len(t.input)))
+	case tcell.KeyEnter:
+		line := string(t.input)
+		if strings.TrimSpace(line) != "" {
+			t.history = append(t.history, line)
+			if len(t.history) > tuiHistory {
+				t.history = t.history[1:]
+			}
+		}
+		t.hist = len(t.history)
+		t.input, t.pos, t.scroll = nil, 0, 0
+		select {
+		case t.lines <- line:
+		default:
+			// The input loop is busy (e.g. connecting), drop the line
+			t.s.Beep()
+		}
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if t.pos > 0 {
+			t.input = slices.Delete(t.input, t.pos-1, t.pos)
+			t.pos--
+		}
+	case tcell.KeyDelete:
+		if t.pos < len(t.input) {
+			t.input = slices.Delete(t.input, t.pos, t.pos+1)
+		}
+	case tcell.KeyLeft:
+		t.pos = max(0, t.pos-1)
+	case tcell.KeyRight:
+		t.pos = min(len(t.input), t.pos+1)
+	case tcell.KeyHome, tcell.KeyCtrlA:
+		t.pos = 0
+	case tcell.KeyEnd, tcell.KeyCtrlE:
+		t.pos = len(t.input)
+	case tcell.KeyCtrlU:
+		t.input, t.pos = nil, 0
+	case tcell.KeyCtrlL:
+		t.s.Sync()
+	case tcell.KeyUp:
+		t.browse(-1)
+	case tcell.KeyDown:
+		t.browse(1)
+	case tcell.KeyPgUp:
+		t.scroll += page
+	case tcell.KeyPgDn:
+		t.scroll = max(0, t.scroll-page)
+	case tcell.KeyTab:
+		if t.complete != nil {
+			line := string(t.input)
+			at := len(string(t.input[:t.pos]))
+			t.mu.Unlock()
+			newLine, newPos, ok := t.complete(line, at, '\t')
+			t.mu.Lock()
+			if ok {
+				t.input = []rune(newLine)
+				t.pos = len([]rune(newLine[:newPos]))
+			}
+		}
+	case tcell.KeyRune:
+		t.input = slices.Insert(t.input, t.pos, ev.Rune())
+		t.pos++
+	}
+	return true
+}
+
+// browse moves in the input history, keeping the line being edited.
+func (t *tui) browse(d int) {
+	i := t.hist + d
+	if i < 0 || i > len(t.history) {
+		return
+	}
+	if t.hist == len(t.history) {
+		t.saved = t.input
+	}
+	t.hist = i
+	if i == len(t.history) {
+		t.input = t.saved
+	} else {
+		t.input = []rune(t.history[i])
+	}
+	t.pos = len(t.input)
+}
+
+var (
+	styleBar     = tcell.StyleDefault.Reverse(true)
+	styleSide    = tcell.StyleDefault
+	styleDim     = tcell.StyleDefault.Dim(true)
+	styleOnline  = tcell.StyleDefault.Foreground(tcell.ColorGreen)
+	styleWait    = tcell.StyleDefault.Foreground(tcell.ColorYellow)
+	styleFailed  = tcell.StyleDefault.Foreground(tcell.ColorRed)
+	styleWarning = tcell.StyleDefault.Foreground(tcell.ColorRed)
+)
+
+func (t *tui) draw() {
+	var (
+		header string
+		side   []sideItem
+	)
+	if t.status != nil {
+		header, side = t.status()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.s
+	s.Clear()
+	w, h := s.Size()
+	if w < 10 || h < 3 {
+		s.Show()
+		return
+	}
+
+	sideW := 0
+	if w >= 3*tuiSideWidth {
+		sideW = tuiSideWidth
+	}
+	paneW := w - sideW
+	rows := h - 2
+
+	// Status bar
+	fill(s, 0, 0, w, styleBar)
+	puts(s, 1, 0, w-1, header, styleBar)
+
+	// Messages, bottom-aligned
+	var wrapped []string
+	for i := len(t.out) - 1; i >= 0 && len(wrapped) < rows+t.scroll; i-- {
+		wrapped = append(wrap(t.out[i], paneW), wrapped...)
+	}
+	t.scroll = min(t.scroll, max(0, len(wrapped)-rows))
+	end := len(wrapped) - t.scroll
+	start := max(0, end-rows)
+	for i, line := range wrapped[start:end] {
+		style := tcell.StyleDefault
+		if strings.HasPrefix(line, "[!]") || strings.HasPrefix(line, "⚠") {
+			style = styleWarning
+		}
+		puts(s, 0, 1+rows-(end-start)+i, paneW, line, style)
+	}
+	if t.scroll > 0 {
+		puts(s, paneW-14, 1, 14, fmt.Sprintf(" ↑ %d more ", t.scroll), styleBar)
+	}
+
+	// Sidebar
+	if sideW > 0 {
+		for y := 1; y <= rows; y++ {
+			s.SetContent(paneW, y, '│', nil, styleDim)
+		}
+		puts(s, paneW+2, 1, sideW-2, "Peers", styleSide.Bold(true))
+		for i, it := range side {
+			y := 2 + i
+			if y > rows {
+				break
+			}
+			mark, style := "○", styleDim
+			switch it.state {
+			case presOnline:
+				mark, style = "●", styleOnline
+			case presHandshake:
+				mark, style = "…", styleWait
+			case presFailed:
+				mark, style = "✗", styleFailed
+			}
+			puts(s, paneW+2, y, 1, mark, style)
+			name := it.name
+			if it.trusted {
+				name += " ✔"
+			}
+			puts(s, paneW+4, y, sideW-4, name, styleSide)
+		}
+	}
+
+	// Input line, scrolled to keep the cursor visible
+	inW := w - len(prompt) - 1
+	off := max(0, t.pos-inW)
+	puts(s, 0, h-1, len(prompt), prompt, tcell.StyleDefault)
+	puts(s, len(prompt), h-1, inW+1, string(t.input[off:]), tcell.StyleDefault)
+	s.ShowCursor(len(prompt)+uniseg.StringWidth(string(t.input[off:t.pos])), h-1)
+	s.Show()
+}
+
+// wrap cuts line into rows of at most width cells.
+func wrap(line string, width int) []string {
+	var (
+		rows []string
+		cur  strings.Builder
+		w    int
+	)
+	g := uniseg.NewGraphemes(line)
+	for g.Next() {
+		cw := g.Width()
+		if w+cw > width && w > 0 {
+			rows = append(rows, cur.String())
+			cur.Reset()
+			w = 0
+		}
+		cur.WriteString(g.Str())
+		w += cw
+	}
+	return append(rows, cur.String())
+}
+
+func fill(s tcell.Screen, x, y, width int, style tcell.Style) {
+	for i := 0; i < width; i++ {
+		s.SetContent(x+i, y, ' ', nil, style)
+	}
+}
+
+// puts writes str at x, y, clipped to width cells.
+func puts(s tcell.Screen, x, y, width int, str string, style tcell.Style) {
+	for end := x + width; str != "" && x < end; {
+		var w int
+		str, w = s.Put(x, y, str, style)
+		if w == 0 {
+			break
+		}
+		x += w
+	}
+}
+
+/* -----------------------------------------------------------
+This builds the TUI status bar and sidebar
+-----------------------------------------------------------*/
+
+func (a *app) status() (string, []sideItem) {
+	a.mu.Lock()
+	id, mgr := a.id, a.mgr
+	hs := maps.Clone(a.handshakes)
+	a.mu.Unlock()
+
+	relay := "relay: none"
+	if a.relay != "" {
+		relay = "relay: ✗ down"
+		if a.h.Network().Connectedness(a.relay) == network.Connected {
+			relay = "relay: ● up"
+		}
+	}
+
+	peers := chat.AllPeers()
+	count := make(map[string]int)
+	for _, p := range peers {
+		count[strings.ToLower(p.Pseudo)]++
+	}
+
+	var items []sideItem
+	sessions := 0
+	for _, p := range peers {
+		it := sideItem{name: p.Pseudo, trusted: p.Trusted}
+		if p.Pseudo == "" || count[strings.ToLower(p.Pseudo)] > 1 {
+			it.name = chat.Handle(p)
+		}
+		if mgr != nil {
+			if _, ok := mgr.Lookup(p.UserID); ok {
+				it.state = presOnline
+				sessions++
+			}
+		}
+		if err, ok := hs[p.PeerID]; ok {
+			if it.state != presOnline {
+				it.state = handshakeState(err)
+			}
+			delete(hs, p.PeerID)
+		}
+		items = append(items, it)
+	}
+	// Handshakes with peers not met yet
+	for pid, err := range hs {
+		s := pid.String()
+		items = append(items, sideItem{name: "peer " + s[max(0, len(s)-8):], state: handshakeState(err)})
+	}
+	slices.SortFunc(items, func(x, y sideItem) int {
+		if xo, yo := x.state == presOnline, y.state == presOnline; xo != yo {
+			if xo {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(strings.ToLower(x.name), strings.ToLower(y.name))
+	})
+
+	header := fmt.Sprintf("pqchat │ %s#%s (%s) │ %s │ %d session(s)", id.Pseudo, id.UserID[:8], id.Alg, relay, sessions)
+	return header, items
+}
+
+func handshakeState(err error) presence {
+	if err != nil {
+		return presFailed
+	}
+	return presHandshake
+}
@@ -16,18 +16,48 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 
+	libp2p "github.com/libp2p/go-libp2p"
+
+	"pqchat/src/internal/dht"
+	"pqchat/src/internal/mailbox"
 	"pqchat/src/internal/net"
 )
 
+var defaults = mailbox.DefaultLimits()
+
+var (
+	flagMailbox   = flag.Bool("mailbox", false, "hold encrypted mail for offline users")
+	flagMailTTL   = flag.Duration("mailbox-ttl", defaults.TTL, "how long mail is kept, clients refuse it after "+mailbox.MaxMailAge.String())
+	flagMailMax   = flag.Int("mailbox-max-mails", defaults.MaxMails, "mails held per user")
+	flagMailBytes = flag.Int("mailbox-max-bytes", defaults.MaxBytes, "bytes of mail held per user")
+	flagMailTotal = flag.Int64("mailbox-max-total", defaults.MaxTotal, "bytes of mail held for all users")
+	flagMailSize  = flag.Int("mailbox-max-mail", defaults.MaxMail, "size of one mail, in bytes")
+	flagMailUsers = flag.Int("mailbox-max-users", defaults.MaxBundles, "users who may publish prekeys")
+	flagFetches   = flag.Int("mailbox-max-fetches", defaults.MaxFetches, "prekey requests per peer and hour")
+	flagUserFetch = flag.Int("mailbox-max-user-fetches", defaults.MaxUserFetches, "prekey requests for one user per hour")
+	flagOneTime   = flag.Int("mailbox-max-one-time", defaults.MaxOneTimeHanded, "one-time prekeys of one user handed out per hour")
+	flagDHT       = flag.Bool("dht", false, "run a DHT node, for clients started with -dht to find each other by user ID")
+)
+
 func main() {
+	flag.Parse()
+
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
-	h, err := net.NewRelayHost()
+	var (
+		opts []libp2p.Option
+		node *dht.DHT
+	)
+	if *flagDHT {
+		opts = append(opts, dht.Routing(ctx, true, nil, &node))
+	}
+	h, err := net.NewRelayHost(opts...)
 	if err != nil {
 		panic(err)
 	}
@@ -37,6 +67,39 @@ func main() {
 		fmt.Println(" ", a)
 	}
 
+	if *flagMailbox {
+		// Requests hold one mail or one prekey bundle at most, larger ones
+		// are not even read
+		publish, err := mailbox.MaxPublishSize()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		if limit := max(*flagMailSize+256<<10, publish); *flagMailSize > 0 && limit < net.DefaultMaxFrameSize {
+			if err := net.SetLimits(limit, limit); err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+		}
+		limits := defaults
+		limits.TTL = *flagMailTTL
+		limits.MaxMails = *flagMailMax
+		limits.MaxBytes = *flagMailBytes
+		limits.MaxTotal = *flagMailTotal
+		limits.MaxMail = *flagMailSize
+		limits.MaxBundles = *flagMailUsers
+		limits.MaxFetches = *flagFetches
+		limits.MaxUserFetches = *flagUserFetch
+		limits.MaxOneTimeHanded = *flagOneTime
+		mailbox.Serve(ctx, h, mailbox.NewStore(limits))
+		fmt.Printf("Mailbox on, mail kept %s\n", limits.TTL)
+	}
+
+	if node != nil {
+		defer node.Close()
+		fmt.Printf("DHT node on, peer records kept %s\n", dht.RecordTTL)
+	}
+
 	<-ctx.Done()
 	fmt.Println("Shutting down relay…")
 	h.Close()
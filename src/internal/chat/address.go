@@ -0,0 +1,133 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// A user ID prefix must be at least this long to address someone by it.
+const minIDPrefix = 8
+
+var ErrUnknownRecipient = errors.New("chat: unknown recipient")
+
+// AmbiguousError is returned when a name matches several verified peers.
+type AmbiguousError struct {
+	Name    string
+	Matches []*Peer
+}
+
+func (e *AmbiguousError) Error() string {
+	names := make([]string, len(e.Matches))
+	for i, p := range e.Matches {
+		names[i] = "@" + Handle(p)
+	}
+	return fmt.Sprintf("chat: %q is ambiguous, use one of %s", e.Name, strings.Join(names, ", "))
+}
+
+// ParseMentions splits the leading @mentions off an input line:
+// "@alice @bob hi" gives ["alice", "bob"] and "hi". No mention means the
+// line is a broadcast.
+func ParseMentions(line string) (names []string, body string) {
+	rest := strings.TrimSpace(line)
+	for strings.HasPrefix(rest, "@") {
+		word, tail, _ := strings.Cut(rest, " ")
+		if name := strings.TrimPrefix(word, "@"); name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+		rest = strings.TrimSpace(tail)
+	}
+	return names, rest
+}
+
+// Resolve finds the verified peer called name, which is a pseudo, a
+// pseudo#<user_id prefix> when several peers share a pseudo, or a user_id
+// prefix of at least 8 hex digits.
+func Resolve(name string) (*Peer, error) {
+	pseudo, prefix, tagged := strings.Cut(name, "#")
+
+	var matches []*Peer
+	for _, p := range AllPeers() {
+		switch {
+		case tagged:
+			if strings.EqualFold(p.Pseudo, pseudo) && strings.HasPrefix(p.UserID, strings.ToLower(prefix)) {
+				matches = append(matches, p)
+			}
+		case strings.EqualFold(p.Pseudo, name):
+			matches = append(matches, p)
+		}
+	}
+	if len(matches) == 0 && !tagged && len(name) >= minIDPrefix && isHex(name) {
+		for _, p := range AllPeers() {
+			if strings.HasPrefix(p.UserID, strings.ToLower(name)) {
+				matches = append(matches, p)
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("%w %q", ErrUnknownRecipient, name)
+	case 1:
+		return matches[0], nil
+	}
+	slices.SortFunc(matches, func(a, b *Peer) int { return strings.Compare(a.UserID, b.UserID) })
+	return nil, &AmbiguousError{Name: name, Matches: matches}
+}
+
+// Handle returns pseudo#<user_id prefix>, which tells apart peers sharing
+// a pseudo.
+func Handle(p *Peer) string {
+	return p.Pseudo + "#" + p.UserID[:min(minIDPrefix, len(p.UserID))]
+}
+
+// Names returns the shortest name addressing each known peer: its pseudo,
+// or its Handle when the pseudo is shared.
+func Names() []string {
+	peers := AllPeers()
+	count := make(map[string]int)
+	for _, p := range peers {
+		count[strings.ToLower(p.Pseudo)]++
+	}
+	names := make([]string, 0, len(peers))
+	for _, p := range peers {
+		if p.Pseudo != "" && count[strings.ToLower(p.Pseudo)] == 1 {
+			names = append(names, p.Pseudo)
+		} else {
+			names = append(names, Handle(p))
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// DisplayName returns the pseudo of a user if known, its ID otherwise.
+func DisplayName(userID string) string {
+	if p, ok := LookupPeer(userID); ok && p.Pseudo != "" {
+		return p.Pseudo
+	}
+	return userID
+}
+
+func isHex(s string) bool {
+	for _, c := range strings.ToLower(s) {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
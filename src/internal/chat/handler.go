@@ -14,27 +14,109 @@
 package chat
 
 import (
-	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"pqchat/src/internal/net"
 	"pqchat/src/internal/protocol"
 )
 
-func HandleIncoming(raw []byte) {
-
-	var hello protocol.HelloMessage
-	if json.Unmarshal(raw, &hello) == nil && hello.Type == "HELLO" {
-		fmt.Println("[+] HELLO from", hello.Pseudo)
+// A CHAT message is accepted once, within maxChatAge of when it was
+// signed. Up to maxSeenChat recent messages are remembered to drop
+// replays.
+const (
+	maxChatAge  = 5 * time.Minute
+	maxSeenChat = 10000
+)
 
-		// TODO: verify signature ML-DSA
+var (
+	seenMu   sync.Mutex
+	seenChat = make(map[string]int64) // from|timestamp|sig → timestamp
+)
 
-		return
+// HandleIncoming dispatches a decrypted frame on its type. userID is the
+// user the session was authenticated as. Frames this version does not
+// know are skipped.
+func HandleIncoming(from peer.ID, userID string, f *net.Frame) {
+	switch f.Type {
+	case net.FrameHello:
+		// The handshake took the only HELLO, signed over its transcript
+		fmt.Fprintln(out, "[!] Dropped HELLO from", DisplayName(userID), "after the handshake")
+	case net.FrameChat:
+		handleChat(from, userID, f.Payload)
+	case net.FramePing, net.FrameAck, net.FrameRekey:
+		// Nothing to do yet
+	default:
+		if f.Type.Known() {
+			fmt.Fprintln(out, "[?] Unexpected", f.Type, "frame from", from)
+		}
 	}
+}
 
+// handleChat displays a CHAT message received on the session of userID.
+// Peers only send their own messages: one signed by someone else was
+// passed on or replayed, and is dropped.
+func handleChat(from peer.ID, userID string, raw []byte) {
 	var chat protocol.ChatMessage
-	if json.Unmarshal(raw, &chat) == nil && chat.Type == "CHAT" {
-		HandleChat(&chat)
+	if err := protocol.Unmarshal(raw, &chat); err != nil || chat.Type != "CHAT" {
+		fmt.Fprintln(out, "[!] Malformed CHAT from", from)
+		return
+	}
+	if chat.From != userID {
+		fmt.Fprintln(out, "[!] Dropped message from", DisplayName(userID), "claiming to be from", DisplayName(chat.From))
+		return
+	}
+	verified := verifyChat(&chat)
+	if !verified && unverifiedPolicy == PolicyDrop {
+		fmt.Fprintln(out, "[!] Dropped unverified message from", from)
 		return
 	}
+	if !fresh(&chat, time.Now()) {
+		fmt.Fprintln(out, "[!] Dropped stale or replayed message from", DisplayName(userID))
+		return
+	}
+	HandleChat(&chat, verified)
+}
+
+// fresh reports whether msg was signed within maxChatAge of now and not
+// seen before, and remembers it.
+func fresh(msg *protocol.ChatMessage, now time.Time) bool {
+	age := now.Sub(time.Unix(msg.Timestamp, 0))
+	if age > maxChatAge || age < -maxChatAge {
+		return false
+	}
+	key := fmt.Sprintf("%s|%d|%s", msg.From, msg.Timestamp, msg.Sig)
 
-	fmt.Println("[?] Unknown message")
+	seenMu.Lock()
+	defer seenMu.Unlock()
+	if _, ok := seenChat[key]; ok {
+		return false
+	}
+	if len(seenChat) >= maxSeenChat {
+		oldest := now.Add(-maxChatAge).Unix()
+		for k, ts := range seenChat {
+			if ts < oldest {
+				delete(seenChat, k)
+			}
+		}
+		// Still full of fresh messages: refuse rather than forget one
+		if len(seenChat) >= maxSeenChat {
+			return false
+		}
+	}
+	seenChat[key] = msg.Timestamp
+	return true
+}
+
+// verifyChat checks msg against the public key of its sender, as stored in
+// the directory from a verified HELLO.
+func verifyChat(msg *protocol.ChatMessage) bool {
+	p, ok := LookupPeer(msg.From)
+	if !ok {
+		return false
+	}
+	return protocol.VerifyChat(msg, p.Alg, p.Pub) == nil
 }
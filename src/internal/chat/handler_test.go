@@ -0,0 +1,99 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package chat
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"pqchat/src/internal/net"
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/protocol"
+)
+
+// chatFrame returns a CHAT frame from id, signed at the given time.
+func chatFrame(t *testing.T, id *pqc.Identity, body string, at time.Time) *net.Frame {
+	t.Helper()
+	msg := &protocol.ChatMessage{Type: "CHAT", From: id.UserID, Body: body, Timestamp: at.Unix()}
+	if err := protocol.Sign(id, msg, &msg.Sig); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := protocol.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &net.Frame{Type: net.FrameChat, Payload: raw}
+}
+
+func TestHandleChat(t *testing.T) {
+	alice, err := pqc.NewIdentity("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	mallory, err := pqc.NewIdentity("mallory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mallory.Close()
+	RegisterPeer(alice.UserID, alice.Pseudo, alice.Alg, alice.Pub, "")
+	RegisterPeer(mallory.UserID, mallory.Pseudo, mallory.Alg, mallory.Pub, "")
+
+	SetOutput(io.Discard)
+	var shown []string
+	SetDisplay(func(m *Message) { shown = append(shown, m.Body) })
+	defer SetDisplay(printMessage)
+
+	now := time.Now()
+	hi := chatFrame(t, alice, "hi", now)
+	tests := []struct {
+		name   string
+		userID string // the session it arrives on
+		f      *net.Frame
+		shown  bool
+	}{
+		{"own message", alice.UserID, hi, true},
+		{"replayed", alice.UserID, hi, false},
+		{"passed on by another peer", mallory.UserID, chatFrame(t, alice, "relayed", now), false},
+		{"too old", alice.UserID, chatFrame(t, alice, "old", now.Add(-2*maxChatAge)), false},
+		{"too far ahead", alice.UserID, chatFrame(t, alice, "early", now.Add(2*maxChatAge)), false},
+		{"same second, other message", alice.UserID, chatFrame(t, alice, "again", now), true},
+	}
+	for _, tt := range tests {
+		shown = nil
+		HandleIncoming("", tt.userID, tt.f)
+		if got := len(shown) == 1; got != tt.shown {
+			t.Errorf("%s: shown = %v, want %v", tt.name, got, tt.shown)
+		}
+	}
+}
+
+func TestHelloAfterHandshake(t *testing.T) {
+	mallory, err := pqc.NewIdentity("mallory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mallory.Close()
+	_, raw, err := protocol.BuildHello(mallory, "12D3KooWMallory", []byte("another handshake"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetOutput(io.Discard)
+	HandleIncoming("", "alice", &net.Frame{Type: net.FrameHello, Payload: raw})
+	if _, ok := LookupPeer(mallory.UserID); ok {
+		t.Error("HELLO within a session registered its user")
+	}
+}
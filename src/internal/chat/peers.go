@@ -15,31 +15,83 @@ package chat
 
 import (
 	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
+// Peer is a verified entry of the peer directory. Records are immutable
+// once stored: RegisterPeer replaces them.
+type Peer struct {
+	UserID    string
+	Pseudo    string
+	Alg       string // signature algorithm of Pub
+	Pub       []byte // public key
+	PeerID    peer.ID
+	Trusted   bool // fingerprint checked out of band, see Trust
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
 var (
-	userToPeer sync.Map // userID → peer.ID
+	userToPeer sync.Map   // userID → *Peer
+	registerMu sync.Mutex // serializes read-modify-write in RegisterPeer
 )
 
-func RegisterPeer(userID string, pid peer.ID) {
-	userToPeer.Store(userID, pid)
+// RegisterPeer records a peer whose HELLO has been verified. Callers must
+// only pass identities checked with protocol.VerifyHello, a handshake or
+// RoomMember.Keys; pid is empty for room members we have no session with.
+func RegisterPeer(userID, pseudo, alg string, pub []byte, pid peer.ID) *Peer {
+	registerMu.Lock()
+	defer registerMu.Unlock()
+
+	now := time.Now()
+	p := &Peer{
+		UserID:    userID,
+		Pseudo:    pseudo,
+		Alg:       alg,
+		Pub:       pub,
+		PeerID:    pid,
+		FirstSeen: now,
+		LastSeen:  now,
+	}
+	if v, ok := userToPeer.Load(userID); ok {
+		p.FirstSeen = v.(*Peer).FirstSeen
+		p.Trusted = v.(*Peer).Trusted
+	}
+	userToPeer.Store(userID, p)
+	return p
 }
 
-func LookupPeer(userID string) (peer.ID, bool) {
+func LookupPeer(userID string) (*Peer, bool) {
 	v, ok := userToPeer.Load(userID)
 	if !ok {
-		return "", false
+		return nil, false
 	}
-	return v.(peer.ID), true
+	return v.(*Peer), true
 }
 
-func AllPeers() []peer.ID {
-	var out []peer.ID
+func AllPeers() []*Peer {
+	var out []*Peer
 	userToPeer.Range(func(_, v any) bool {
-		out = append(out, v.(peer.ID))
+		out = append(out, v.(*Peer))
 		return true
 	})
 	return out
 }
+
+// Trust records that the user's fingerprint was checked out of band. The
+// user ID commits to the public key, so this holds across reconnections.
+func Trust(userID string) bool {
+	registerMu.Lock()
+	defer registerMu.Unlock()
+
+	v, ok := userToPeer.Load(userID)
+	if !ok {
+		return false
+	}
+	p := *v.(*Peer)
+	p.Trusted = true
+	userToPeer.Store(userID, &p)
+	return true
+}
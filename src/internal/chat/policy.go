@@ -0,0 +1,42 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package chat
+
+import "fmt"
+
+// Policy tells what to do with a CHAT message whose signature cannot be
+// verified (unknown sender or bad signature).
+type Policy int
+
+const (
+	PolicyDrop Policy = iota // discard it (default)
+	PolicyFlag               // display it, marked as unverified
+)
+
+var unverifiedPolicy = PolicyDrop
+
+func SetUnverifiedPolicy(p Policy) {
+	unverifiedPolicy = p
+}
+
+// ParsePolicy parses "drop" or "flag".
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "drop":
+		return PolicyDrop, nil
+	case "flag":
+		return PolicyFlag, nil
+	}
+	return PolicyDrop, fmt.Errorf("unknown policy %q (want drop or flag)", s)
+}
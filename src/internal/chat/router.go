@@ -15,9 +15,104 @@ package chat
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
 	"pqchat/src/internal/protocol"
 )
 
-func HandleChat(msg *protocol.ChatMessage) {
-	fmt.Printf("<%s> %s\n", msg.From, msg.Body)
+// out receives what the chat displays.
+var out io.Writer = os.Stdout
+
+func SetOutput(w io.Writer) {
+	out = w
+}
+
+// localUser is our own user ID, used to check and show addressed messages.
+var localUser atomic.Value // string
+
+func SetLocalUser(userID string) {
+	localUser.Store(userID)
+}
+
+func self() string {
+	userID, _ := localUser.Load().(string)
+	return userID
+}
+
+// Message is a received CHAT message, ready to be displayed.
+type Message struct {
+	*protocol.ChatMessage
+	Verified bool // signed by the key of msg.From
+	Trusted  bool // and that key was checked with Trust
+	Offline  bool // fetched from a mailbox, sent while we were away
+}
+
+// display shows received messages, see SetDisplay.
+var display = printMessage
+
+// SetDisplay replaces the default display of received messages, which
+// prints them to the output.
+func SetDisplay(fn func(m *Message)) {
+	display = fn
+}
+
+// HandleChat displays a CHAT message. Addressed messages are dropped when
+// we are not one of their recipients.
+func HandleChat(msg *protocol.ChatMessage, verified bool) {
+	if len(msg.To) > 0 && self() != "" && !slices.Contains(msg.To, self()) {
+		fmt.Fprintln(out, "[!] Dropped message from", DisplayName(msg.From), "addressed to other users")
+		return
+	}
+	m := &Message{ChatMessage: msg, Verified: verified}
+	if p, ok := LookupPeer(msg.From); ok && verified {
+		m.Trusted = p.Trusted
+	}
+	display(m)
+}
+
+// HandleMail displays a CHAT message fetched from a mailbox, once checked
+// with protocol.VerifyMailChat.
+func HandleMail(msg *protocol.ChatMessage) {
+	m := &Message{ChatMessage: msg, Verified: true, Offline: true}
+	if p, ok := LookupPeer(msg.From); ok {
+		m.Trusted = p.Trusted
+	}
+	display(m)
+}
+
+// printMessage shows "<alice> hi", "<alice → you, bob> hi" when the
+// message is addressed, or "#proj <alice> hi" in a room. Mail gets the
+// time it was sent.
+func printMessage(m *Message) {
+	name := DisplayName(m.From)
+	room := ""
+	if m.Room != "" {
+		room = "#" + m.Room + " "
+	}
+	if len(m.To) > 0 {
+		to := make([]string, len(m.To))
+		for i, userID := range m.To {
+			if userID == self() {
+				to[i] = "you"
+			} else {
+				to[i] = DisplayName(userID)
+			}
+		}
+		name += " → " + strings.Join(to, ", ")
+	}
+
+	switch {
+	case !m.Verified:
+		fmt.Fprintf(out, "%s<%s> %s  [UNVERIFIED]\n", room, name, m.Body)
+	case m.Offline:
+		sent := time.Unix(m.Timestamp, 0).Format("Jan 2 15:04")
+		fmt.Fprintf(out, "%s<%s> %s  [offline, sent %s]\n", room, name, m.Body, sent)
+	default:
+		fmt.Fprintf(out, "%s<%s> %s\n", room, name, m.Body)
+	}
 }
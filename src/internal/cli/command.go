@@ -0,0 +1,193 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// Prefix starts a command line. Doubling it sends a chat line starting
+// with it: "//shrug" says "/shrug".
+const Prefix = "/"
+
+var (
+	ErrUnknownCommand = errors.New("cli: unknown command")
+	ErrUsage          = errors.New("cli: wrong arguments")
+	ErrQuit           = errors.New("cli: quit")
+)
+
+// Command is a slash command. Args is the usage synopsis shown by help,
+// e.g. "<peer> <text>".
+type Command struct {
+	Name    string
+	Args    string
+	Help    string
+	MinArgs int
+	MaxArgs int  // -1: no limit
+	Rest    bool // the last argument takes the rest of the line verbatim
+
+	// Complete returns the candidates for argument n (from 0), may be nil.
+	Complete func(n int) []string
+	Run      func(args []string) error
+}
+
+// Usage returns "/name args".
+func (c *Command) Usage() string {
+	if c.Args == "" {
+		return Prefix + c.Name
+	}
+	return Prefix + c.Name + " " + c.Args
+}
+
+// Dispatcher runs the commands registered on it.
+type Dispatcher struct {
+	cmds map[string]*Command
+
+	// Words returns the completions of chat lines, e.g. @mentions.
+	Words func() []string
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{cmds: make(map[string]*Command)}
+}
+
+// Register adds c, replacing a command of the same name.
+func (d *Dispatcher) Register(c *Command) {
+	d.cmds[c.Name] = c
+}
+
+// Lookup returns the command called name, without its prefix.
+func (d *Dispatcher) Lookup(name string) (*Command, bool) {
+	c, ok := d.cmds[name]
+	return c, ok
+}
+
+// Commands returns the registered commands sorted by name.
+func (d *Dispatcher) Commands() []*Command {
+	out := make([]*Command, 0, len(d.cmds))
+	for _, c := range d.cmds {
+		out = append(out, c)
+	}
+	slices.SortFunc(out, func(a, b *Command) int { return strings.Compare(a.Name, b.Name) })
+	return out
+}
+
+// Help writes the usage of the named command, or of all of them.
+func (d *Dispatcher) Help(w io.Writer, name string) error {
+	cmds := d.Commands()
+	if name != "" {
+		c, ok := d.cmds[strings.TrimPrefix(name, Prefix)]
+		if !ok {
+			return fmt.Errorf("%w %s", ErrUnknownCommand, name)
+		}
+		cmds = []*Command{c}
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range cmds {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.Usage(), c.Help)
+	}
+	return tw.Flush()
+}
+
+// IsCommand reports whether line is a command rather than chat text.
+func IsCommand(line string) bool {
+	return strings.HasPrefix(line, Prefix) && !strings.HasPrefix(line, Prefix+Prefix)
+}
+
+// Unescape returns the chat text of a line that is not a command.
+func Unescape(line string) string {
+	if strings.HasPrefix(line, Prefix+Prefix) {
+		return line[len(Prefix):]
+	}
+	return line
+}
+
+// Run parses a command line and runs its command.
+func (d *Dispatcher) Run(line string) error {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(line), Prefix), " ")
+	c, ok := d.cmds[name]
+	if !ok {
+		return fmt.Errorf("%w %s%s, try %shelp", ErrUnknownCommand, Prefix, name, Prefix)
+	}
+
+	limit := -1
+	if c.Rest {
+		limit = c.MaxArgs
+	}
+	args, err := Split(rest, limit)
+	if err != nil {
+		return fmt.Errorf("%w: %v, usage: %s", ErrUsage, err, c.Usage())
+	}
+	if len(args) < c.MinArgs || (c.MaxArgs >= 0 && len(args) > c.MaxArgs) {
+		return fmt.Errorf("%w, usage: %s", ErrUsage, c.Usage())
+	}
+	return c.Run(args)
+}
+
+// Split parses the arguments of a command line. Arguments are separated by
+// spaces and may be quoted with ' or ", a backslash escapes the next
+// character. With limit > 0, the last argument is the rest of s verbatim.
+func Split(s string, limit int) ([]string, error) {
+	var (
+		args  []string
+		cur   strings.Builder
+		in    bool // inside an argument
+		quote rune
+		esc   bool
+	)
+	for i, r := range s {
+		if !in && limit > 0 && len(args) == limit-1 && r != ' ' {
+			return append(args, strings.TrimSpace(s[i:])), nil
+		}
+		switch {
+		case esc:
+			cur.WriteRune(r)
+			esc = false
+		case r == '\\' && quote != '\'':
+			esc, in = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, in = r, true
+		case r == ' ' || r == '\t':
+			if in {
+				args = append(args, cur.String())
+				cur.Reset()
+				in = false
+			}
+		default:
+			cur.WriteRune(r)
+			in = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if esc {
+		return nil, errors.New("trailing backslash")
+	}
+	if in {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package cli
+
+import "strings"
+
+// Complete has the signature of term.Terminal's AutoCompleteCallback. On
+// Tab it completes the word before the cursor: a command name, one of its
+// arguments, or a word of a chat line. Several matches are completed up to
+// their common prefix.
+func (d *Dispatcher) Complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	head := line[:pos]
+	start := strings.LastIndexAny(head, " \t") + 1
+	word := head[start:]
+
+	var cands []string
+	switch {
+	case IsCommand(head) && start == 0:
+		for _, c := range d.Commands() {
+			cands = append(cands, Prefix+c.Name)
+		}
+	case IsCommand(head):
+		fields := strings.Fields(head[:start])
+		c, ok := d.cmds[strings.TrimPrefix(fields[0], Prefix)]
+		if ok && c.Complete != nil {
+			cands = c.Complete(len(fields) - 1)
+		}
+	case d.Words != nil:
+		cands = d.Words()
+	}
+
+	var match []string
+	for _, c := range cands {
+		if strings.HasPrefix(c, word) {
+			match = append(match, c)
+		}
+	}
+	if len(match) == 0 {
+		return line, pos, true
+	}
+
+	repl := match[0]
+	for _, m := range match[1:] {
+		repl = commonPrefix(repl, m)
+	}
+	if len(match) == 1 {
+		repl += " "
+	}
+	return head[:start] + repl + line[pos:], start + len(repl), true
+}
+
+// commonPrefix never cuts a rune in two.
+func commonPrefix(a, b string) string {
+	for i, r := range a {
+		if !strings.HasPrefix(b[min(i, len(b)):], string(r)) {
+			return a[:i]
+		}
+	}
+	return a
+}
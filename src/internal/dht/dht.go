@@ -0,0 +1,128 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package dht
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	kaddht "github.com/libp2p/go-libp2p-kad-dht"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+// The DHT maps user IDs to signed peer records, so that a user can be
+// dialed from its user ID alone. It is go-libp2p-kad-dht under our own
+// protocol prefix, apart from the IPFS DHT: records are values stored
+// under /pqchat-user/<user_id>. Nodes check the ML-DSA signature of a
+// record before storing it, and clients again before trusting it: a node
+// can hide a record, not forge one.
+
+// ProtocolPrefix makes DHT streams use /pqchat/kad/1.0.0.
+const ProtocolPrefix = "/pqchat"
+
+// Namespace holds peer records in the DHT keyspace.
+const Namespace = "pqchat-user"
+
+// A node we connected to has joinTimeout to show up in the routing table.
+const (
+	joinTimeout = 10 * time.Second
+	joinPoll    = 100 * time.Millisecond
+)
+
+var (
+	ErrNoPeers  = errors.New("dht: no DHT node reachable")
+	ErrNotFound = errors.New("dht: no record for this user")
+)
+
+// DHT is our node.
+type DHT struct {
+	h         host.Host
+	kad       *kaddht.IpfsDHT
+	bootstrap []peer.AddrInfo
+}
+
+// Routing returns a NewHost option building the host with a DHT node,
+// then setting *d to it. A server stores records and answers lookups, as
+// a relayer does; otherwise the node only looks up until it is reachable
+// from the Internet. bootstrap are nodes to join through, which must run
+// the DHT too.
+func Routing(ctx context.Context, server bool, bootstrap []peer.AddrInfo, d **DHT) libp2p.Option {
+	mode := kaddht.ModeAuto
+	if server {
+		mode = kaddht.ModeServer
+	}
+	return libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
+		kad, err := kaddht.New(ctx, h,
+			kaddht.Mode(mode),
+			kaddht.ProtocolPrefix(ProtocolPrefix),
+			kaddht.Validator(record.NamespacedValidator{Namespace: Validator{}}),
+			kaddht.MaxRecordAge(RecordTTL),
+			kaddht.DisableProviders(),
+			kaddht.BootstrapPeers(bootstrap...),
+		)
+		if err != nil {
+			return nil, err
+		}
+		*d = &DHT{h: h, kad: kad, bootstrap: bootstrap}
+		return kad, nil
+	})
+}
+
+// Bootstrap connects to the bootstrap nodes and fills the routing table
+// from them.
+func (d *DHT) Bootstrap(ctx context.Context) error {
+	connected := false
+	for _, info := range d.bootstrap {
+		if info.ID != d.h.ID() && d.h.Connect(ctx, info) == nil {
+			connected = true
+		}
+	}
+	if !connected && d.Size() == 0 {
+		return ErrNoPeers
+	}
+
+	// Nodes enter the table once identify told they run the DHT
+	wait, cancel := context.WithTimeout(ctx, joinTimeout)
+	defer cancel()
+	t := time.NewTicker(joinPoll)
+	defer t.Stop()
+	for d.Size() == 0 {
+		select {
+		case <-wait.Done():
+			return ErrNoPeers
+		case <-t.C:
+		}
+	}
+	select {
+	case <-d.kad.ForceRefresh():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// Size returns how many nodes are in the routing table.
+func (d *DHT) Size() int {
+	return d.kad.RoutingTable().Size()
+}
+
+// Close stops the node.
+func (d *DHT) Close() error {
+	return d.kad.Close()
+}
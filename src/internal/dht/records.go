@@ -0,0 +1,147 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package dht
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/protocol"
+)
+
+// A record is served for RecordTTL after it was signed: users advertise
+// theirs again before. Clocks may be off by clockSkew.
+const (
+	RecordTTL = time.Hour
+	clockSkew = 5 * time.Minute
+	maxAddrs  = 16
+)
+
+var (
+	ErrExpired = errors.New("dht: peer record expired")
+	ErrNoAddrs = errors.New("dht: no address to advertise")
+)
+
+// Key returns where the record of a user is stored.
+func Key(userID string) string {
+	return "/" + Namespace + "/" + userID
+}
+
+// Advertise signs a record saying id runs on our peer, at its current
+// addresses, and stores it on the nodes closest to its key.
+func (d *DHT) Advertise(ctx context.Context, id *pqc.Identity) error {
+	addrs := d.h.Addrs()
+	if len(addrs) == 0 {
+		return ErrNoAddrs
+	}
+	if d.Size() == 0 {
+		return ErrNoPeers
+	}
+	list := make([]string, 0, min(len(addrs), maxAddrs))
+	for _, a := range addrs[:min(len(addrs), maxAddrs)] {
+		list = append(list, a.String())
+	}
+	r, err := protocol.NewPeerRecord(id, d.h.ID().String(), list)
+	if err != nil {
+		return err
+	}
+	raw, err := protocol.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return d.kad.PutValue(ctx, Key(r.UserID), raw)
+}
+
+// Resolve looks up the record of a user and returns it, with where to dial
+// its peer. Of the valid records the nodes hold, the newest wins.
+func (d *DHT) Resolve(ctx context.Context, userID string) (*protocol.PeerRecord, peer.AddrInfo, error) {
+	raw, err := d.kad.GetValue(ctx, Key(userID))
+	if errors.Is(err, routing.ErrNotFound) {
+		return nil, peer.AddrInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, peer.AddrInfo{}, err
+	}
+	return parseRecord(Key(userID), raw, time.Now())
+}
+
+// Validator checks the records stored under Namespace. The DHT runs it on
+// the records it is asked to store, and on those a lookup returns.
+type Validator struct{}
+
+// Validate checks a record stored under key.
+func (Validator) Validate(key string, value []byte) error {
+	_, _, err := parseRecord(key, value, time.Now())
+	return err
+}
+
+// Select returns the index of the newest valid record in values.
+func (Validator) Select(key string, values [][]byte) (int, error) {
+	now := time.Now()
+	best, newest := -1, int64(0)
+	for i, v := range values {
+		r, _, err := parseRecord(key, v, now)
+		if err == nil && (best < 0 || r.Timestamp > newest) {
+			best, newest = i, r.Timestamp
+		}
+	}
+	if best < 0 {
+		return 0, ErrNotFound
+	}
+	return best, nil
+}
+
+// parseRecord decodes the record stored under key and checks it at now.
+func parseRecord(key string, value []byte, now time.Time) (*protocol.PeerRecord, peer.AddrInfo, error) {
+	var r protocol.PeerRecord
+	if err := protocol.Unmarshal(value, &r); err != nil || key != Key(r.UserID) {
+		return nil, peer.AddrInfo{}, protocol.ErrPeerRecord
+	}
+	info, err := checkRecord(&r, now)
+	if err != nil {
+		return nil, peer.AddrInfo{}, err
+	}
+	return &r, info, nil
+}
+
+// checkRecord verifies a record, and that it is still valid at now. It
+// returns where to dial its peer.
+func checkRecord(r *protocol.PeerRecord, now time.Time) (peer.AddrInfo, error) {
+	signed := time.Unix(r.Timestamp, 0)
+	if now.Sub(signed) > RecordTTL || signed.Sub(now) > clockSkew {
+		return peer.AddrInfo{}, ErrExpired
+	}
+	p, err := peer.Decode(r.PeerID)
+	if err != nil || len(r.Addrs) == 0 || len(r.Addrs) > maxAddrs {
+		return peer.AddrInfo{}, protocol.ErrPeerRecord
+	}
+	info := peer.AddrInfo{ID: p}
+	for _, s := range r.Addrs {
+		a, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return peer.AddrInfo{}, protocol.ErrPeerRecord
+		}
+		info.Addrs = append(info.Addrs, a)
+	}
+	if err := r.Verify(); err != nil {
+		return peer.AddrInfo{}, err
+	}
+	return info, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package dht
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/test"
+
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/protocol"
+)
+
+func TestValidator(t *testing.T) {
+	alice, err := pqc.NewIdentity("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := pqc.NewIdentity("bob", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	p, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// record returns a record of id signed at, once edit altered it
+	now := time.Now()
+	record := func(id *pqc.Identity, at time.Time, edit func(r *protocol.PeerRecord)) []byte {
+		t.Helper()
+		r, err := protocol.NewPeerRecord(id, p.String(), []string{"/ip4/127.0.0.1/tcp/4001"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Timestamp = at.Unix()
+		if err := protocol.Sign(id, r, &r.Sig); err != nil {
+			t.Fatal(err)
+		}
+		if edit != nil {
+			edit(r)
+		}
+		raw, err := protocol.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	v := Validator{}
+	key := Key(alice.UserID)
+	tests := []struct {
+		name  string
+		key   string
+		value []byte
+		err   error
+	}{
+		{"valid", key, record(alice, now, nil), nil},
+		{"other user's key", Key(bob.UserID), record(alice, now, nil), protocol.ErrPeerRecord},
+		{"expired", key, record(alice, now.Add(-RecordTTL-time.Minute), nil), ErrExpired},
+		{"from the future", key, record(alice, now.Add(2*clockSkew), nil), ErrExpired},
+		{"altered", key, record(alice, now, func(r *protocol.PeerRecord) { r.Addrs = []string{"/ip4/10.0.0.1/tcp/1"} }), protocol.ErrPeerRecord},
+		{"bad address", key, record(alice, now, func(r *protocol.PeerRecord) { r.Addrs = []string{"nowhere"} }), protocol.ErrPeerRecord},
+		{"not a record", key, []byte("{}"), protocol.ErrPeerRecord},
+	}
+	for _, tt := range tests {
+		if err := v.Validate(tt.key, tt.value); !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	// The newest valid record wins
+	values := [][]byte{
+		record(alice, now.Add(-2*time.Minute), nil),
+		record(alice, now.Add(-time.Minute), nil),
+		record(alice, now, func(r *protocol.PeerRecord) { r.Addrs = []string{"/ip4/10.0.0.1/tcp/1"} }),
+		record(alice, now.Add(-3*time.Minute), nil),
+	}
+	if i, err := v.Select(key, values); err != nil || i != 1 {
+		t.Errorf("selected %d, %v; want 1", i, err)
+	}
+	if _, err := v.Select(key, values[2:3]); !errors.Is(err, ErrNotFound) {
+		t.Errorf("no valid record: got %v, want %v", err, ErrNotFound)
+	}
+}
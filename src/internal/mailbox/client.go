@@ -0,0 +1,148 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package mailbox
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/protocol"
+)
+
+var ErrRefused = errors.New("mailbox: refused by the relayer")
+
+// Client talks to the mailbox of a relayer.
+type Client struct {
+	h     host.Host
+	relay peer.ID
+}
+
+func NewClient(h host.Host, relay peer.ID) *Client {
+	return &Client{h: h, relay: relay}
+}
+
+// Put leaves a mail on the relayer.
+func (c *Client) Put(ctx context.Context, m *protocol.Mail) error {
+	_, err := c.request(ctx, func([]byte) (*protocol.MailboxRequest, error) {
+		return &protocol.MailboxRequest{Op: "put", Mail: m}, nil
+	})
+	return err
+}
+
+// Publish replaces our prekey bundle on the relayer.
+func (c *Client) Publish(ctx context.Context, b *protocol.PrekeyBundle) error {
+	_, err := c.request(ctx, func([]byte) (*protocol.MailboxRequest, error) {
+		return &protocol.MailboxRequest{Op: "publish", Bundle: b}, nil
+	})
+	return err
+}
+
+// Prekeys returns the prekey bundle of a user, once checked: the relayer
+// cannot substitute its own keys. It holds one one-time prekey at most,
+// which the relayer will not hand out again.
+func (c *Client) Prekeys(ctx context.Context, userID string) (*protocol.PrekeyBundle, error) {
+	resp, err := c.request(ctx, func([]byte) (*protocol.MailboxRequest, error) {
+		return &protocol.MailboxRequest{Op: "prekeys", UserID: userID}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	b := resp.Bundle
+	if b == nil || b.UserID != userID || len(b.OneTime) > 1 {
+		return nil, protocol.ErrBundle
+	}
+	if _, err := b.Verify(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Fetch returns the mail held for id, and how many of its one-time prekeys
+// are left. Mail stays on the relayer until Ack.
+func (c *Client) Fetch(ctx context.Context, id *pqc.Identity) ([]protocol.StoredMail, int, error) {
+	resp, err := c.request(ctx, func(challenge []byte) (*protocol.MailboxRequest, error) {
+		auth, err := protocol.NewMailboxAuth(id, c.relay.String(), challenge)
+		if err != nil {
+			return nil, err
+		}
+		return &protocol.MailboxRequest{Op: "fetch", Auth: auth}, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Mails, resp.OneTime, nil
+}
+
+// Ack deletes fetched mail from the relayer.
+func (c *Client) Ack(ctx context.Context, id *pqc.Identity, ids []string) error {
+	_, err := c.request(ctx, func(challenge []byte) (*protocol.MailboxRequest, error) {
+		auth, err := protocol.NewMailboxAuth(id, c.relay.String(), challenge)
+		if err != nil {
+			return nil, err
+		}
+		return &protocol.MailboxRequest{Op: "ack", IDs: ids, Auth: auth}, nil
+	})
+	return err
+}
+
+// request opens a stream to the relayer, builds the request once the
+// challenge is in and returns the response.
+func (c *Client) request(ctx context.Context, build func(challenge []byte) (*protocol.MailboxRequest, error)) (*protocol.MailboxResponse, error) {
+	st, err := c.h.NewStream(ctx, c.relay, ProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+	deadline := time.Now().Add(streamTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = st.SetDeadline(deadline)
+
+	var hello protocol.MailboxResponse
+	if err := readMessage(st, &hello); err != nil {
+		_ = st.Reset()
+		return nil, err
+	}
+	challenge, err := base64.StdEncoding.DecodeString(hello.Challenge)
+	if err != nil || len(challenge) != challengeSize {
+		_ = st.Reset()
+		return nil, protocol.ErrMailboxAuth
+	}
+	req, err := build(challenge)
+	if err != nil {
+		_ = st.Reset()
+		return nil, err
+	}
+	if err := writeMessage(st, req); err != nil {
+		_ = st.Reset()
+		return nil, err
+	}
+
+	var resp protocol.MailboxResponse
+	if err := readMessage(st, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%w: %s", ErrRefused, resp.Error)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,446 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package mailbox
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/protocol"
+)
+
+// KEMAlg is the algorithm of the prekeys we generate.
+const KEMAlg = pqc.DefaultKEM
+
+// The signed prekey is replaced after prekeyLifetime. Old prekeys, and
+// one-time prekeys nobody used, are kept for prekeyKeep so mail sealed to
+// them can still be opened; the relayer hands out one-time prekeys for a
+// shorter time (see Limits.OneTimeTTL).
+const (
+	prekeyLifetime = 7 * 24 * time.Hour
+	prekeyKeep     = 30 * 24 * time.Hour
+	prekeysInfo    = "pqchat-prekeys-v1"
+)
+
+// A mail is opened within MaxMailAge of when its CHAT was signed, and
+// once: the relayer can neither serve it again nor keep it longer. Its
+// Limits.TTL should not exceed MaxMailAge. Clocks may be off by mailSkew.
+const (
+	MaxMailAge = 7 * 24 * time.Hour
+	mailSkew   = 5 * time.Minute
+)
+
+// OneTimeTarget is how many one-time prekeys we keep on the relayer. They
+// are topped up once half of them are used.
+const OneTimeTarget = 16
+
+var (
+	ErrUnknownPrekey = errors.New("mailbox: mail sealed to an unknown prekey")
+	ErrNotForUs      = errors.New("mailbox: mail addressed to another user")
+	ErrClosed        = errors.New("mailbox: prekeys closed")
+	ErrStaleMail     = errors.New("mailbox: mail too old or from the future")
+	ErrReplayed      = errors.New("mailbox: mail already opened")
+)
+
+// Keys holds our prekeys and their private keys. They are saved next to
+// the identity, encrypted under a key derived from its private key.
+type Keys struct {
+	id   *pqc.Identity
+	path string // none for an ephemeral identity
+
+	mu     sync.Mutex
+	keys   []*prekey        // newest last
+	opened map[string]int64 // mails and one-time prekeys opened → CHAT timestamp
+	closed bool
+}
+
+// saved is what the prekeys file holds. Older files hold the keys alone.
+type saved struct {
+	Keys   []*prekey        `json:"keys"`
+	Opened map[string]int64 `json:"opened,omitempty"`
+}
+
+type prekey struct {
+	ID        string `json:"id"`
+	KEMAlg    string `json:"kem_alg"`
+	Pub       []byte `json:"pub"`
+	Secret    []byte `json:"secret"`
+	Created   int64  `json:"created"`
+	OneTime   bool   `json:"one_time,omitempty"`  // deleted once used
+	Published bool   `json:"published,omitempty"` // one-time, sent to the relayer
+}
+
+// LoadKeys reads the prekeys saved at path by id, if any, and rotates them.
+// With an empty path they live in memory only.
+func LoadKeys(id *pqc.Identity, path string) (*Keys, error) {
+	k := &Keys{id: id, path: path, opened: make(map[string]int64)}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			if err := k.open(data); err != nil {
+				return nil, fmt.Errorf("open prekeys: %w", err)
+			}
+		case !os.IsNotExist(err):
+			return nil, fmt.Errorf("read prekeys: %w", err)
+		}
+	}
+	if _, err := k.Rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotate draws a new signed prekey when the current one is too old, and
+// forgets the expired ones, and the mails too old to be opened anyway. It
+// reports whether the bundle changed.
+func (k *Keys) Rotate() (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.closed {
+		return false, ErrClosed
+	}
+
+	now := time.Now()
+	kept := k.keys[:0]
+	for _, p := range k.keys {
+		if now.Sub(time.Unix(p.Created, 0)) < prekeyKeep {
+			kept = append(kept, p)
+			continue
+		}
+		pqc.Wipe(p.Secret)
+	}
+	k.keys = kept
+	for key, ts := range k.opened {
+		if now.Sub(time.Unix(ts, 0)) > MaxMailAge {
+			delete(k.opened, key)
+		}
+	}
+	if p := k.signed(); p != nil && now.Sub(time.Unix(p.Created, 0)) < prekeyLifetime {
+		return false, nil
+	}
+
+	p, err := newPrekey(now, false)
+	if err != nil {
+		return false, err
+	}
+	k.keys = append(k.keys, p)
+	return true, k.save()
+}
+
+// Replenish draws new one-time prekeys when the relayer holds less than
+// half of OneTimeTarget, held being what it reports. It reports whether
+// there are one-time prekeys to publish.
+func (k *Keys) Replenish(held int) (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.closed {
+		return false, ErrClosed
+	}
+
+	pending := 0
+	for _, p := range k.keys {
+		if p.OneTime && !p.Published {
+			pending++
+		}
+	}
+	if held >= OneTimeTarget/2 {
+		return pending > 0, nil
+	}
+	now := time.Now()
+	for range OneTimeTarget - held - pending {
+		p, err := newPrekey(now, true)
+		if err != nil {
+			return false, err
+		}
+		k.keys = append(k.keys, p)
+		pending++
+	}
+	return pending > 0, k.save()
+}
+
+// Bundle returns our prekey bundle, signed by id, with the one-time
+// prekeys not published yet.
+func (k *Keys) Bundle(id *pqc.Identity) (*protocol.PrekeyBundle, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.closed {
+		return nil, ErrClosed
+	}
+	var oneTime []protocol.Prekey
+	for _, p := range k.keys {
+		if !p.OneTime || p.Published {
+			continue
+		}
+		pk := p.public()
+		if err := protocol.SignOneTime(id, &pk); err != nil {
+			return nil, err
+		}
+		oneTime = append(oneTime, pk)
+	}
+	return protocol.NewBundle(id, k.signed().public(), oneTime)
+}
+
+// Published records that the relayer took the one-time prekeys of b.
+func (k *Keys) Published(b *protocol.PrekeyBundle) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.closed {
+		return ErrClosed
+	}
+	for _, p := range k.keys {
+		if p.OneTime && slices.ContainsFunc(b.OneTime, func(pk protocol.Prekey) bool { return pk.ID == p.ID }) {
+			p.Published = true
+		}
+	}
+	return k.save()
+}
+
+// Open decrypts a mail for userID and checks the CHAT message inside: it
+// must be signed by its sender, addressed to userID, within MaxMailAge,
+// and not opened before.
+func (k *Keys) Open(userID string, m *protocol.Mail) (*protocol.ChatMessage, error) {
+	if m.Type != "MAIL" {
+		return nil, protocol.ErrMailEncoding
+	}
+	if m.To != userID {
+		return nil, ErrNotForUs
+	}
+	ids, cts := []string{m.Prekey}, []string{m.KEMCT}
+	if m.OneTime != "" {
+		ids, cts = append(ids, m.OneTime), append(cts, m.OneTimeCT)
+	}
+	kemCTs := make([][]byte, len(cts))
+	for i, c := range cts {
+		b, err := base64.StdEncoding.DecodeString(c)
+		if err != nil || len(b) == 0 {
+			return nil, protocol.ErrMailEncoding
+		}
+		kemCTs[i] = b
+	}
+	ct, err := base64.StdEncoding.DecodeString(m.CT)
+	if err != nil {
+		return nil, protocol.ErrMailEncoding
+	}
+
+	// Hold the lock until the one-time prekey is deleted: it opens one
+	// mail only
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.opened[oneTimeKey(m.OneTime)]; ok {
+		return nil, ErrReplayed
+	}
+	var kems []*pqc.KEM
+	defer func() {
+		for _, kem := range kems {
+			kem.Clean()
+		}
+	}()
+	for i, id := range ids {
+		j := slices.IndexFunc(k.keys, func(p *prekey) bool { return p.ID == id && p.OneTime == (i > 0) })
+		if j < 0 {
+			return nil, ErrUnknownPrekey
+		}
+		kem, err := pqc.NewKEMFromSecret(k.keys[j].KEMAlg, k.keys[j].Secret)
+		if err != nil {
+			return nil, err
+		}
+		kems = append(kems, kem)
+	}
+
+	raw, err := pqc.OpenMail(kems, kemCTs, ct, protocol.MailContext(m.To, m.Prekey, m.OneTime))
+	if err != nil {
+		return nil, err
+	}
+	var msg protocol.ChatMessage
+	if err := protocol.Unmarshal(raw, &msg); err != nil {
+		return nil, protocol.ErrMailEncoding
+	}
+	if _, err := protocol.VerifyMailChat(&msg); err != nil {
+		return nil, err
+	}
+	// The sender signed it for us, not for someone who passed it on
+	if len(msg.To) != 1 || msg.To[0] != userID || msg.Room != "" {
+		return nil, ErrNotForUs
+	}
+	age := time.Since(time.Unix(msg.Timestamp, 0))
+	if age > MaxMailAge || age < -mailSkew {
+		return nil, ErrStaleMail
+	}
+	key := mailKey(&msg)
+	if _, ok := k.opened[key]; ok {
+		return nil, ErrReplayed
+	}
+
+	k.opened[key] = msg.Timestamp
+	if m.OneTime != "" {
+		k.opened[oneTimeKey(m.OneTime)] = msg.Timestamp
+		k.keys = slices.DeleteFunc(k.keys, func(p *prekey) bool {
+			if p.OneTime && p.ID == m.OneTime {
+				pqc.Wipe(p.Secret)
+				return true
+			}
+			return false
+		})
+	}
+	if err := k.save(); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// oneTimeKey remembers a one-time prekey that opened a mail, deleted since.
+func oneTimeKey(id string) string {
+	return "one-time " + id
+}
+
+// mailKey tells mails apart by their signed CHAT, whatever the envelope.
+func mailKey(msg *protocol.ChatMessage) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%s", msg.From, msg.Timestamp, msg.Sig)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Close wipes the private keys. The prekeys cannot be used afterwards.
+func (k *Keys) Close() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, p := range k.keys {
+		pqc.Wipe(p.Secret)
+	}
+	k.keys = nil
+	k.closed = true
+}
+
+// Seal encrypts a signed CHAT message to the signed prekey of a bundle,
+// and to its first one-time prekey if any. The caller has checked b.
+func Seal(b *protocol.PrekeyBundle, chat []byte) (*protocol.Mail, error) {
+	prekeys := []protocol.Prekey{b.Signed}
+	m := &protocol.Mail{Type: "MAIL", To: b.UserID, Prekey: b.Signed.ID}
+	if len(b.OneTime) > 0 {
+		prekeys = append(prekeys, b.OneTime[0])
+		m.OneTime = b.OneTime[0].ID
+	}
+	keys := make([]pqc.MailKey, len(prekeys))
+	for i, p := range prekeys {
+		pub, err := p.Key()
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = pqc.MailKey{Alg: p.KEMAlg, Pub: pub}
+	}
+
+	kemCTs, ct, err := pqc.SealMail(keys, chat, protocol.MailContext(m.To, m.Prekey, m.OneTime))
+	if err != nil {
+		return nil, err
+	}
+	m.KEMCT = base64.StdEncoding.EncodeToString(kemCTs[0])
+	if m.OneTime != "" {
+		m.OneTimeCT = base64.StdEncoding.EncodeToString(kemCTs[1])
+	}
+	m.CT = base64.StdEncoding.EncodeToString(ct)
+	return m, nil
+}
+
+// signed returns the newest signed prekey. k.mu is held.
+func (k *Keys) signed() *prekey {
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		if !k.keys[i].OneTime {
+			return k.keys[i]
+		}
+	}
+	return nil
+}
+
+func (p *prekey) public() protocol.Prekey {
+	pk := protocol.Prekey{ID: p.ID, KEMAlg: p.KEMAlg, Pub: base64.StdEncoding.EncodeToString(p.Pub)}
+	if p.OneTime {
+		pk.Created = p.Created
+	}
+	return pk
+}
+
+func newPrekey(now time.Time, oneTime bool) (*prekey, error) {
+	kem, err := pqc.NewKEMWith(KEMAlg)
+	if err != nil {
+		return nil, err
+	}
+	defer kem.Clean()
+	pub, err := kem.Keygen()
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &prekey{
+		ID:      hex.EncodeToString(id),
+		KEMAlg:  KEMAlg,
+		Pub:     pub,
+		Secret:  kem.ExportSecret(),
+		Created: now.Unix(),
+		OneTime: oneTime,
+	}, nil
+}
+
+// save writes the prekeys to k.path. k.mu is held.
+func (k *Keys) save() error {
+	if k.path == "" {
+		return nil
+	}
+	raw, err := json.Marshal(saved{Keys: k.keys, Opened: k.opened})
+	if err != nil {
+		return err
+	}
+	defer pqc.Wipe(raw)
+	sealed, err := k.id.SealData(prekeysInfo, raw)
+	if err != nil {
+		return err
+	}
+	if err := pqc.WriteFileAtomic(k.path, sealed, 0o600); err != nil {
+		return fmt.Errorf("write prekeys: %w", err)
+	}
+	return nil
+}
+
+// open reads what save wrote.
+func (k *Keys) open(data []byte) error {
+	raw, err := k.id.OpenData(prekeysInfo, data)
+	if err != nil {
+		return err
+	}
+	defer pqc.Wipe(raw)
+	if len(raw) > 0 && raw[0] == '[' {
+		return json.Unmarshal(raw, &k.keys)
+	}
+	var sv saved
+	if err := json.Unmarshal(raw, &sv); err != nil {
+		return err
+	}
+	k.keys = sv.Keys
+	if sv.Opened != nil {
+		k.opened = sv.Opened
+	}
+	return nil
+}
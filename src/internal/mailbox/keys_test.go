@@ -0,0 +1,107 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package mailbox
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/protocol"
+)
+
+func TestOpenOnce(t *testing.T) {
+	alice, err := pqc.NewIdentity("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := pqc.NewIdentity("bob", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	path := filepath.Join(t.TempDir(), "bob.prekeys")
+	keys, err := LoadKeys(bob, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Replenish(0); err != nil {
+		t.Fatal(err)
+	}
+	b, err := keys.Bundle(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mail seals a CHAT from alice signed at, to the signed prekey alone
+	// unless oneTime
+	mail := func(at time.Time, oneTime bool) *protocol.Mail {
+		t.Helper()
+		msg, _, err := protocol.BuildMailChat(alice, bob.UserID, "hi")
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Timestamp = at.Unix()
+		if err := protocol.Sign(alice, msg, &msg.Sig); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := protocol.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed := *b
+		if !oneTime {
+			sealed.OneTime = nil
+		}
+		m, err := Seal(&sealed, raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	now := time.Now()
+	signed, oneTime := mail(now, false), mail(now.Add(-time.Hour), true)
+
+	tests := []struct {
+		name string
+		m    *protocol.Mail
+		err  error
+	}{
+		{"signed prekey", signed, nil},
+		{"signed prekey again", signed, ErrReplayed},
+		{"one-time prekey", oneTime, nil},
+		{"one-time prekey again", oneTime, ErrReplayed},
+		{"too old", mail(now.Add(-MaxMailAge-time.Minute), false), ErrStaleMail},
+		{"from the future", mail(now.Add(time.Hour), false), ErrStaleMail},
+	}
+	for _, tt := range tests {
+		if _, err := keys.Open(bob.UserID, tt.m); !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	// Opened mails are remembered across restarts
+	keys.Close()
+	keys, err = LoadKeys(bob, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+	if _, err := keys.Open(bob.UserID, signed); !errors.Is(err, ErrReplayed) {
+		t.Errorf("after a restart: got %v, want %v", err, ErrReplayed)
+	}
+}
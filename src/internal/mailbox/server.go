@@ -0,0 +1,171 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package mailbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+
+	"pqchat/src/internal/net"
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/protocol"
+)
+
+// ProtocolID is the libp2p protocol of mailbox streams. A stream carries
+// one request: the relayer sends a challenge, the client its request, the
+// relayer its response. Fetch and ack must sign the challenge with the
+// identity key of the mailbox.
+const ProtocolID = "/pqchat/mailbox/1.0.0"
+
+const (
+	streamTimeout = 30 * time.Second
+	challengeSize = 32
+	sweepInterval = time.Minute
+
+	// JSON around the keys and signatures of a publish request, with room
+	// for a long pseudo
+	bundleOverhead = 4 << 10
+	prekeyOverhead = 256
+)
+
+// MaxPublishSize bounds the size of a publish request: a bundle with
+// OneTimeTarget one-time prekeys, signed with the largest signatures.
+func MaxPublishSize() (int, error) {
+	kemPub, err := pqc.KEMPublicKeySize(KEMAlg)
+	if err != nil {
+		return 0, err
+	}
+	pub, sig := pqc.MaxSigSizes()
+	b64 := base64.StdEncoding.EncodedLen
+	prekey := b64(kemPub) + b64(sig) + prekeyOverhead
+	return b64(pub) + b64(sig) + (1+OneTimeTarget)*prekey + bundleOverhead, nil
+}
+
+// Serve answers mailbox streams on h from store, and expires its content
+// until ctx is done.
+func Serve(ctx context.Context, h host.Host, store *Store) {
+	h.SetStreamHandler(ProtocolID, func(st network.Stream) {
+		serveStream(h, store, st)
+	})
+	go func() {
+		t := time.NewTicker(sweepInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				h.RemoveStreamHandler(ProtocolID)
+				return
+			case now := <-t.C:
+				store.Expire(now)
+			}
+		}
+	}()
+}
+
+func serveStream(h host.Host, store *Store, st network.Stream) {
+	defer st.Close()
+	_ = st.SetDeadline(time.Now().Add(streamTimeout))
+
+	challenge := make([]byte, challengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		_ = st.Reset()
+		return
+	}
+	hello := protocol.MailboxResponse{Challenge: base64.StdEncoding.EncodeToString(challenge)}
+	if err := writeMessage(st, &hello); err != nil {
+		_ = st.Reset()
+		return
+	}
+
+	var req protocol.MailboxRequest
+	if err := readMessage(st, &req); err != nil {
+		_ = st.Reset()
+		return
+	}
+	from := st.Conn().RemotePeer().String()
+	resp, err := answer(store, h.ID().String(), from, challenge, &req)
+	if err != nil {
+		resp = &protocol.MailboxResponse{Error: err.Error()}
+	}
+	_ = writeMessage(st, resp)
+}
+
+// answer runs a request of the peer from against the store.
+func answer(store *Store, relay, from string, challenge []byte, req *protocol.MailboxRequest) (*protocol.MailboxResponse, error) {
+	switch req.Op {
+	case "put":
+		if req.Mail == nil {
+			return nil, protocol.ErrMailEncoding
+		}
+		if _, err := store.Put(req.Mail); err != nil {
+			return nil, err
+		}
+		return &protocol.MailboxResponse{}, nil
+
+	case "publish":
+		if req.Bundle == nil {
+			return nil, protocol.ErrBundle
+		}
+		if err := store.Publish(req.Bundle); err != nil {
+			return nil, err
+		}
+		return &protocol.MailboxResponse{}, nil
+
+	case "prekeys":
+		b, err := store.Bundle(from, req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return &protocol.MailboxResponse{Bundle: b}, nil
+
+	case "fetch", "ack":
+		if req.Auth == nil {
+			return nil, protocol.ErrMailboxAuth
+		}
+		if err := req.Auth.Verify(relay, challenge); err != nil {
+			return nil, err
+		}
+		if req.Op == "fetch" {
+			return &protocol.MailboxResponse{
+				Mails:   store.Fetch(req.Auth.UserID),
+				OneTime: store.OneTime(req.Auth.UserID),
+			}, nil
+		}
+		store.Ack(req.Auth.UserID, req.IDs)
+		return &protocol.MailboxResponse{}, nil
+	}
+	return nil, fmt.Errorf("mailbox: unknown operation %q", req.Op)
+}
+
+func writeMessage(st network.Stream, v any) error {
+	raw, err := protocol.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return net.WriteFrame(st, raw)
+}
+
+func readMessage(st network.Stream, v any) error {
+	raw, err := net.ReadFrame(st)
+	if err != nil {
+		return err
+	}
+	return protocol.Unmarshal(raw, v)
+}
@@ -0,0 +1,369 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package mailbox
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"pqchat/src/internal/protocol"
+)
+
+// A relayer may hold mail for users who are offline. Senders encrypt it to
+// a prekey the recipient published, signed with its identity key, so the
+// relayer only learns who the mail is for; recipients fetch and acknowledge
+// their mail when they come back. The relayer keeps mail for a while only,
+// within quotas.
+
+var (
+	ErrMailboxFull = errors.New("mailbox: the recipient's mailbox is full")
+	ErrStoreFull   = errors.New("mailbox: the relayer holds too much mail")
+	ErrTooLarge    = errors.New("mailbox: mail too large")
+	ErrStale       = errors.New("mailbox: a newer prekey bundle is published")
+	ErrNoBundle    = errors.New("mailbox: no prekey bundle for this user")
+	ErrTooMany     = errors.New("mailbox: the relayer holds too many prekey bundles")
+	ErrRateLimited = errors.New("mailbox: too many prekey requests, try again later")
+)
+
+// maxTracked bounds the peers and users whose prekey requests are counted
+// in a window. Beyond, requests from new ones are refused.
+const maxTracked = 100000
+
+// Limits bound what a relayer holds. A zero field means no limit.
+type Limits struct {
+	TTL        time.Duration // how long mail is kept
+	BundleTTL  time.Duration // how long a bundle is kept once published
+	OneTimeTTL time.Duration // how long a one-time prekey is handed out after its creation
+	MaxMails   int           // per mailbox
+	MaxBytes   int           // per mailbox
+	MaxTotal   int64         // over every mailbox
+	MaxMail    int           // size of one mail
+	MaxBundles int           // prekey bundles held
+	MaxOneTime int           // one-time prekeys held per user
+
+	// Prekey requests are counted over FetchWindow: a peer asking too
+	// often, or for a user asked for too often, is refused. A user's
+	// one-time prekeys are handed out within a budget, bundles then go
+	// without one.
+	FetchWindow      time.Duration
+	MaxFetches       int // prekey requests per requesting peer
+	MaxUserFetches   int // prekey requests for one user
+	MaxOneTimeHanded int // one-time prekeys of one user handed out
+}
+
+// DefaultLimits suits a small community relayer.
+func DefaultLimits() Limits {
+	return Limits{
+		TTL:        MaxMailAge,
+		BundleTTL:  30 * 24 * time.Hour,
+		OneTimeTTL: 14 * 24 * time.Hour,
+		MaxMails:   100,
+		MaxBytes:   1 << 20,
+		MaxTotal:   256 << 20,
+		MaxMail:    64 << 10,
+		MaxBundles: 100000,
+		MaxOneTime: 2 * OneTimeTarget,
+
+		FetchWindow:      time.Hour,
+		MaxFetches:       60,
+		MaxUserFetches:   240,
+		MaxOneTimeHanded: OneTimeTarget / 2,
+	}
+}
+
+// Store keeps mail and prekey bundles in memory, by user ID.
+type Store struct {
+	limits Limits
+
+	mu      sync.Mutex
+	boxes   map[string][]*stored
+	bundles map[string]*published
+	total   int64
+
+	// Prekey requests by peer and by user, one-time prekeys handed out by user
+	fetchesBy, fetchesOf, handed window
+}
+
+// window counts events by key, starting over every period.
+type window struct {
+	start time.Time
+	n     map[string]int
+}
+
+// allow counts an event for key at now, unless key already had max of them
+// in the current period. A zero max or period means no limit.
+func (w *window) allow(key string, now time.Time, period time.Duration, max int) bool {
+	if max <= 0 || period <= 0 {
+		return true
+	}
+	if w.n == nil || now.Sub(w.start) >= period {
+		w.start, w.n = now, make(map[string]int)
+	}
+	n, ok := w.n[key]
+	if n >= max || (!ok && len(w.n) >= maxTracked) {
+		return false
+	}
+	w.n[key] = n + 1
+	return true
+}
+
+type stored struct {
+	protocol.StoredMail
+	size    int
+	expires time.Time
+}
+
+type published struct {
+	bundle  *protocol.PrekeyBundle // without its one-time prekeys
+	oneTime []protocol.Prekey      // oldest first
+	expires time.Time
+
+	// One-time prekeys handed out, so that they cannot be published again,
+	// by ID with their creation time. They go once stale.
+	spent map[string]int64
+}
+
+func NewStore(limits Limits) *Store {
+	return &Store{
+		limits:  limits,
+		boxes:   make(map[string][]*stored),
+		bundles: make(map[string]*published),
+	}
+}
+
+// Put stores a mail until it is acknowledged or expires, and returns its
+// ID. Only mail for users with a published bundle is taken.
+func (s *Store) Put(m *protocol.Mail) (string, error) {
+	size, err := checkMail(m)
+	if err != nil {
+		return "", err
+	}
+	if s.limits.MaxMail > 0 && size > s.limits.MaxMail {
+		return "", ErrTooLarge
+	}
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.bundles[m.To]; !ok {
+		return "", ErrNoBundle
+	}
+	box := s.boxes[m.To]
+	if s.limits.MaxMails > 0 && len(box) >= s.limits.MaxMails {
+		return "", ErrMailboxFull
+	}
+	if s.limits.MaxBytes > 0 && boxSize(box)+size > s.limits.MaxBytes {
+		return "", ErrMailboxFull
+	}
+	if s.limits.MaxTotal > 0 && s.total+int64(size) > s.limits.MaxTotal {
+		return "", ErrStoreFull
+	}
+	sm := &stored{
+		StoredMail: protocol.StoredMail{ID: id, Received: now.Unix(), Mail: *m},
+		size:       size,
+	}
+	if s.limits.TTL > 0 {
+		sm.expires = now.Add(s.limits.TTL)
+	}
+	s.boxes[m.To] = append(box, sm)
+	s.total += int64(size)
+	return id, nil
+}
+
+// Fetch returns the mail held for a user, oldest first. It stays there
+// until acknowledged.
+func (s *Store) Fetch(userID string) []protocol.StoredMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []protocol.StoredMail
+	for _, sm := range s.boxes[userID] {
+		out = append(out, sm.StoredMail)
+	}
+	return out
+}
+
+// Ack deletes mail of a user by ID, and returns how many were deleted.
+func (s *Store) Ack(userID string, ids []string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.drop(userID, func(sm *stored) bool { return slices.Contains(ids, sm.ID) })
+}
+
+// Publish stores the prekey bundle of a user, replacing an older one. Its
+// one-time prekeys are added to those not handed out yet: one handed out
+// before is not taken again, whoever publishes it.
+func (s *Store) Publish(b *protocol.PrekeyBundle) error {
+	if _, err := b.Verify(); err != nil {
+		return err
+	}
+	now := time.Now()
+	bundle := *b
+	bundle.OneTime = nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.bundles[b.UserID]
+	switch {
+	case ok && p.bundle.Timestamp > b.Timestamp:
+		return ErrStale
+	case !ok && s.limits.MaxBundles > 0 && len(s.bundles) >= s.limits.MaxBundles:
+		return ErrTooMany
+	case !ok:
+		p = &published{spent: make(map[string]int64)}
+		s.bundles[b.UserID] = p
+	}
+	p.bundle = &bundle
+	if s.limits.BundleTTL > 0 {
+		p.expires = now.Add(s.limits.BundleTTL)
+	}
+	for _, pk := range b.OneTime {
+		if s.limits.MaxOneTime > 0 && len(p.oneTime) >= s.limits.MaxOneTime {
+			break
+		}
+		held := slices.ContainsFunc(p.oneTime, func(q protocol.Prekey) bool { return q.ID == pk.ID })
+		_, spent := p.spent[pk.ID]
+		if !held && !spent && !s.stale(pk, now) {
+			p.oneTime = append(p.oneTime, pk)
+		}
+	}
+	return nil
+}
+
+// Bundle returns the prekey bundle of a user to the peer from, with one of
+// its one-time prekeys if any is left and the user's budget allows. That
+// one is never handed out again.
+func (s *Store) Bundle(from, userID string) (*protocol.PrekeyBundle, error) {
+	now, l := time.Now(), s.limits
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.fetchesBy.allow(from, now, l.FetchWindow, l.MaxFetches) {
+		return nil, ErrRateLimited
+	}
+	p, ok := s.bundles[userID]
+	if !ok {
+		return nil, ErrNoBundle
+	}
+	if !s.fetchesOf.allow(userID, now, l.FetchWindow, l.MaxUserFetches) {
+		return nil, ErrRateLimited
+	}
+	b := *p.bundle
+	if len(p.oneTime) > 0 && s.handed.allow(userID, now, l.FetchWindow, l.MaxOneTimeHanded) {
+		b.OneTime = []protocol.Prekey{p.oneTime[0]}
+		p.spent[p.oneTime[0].ID] = p.oneTime[0].Created
+		p.oneTime = slices.Delete(p.oneTime, 0, 1)
+	}
+	return &b, nil
+}
+
+// OneTime returns how many one-time prekeys are left for a user.
+func (s *Store) OneTime(userID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.bundles[userID]; ok {
+		return len(p.oneTime)
+	}
+	return 0
+}
+
+// Expire drops the mail and bundles that are too old.
+func (s *Store) Expire(now time.Time) {
+	expired := func(t time.Time) bool { return !t.IsZero() && now.After(t) }
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for userID := range s.boxes {
+		s.drop(userID, func(sm *stored) bool { return expired(sm.expires) })
+	}
+	for userID, p := range s.bundles {
+		if expired(p.expires) {
+			delete(s.bundles, userID)
+			continue
+		}
+		p.oneTime = slices.DeleteFunc(p.oneTime, func(pk protocol.Prekey) bool { return s.stale(pk, now) })
+		for id, created := range p.spent {
+			if s.stale(protocol.Prekey{Created: created}, now) {
+				delete(p.spent, id)
+			}
+		}
+	}
+}
+
+// stale reports whether a one-time prekey is too old to be handed out: its
+// owner may have deleted it by the time the mail comes.
+func (s *Store) stale(pk protocol.Prekey, now time.Time) bool {
+	return s.limits.OneTimeTTL > 0 && now.Sub(time.Unix(pk.Created, 0)) > s.limits.OneTimeTTL
+}
+
+// drop deletes the mail of a user matching fn. s.mu is held.
+func (s *Store) drop(userID string, fn func(*stored) bool) int {
+	box := s.boxes[userID]
+	kept := box[:0]
+	for _, sm := range box {
+		if fn(sm) {
+			s.total -= int64(sm.size)
+			continue
+		}
+		kept = append(kept, sm)
+	}
+	n := len(box) - len(kept)
+	clear(box[len(kept):])
+	if len(kept) == 0 {
+		delete(s.boxes, userID)
+	} else {
+		s.boxes[userID] = kept
+	}
+	return n
+}
+
+// checkMail checks the envelope the relayer can see, and returns its size.
+func checkMail(m *protocol.Mail) (int, error) {
+	if m.Type != "MAIL" || m.Prekey == "" {
+		return 0, protocol.ErrMailEncoding
+	}
+	if to, err := hex.DecodeString(m.To); err != nil || len(to) != 32 {
+		return 0, protocol.ErrMailEncoding
+	}
+	for _, field := range []string{m.KEMCT, m.CT} {
+		if b, err := base64.StdEncoding.DecodeString(field); err != nil || len(b) == 0 {
+			return 0, protocol.ErrMailEncoding
+		}
+	}
+	return len(m.To) + len(m.Prekey) + len(m.KEMCT) + len(m.CT), nil
+}
+
+func boxSize(box []*stored) int {
+	n := 0
+	for _, sm := range box {
+		n += sm.size
+	}
+	return n
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package mailbox
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/protocol"
+)
+
+func TestBundleLimits(t *testing.T) {
+	id, err := pqc.NewIdentity("bob", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer id.Close()
+	keys, err := LoadKeys(id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+	if _, err := keys.Replenish(0); err != nil {
+		t.Fatal(err)
+	}
+	b, err := keys.Bundle(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limits := DefaultLimits()
+	limits.MaxFetches, limits.MaxUserFetches, limits.MaxOneTimeHanded = 3, 5, 2
+	store := NewStore(limits)
+	if err := store.Publish(b); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		from, user string
+		oneTime    bool
+		err        error
+	}{
+		{"a", id.UserID, true, nil},
+		{"a", id.UserID, true, nil},
+		{"a", id.UserID, false, nil}, // one-time budget spent
+		{"a", id.UserID, false, ErrRateLimited},
+		{"b", "nobody", false, ErrNoBundle},
+		{"b", id.UserID, false, nil},
+		{"c", id.UserID, false, nil},
+		{"d", id.UserID, false, ErrRateLimited}, // bob asked for too often
+	}
+	for i, tt := range tests {
+		got, err := store.Bundle(tt.from, tt.user)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%d: got %v, want %v", i, err, tt.err)
+			continue
+		}
+		if err == nil && (len(got.OneTime) > 0) != tt.oneTime {
+			t.Errorf("%d: %d one-time prekeys", i, len(got.OneTime))
+		}
+	}
+	if n := store.OneTime(id.UserID); n != OneTimeTarget-2 {
+		t.Errorf("%d one-time prekeys left, want %d", n, OneTimeTarget-2)
+	}
+
+	// The next window starts over
+	for _, w := range []*window{&store.fetchesBy, &store.fetchesOf, &store.handed} {
+		w.start = w.start.Add(-limits.FetchWindow)
+	}
+	got, err := store.Bundle("a", id.UserID)
+	if err != nil {
+		t.Fatalf("next window: %v", err)
+	}
+	if len(got.OneTime) != 1 {
+		t.Errorf("next window: %d one-time prekeys", len(got.OneTime))
+	}
+}
+
+func TestWindow(t *testing.T) {
+	var w window
+	now := time.Now()
+	for i := range 3 {
+		if !w.allow("k", now, time.Minute, 3) {
+			t.Fatalf("event %d refused", i)
+		}
+	}
+	if w.allow("k", now.Add(59*time.Second), time.Minute, 3) {
+		t.Error("fourth event allowed")
+	}
+	if !w.allow("other", now, time.Minute, 3) {
+		t.Error("other key refused")
+	}
+	if !w.allow("k", now.Add(time.Minute), time.Minute, 3) {
+		t.Error("refused in the next period")
+	}
+	if !w.allow("k", now, 0, 1) || !w.allow("k", now, time.Minute, 0) {
+		t.Error("zero limits refuse")
+	}
+}
+
+func TestRepublishHanded(t *testing.T) {
+	id, err := pqc.NewIdentity("bob", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer id.Close()
+	keys, err := LoadKeys(id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+	if _, err := keys.Replenish(0); err != nil {
+		t.Fatal(err)
+	}
+	b, err := keys.Bundle(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(DefaultLimits())
+	if err := store.Publish(b); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Bundle("eve", id.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.OneTime) != 1 {
+		t.Fatalf("%d one-time prekeys", len(got.OneTime))
+	}
+	// Anyone who fetched it may publish the bundle again, with that prekey
+	if err := store.Publish(got); err != nil {
+		t.Fatal(err)
+	}
+	if n := store.OneTime(id.UserID); n != OneTimeTarget-1 {
+		t.Errorf("%d one-time prekeys left, want %d", n, OneTimeTarget-1)
+	}
+	for range OneTimeTarget {
+		next, err := store.Bundle("alice", id.UserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(next.OneTime) > 0 && next.OneTime[0].ID == got.OneTime[0].ID {
+			t.Fatal("one-time prekey handed out twice")
+		}
+	}
+}
+
+func TestMaxPublishSize(t *testing.T) {
+	limit, err := MaxPublishSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, alg := range pqc.SigAlgorithms {
+		id, err := pqc.NewIdentity("bob", alg)
+		if err != nil {
+			continue // disabled in this liboqs build
+		}
+		keys, err := LoadKeys(id, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := keys.Replenish(0); err != nil {
+			t.Fatal(err)
+		}
+		b, err := keys.Bundle(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := protocol.Marshal(&protocol.MailboxRequest{Op: "publish", Bundle: b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(raw) > limit {
+			t.Errorf("%s: publish request of %d bytes, limit %d", alg, len(raw), limit)
+		}
+		keys.Close()
+		id.Close()
+	}
+}
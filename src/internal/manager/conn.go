@@ -0,0 +1,75 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package manager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"pqchat/src/internal/net"
+	"pqchat/src/internal/session"
+)
+
+// Conn is an authenticated session with a peer and the stream it runs on.
+type Conn struct {
+	Session  *session.Session
+	Stream   network.Stream
+	Version  net.Version
+	Outbound bool // we dialed
+
+	done     chan struct{} // closed when the read loop is over
+	dropOnce sync.Once
+}
+
+func newConn(sess *session.Session, s network.Stream, v net.Version, outbound bool) *Conn {
+	return &Conn{
+		Session:  sess,
+		Stream:   s,
+		Version:  v,
+		Outbound: outbound,
+		done:     make(chan struct{}),
+	}
+}
+
+func (c *Conn) PeerID() peer.ID { return c.Session.RemotePeer }
+func (c *Conn) UserID() string  { return c.Session.RemoteUserID }
+func (c *Conn) Pseudo() string  { return c.Session.RemotePseudo }
+
+// Send encrypts f and writes it to the peer.
+func (c *Conn) Send(f *net.Frame) error {
+	return c.Session.Send(c.Stream, f)
+}
+
+// Close sends a close frame and lets the peer drain the stream, waiting at
+// most timeout, then drops the session.
+func (c *Conn) Close(timeout time.Duration) {
+	_ = c.Send(&net.Frame{Type: net.FrameClose})
+	_ = c.Stream.CloseWrite()
+	select {
+	case <-c.done:
+	case <-time.After(timeout):
+	}
+	c.drop()
+}
+
+// drop closes the stream and wipes the session keys.
+func (c *Conn) drop() {
+	c.dropOnce.Do(func() {
+		_ = c.Stream.Close()
+		c.Session.Close()
+	})
+}
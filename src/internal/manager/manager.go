@@ -0,0 +1,322 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package manager
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"pqchat/src/internal/net"
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/session"
+)
+
+var (
+	ErrUnknownUser = errors.New("manager: no session with this user")
+	ErrClosed      = errors.New("manager: closed")
+)
+
+// How long Close waits for peers to drain their streams.
+const closeTimeout = 2 * time.Second
+
+// Handlers are called by the manager, from its own goroutines. Any of them
+// may be nil.
+type Handlers struct {
+	Handshaking  func(p peer.ID, in bool)            // a handshake started
+	Connected    func(c *Conn)                       // a new session is up
+	Disconnected func(c *Conn, err error)            // nil err: closed by either side
+	Frame        func(c *Conn, f *net.Frame)         // an authenticated frame arrived
+	Failed       func(p peer.ID, in bool, err error) // a handshake failed
+}
+
+// Manager keeps one session per remote peer, whoever dialed, and lets the
+// application talk to them by user ID.
+type Manager struct {
+	h        host.Host
+	cfg      *session.Config
+	versions []net.Version
+	on       Handlers
+
+	mu     sync.Mutex
+	id     *pqc.Identity
+	byPeer map[peer.ID]*Conn
+	byUser map[string]*Conn
+	closed bool
+}
+
+// New creates a manager and registers its stream handlers on h.
+func New(h host.Host, id *pqc.Identity, cfg *session.Config, versions []net.Version, on Handlers) *Manager {
+	m := &Manager{
+		h:        h,
+		id:       id,
+		cfg:      cfg,
+		versions: versions,
+		on:       on,
+		byPeer:   make(map[peer.ID]*Conn),
+		byUser:   make(map[string]*Conn),
+	}
+	net.SetStreamHandlers(h, versions, m.handleStream)
+	return m
+}
+
+// Identity returns the identity new sessions are opened with.
+func (m *Manager) Identity() *pqc.Identity {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.id
+}
+
+// SetIdentity changes the identity of the sessions opened from now on.
+// Established sessions keep the one they were authenticated with.
+func (m *Manager) SetIdentity(id *pqc.Identity) {
+	m.mu.Lock()
+	m.id = id
+	m.mu.Unlock()
+}
+
+// handleStream runs the server side of the handshake on an incoming stream,
+// then serves it: replies to this peer go through the same stream.
+func (m *Manager) handleStream(v net.Version, s network.Stream) {
+	if m.on.Handshaking != nil {
+		m.on.Handshaking(s.Conn().RemotePeer(), true)
+	}
+	sess, err := session.ServerHandshake(s, m.Identity(), m.cfg)
+	if err != nil {
+		_ = s.Reset()
+		if m.on.Failed != nil {
+			m.on.Failed(s.Conn().RemotePeer(), true, err)
+		}
+		return
+	}
+	c := newConn(sess, s, v, false)
+	if m.add(c) {
+		m.serve(c)
+	}
+}
+
+// Connect dials the peer at maddr, unless a session with it already exists.
+func (m *Manager) Connect(ctx context.Context, maddr string) (*Conn, error) {
+	info, err := peer.AddrInfoFromString(maddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer multiaddr: %w", err)
+	}
+	return m.ConnectPeer(ctx, *info)
+}
+
+// ConnectPeer is Connect with already parsed addresses.
+func (m *Manager) ConnectPeer(ctx context.Context, info peer.AddrInfo) (*Conn, error) {
+	if c, ok := m.LookupPeer(info.ID); ok {
+		return c, nil
+	}
+	if err := m.h.Connect(ctx, info); err != nil {
+		return nil, fmt.Errorf("peer connect: %w", err)
+	}
+	s, v, err := net.OpenStream(ctx, m.h, info.ID, m.versions)
+	if err != nil {
+		return nil, fmt.Errorf("open stream: %w", err)
+	}
+	if m.on.Handshaking != nil {
+		m.on.Handshaking(info.ID, false)
+	}
+	sess, err := session.ClientHandshake(s, m.Identity(), m.cfg)
+	if err != nil {
+		_ = s.Reset()
+		if m.on.Failed != nil {
+			m.on.Failed(info.ID, false, err)
+		}
+		return nil, fmt.Errorf("pqc handshake: %w", err)
+	}
+
+	c := newConn(sess, s, v, true)
+	if !m.add(c) {
+		// The peer dialed us at the same time and its stream won
+		if w, ok := m.LookupPeer(info.ID); ok {
+			return w, nil
+		}
+		return nil, ErrClosed
+	}
+	go m.serve(c)
+	return c, nil
+}
+
+// add registers c, settling duplicates with another session to the same
+// peer. It returns false if c was dropped.
+func (m *Manager) add(c *Conn) bool {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		c.drop()
+		return false
+	}
+	old := m.byPeer[c.PeerID()]
+	if old != nil && !m.prefer(c, old) {
+		m.mu.Unlock()
+		c.drop()
+		return false
+	}
+	if old != nil && m.byUser[old.UserID()] == old {
+		delete(m.byUser, old.UserID())
+	}
+	m.byPeer[c.PeerID()] = c
+	m.byUser[c.UserID()] = c
+	m.mu.Unlock()
+
+	if old != nil {
+		old.drop()
+	}
+	if m.on.Connected != nil {
+		m.on.Connected(c)
+	}
+	return true
+}
+
+// prefer tells whether c should replace old, another session with the same
+// peer. When both peers dialed each other at once, both ends keep the stream
+// dialed by the lower peer ID; otherwise the newer session wins, the old one
+// being most likely dead.
+func (m *Manager) prefer(c, old *Conn) bool {
+	if c.Outbound == old.Outbound {
+		return true
+	}
+	weDialFirst := m.h.ID() < c.PeerID()
+	return c.Outbound == weDialFirst
+}
+
+// remove forgets c if it is still the registered session of its peer.
+func (m *Manager) remove(c *Conn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.byPeer[c.PeerID()] != c {
+		return false
+	}
+	delete(m.byPeer, c.PeerID())
+	if m.byUser[c.UserID()] == c {
+		delete(m.byUser, c.UserID())
+	}
+	return true
+}
+
+// serve reads frames from c until the stream ends.
+func (m *Manager) serve(c *Conn) {
+	defer close(c.done)
+
+	rd := bufio.NewReader(c.Stream)
+	var err error
+	for {
+		var f *net.Frame
+		if f, err = c.Session.Recv(rd); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			break
+		}
+		if f.Type == net.FrameClose {
+			break
+		}
+		if m.on.Frame != nil {
+			m.on.Frame(c, f)
+		}
+	}
+
+	// Dropped connections were replaced, nobody left
+	if m.remove(c) && m.on.Disconnected != nil {
+		m.on.Disconnected(c, err)
+	}
+	c.drop()
+}
+
+// Send sends f to the user's session.
+func (m *Manager) Send(userID string, f *net.Frame) error {
+	c, ok := m.Lookup(userID)
+	if !ok {
+		return ErrUnknownUser
+	}
+	return c.Send(f)
+}
+
+// Broadcast sends f to every session and returns the failures by user ID.
+func (m *Manager) Broadcast(f *net.Frame) map[string]error {
+	failed := make(map[string]error)
+	for _, c := range m.Conns() {
+		if err := c.Send(f); err != nil {
+			failed[c.UserID()] = err
+		}
+	}
+	return failed
+}
+
+// Lookup returns the session with a user.
+func (m *Manager) Lookup(userID string) (*Conn, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.byUser[userID]
+	return c, ok
+}
+
+// LookupPeer returns the session with a libp2p peer.
+func (m *Manager) LookupPeer(p peer.ID) (*Conn, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.byPeer[p]
+	return c, ok
+}
+
+// Conns returns the current sessions.
+func (m *Manager) Conns() []*Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]*Conn, 0, len(m.byPeer))
+	for _, c := range m.byPeer {
+		out = append(out, c)
+	}
+	return out
+}
+
+// Disconnect closes the session with a user.
+func (m *Manager) Disconnect(userID string) error {
+	c, ok := m.Lookup(userID)
+	if !ok {
+		return ErrUnknownUser
+	}
+	c.Close(closeTimeout)
+	return nil
+}
+
+// Close says goodbye to every peer and waits for them, at most a few
+// seconds, before wiping the sessions.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range m.Conns() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Close(closeTimeout)
+		}()
+	}
+	wg.Wait()
+}
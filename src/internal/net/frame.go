@@ -0,0 +1,137 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every message sent with WriteFrame starts with a typed header (big endian):
+//
+//	version  1 byte   FrameVersion
+//	type     1 byte   FrameType
+//	flags    2 bytes  Flag* bits, unknown ones are ignored
+//	channel  4 bytes  stream/channel the frame belongs to (0: default)
+//
+// Receivers skip frame types they do not know, so new types can be added
+// without breaking older peers.
+const (
+	FrameVersion    = 1
+	FrameHeaderSize = 8
+)
+
+type FrameType uint8
+
+const (
+	FrameHandshake FrameType = iota + 1 // key exchange, in clear
+	FrameHello                          // signed HELLO
+	FrameChat                           // signed CHAT envelope
+	FrameAck                            // delivery acknowledgement
+	FrameRekey                          // explicit rekey request
+	FramePing                           // keepalive
+	FrameClose                          // orderly session shutdown
+	FrameRoom                           // room invite, join, leave, commit or message
+)
+
+var frameTypeNames = map[FrameType]string{
+	FrameHandshake: "handshake",
+	FrameHello:     "hello",
+	FrameChat:      "chat",
+	FrameAck:       "ack",
+	FrameRekey:     "rekey",
+	FramePing:      "ping",
+	FrameClose:     "close",
+	FrameRoom:      "room",
+}
+
+func (t FrameType) String() string {
+	if name, ok := frameTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("type-%d", uint8(t))
+}
+
+// Known reports whether this implementation handles frames of type t.
+func (t FrameType) Known() bool {
+	_, ok := frameTypeNames[t]
+	return ok
+}
+
+const (
+	FlagEncrypted uint16 = 1 << 0 // payload is a session ciphertext
+)
+
+var (
+	ErrFrameVersion = errors.New("net: unsupported frame version")
+	ErrFrameHeader  = errors.New("net: frame too short for its header")
+)
+
+// Frame is one typed message on a /pqchat stream.
+type Frame struct {
+	Version uint8
+	Type    FrameType
+	Flags   uint16
+	Channel uint32
+	Payload []byte
+}
+
+// Header returns the encoded header, also used as additional data when the
+// payload is encrypted.
+func (f *Frame) Header() []byte {
+	v := f.Version
+	if v == 0 {
+		v = FrameVersion
+	}
+	hdr := make([]byte, 0, FrameHeaderSize)
+	hdr = append(hdr, v, byte(f.Type))
+	hdr = binary.BigEndian.AppendUint16(hdr, f.Flags)
+	return binary.BigEndian.AppendUint32(hdr, f.Channel)
+}
+
+// Encrypted reports whether FlagEncrypted is set.
+func (f *Frame) Encrypted() bool {
+	return f.Flags&FlagEncrypted != 0
+}
+
+// Send writes f as one message.
+func Send(w io.Writer, f *Frame) error {
+	buf := make([]byte, 0, FrameHeaderSize+len(f.Payload))
+	buf = append(buf, f.Header()...)
+	return WriteFrame(w, append(buf, f.Payload...))
+}
+
+// Recv reads the next typed frame. Its type may be unknown (see Known).
+func Recv(rd io.Reader) (*Frame, error) {
+	raw, err := ReadFrame(rd)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < FrameHeaderSize {
+		return nil, ErrFrameHeader
+	}
+	f := &Frame{
+		Version: raw[0],
+		Type:    FrameType(raw[1]),
+		Flags:   binary.BigEndian.Uint16(raw[2:4]),
+		Channel: binary.BigEndian.Uint32(raw[4:8]),
+		Payload: raw[FrameHeaderSize:],
+	}
+	if f.Version != FrameVersion {
+		return nil, fmt.Errorf("%w %d", ErrFrameVersion, f.Version)
+	}
+	return f, nil
+}
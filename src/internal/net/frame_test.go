@@ -0,0 +1,157 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// setLimits sets small limits for the test, so that chunking shows.
+func setLimits(t *testing.T, frame, message int) {
+	t.Helper()
+	if err := SetLimits(frame, message); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { maxFrameSize, maxMessageSize = DefaultMaxFrameSize, DefaultMaxMessageSize })
+}
+
+// chunkHeaders returns the length headers of the frames in wire.
+func chunkHeaders(t *testing.T, wire []byte) []uint32 {
+	t.Helper()
+	var hdrs []uint32
+	for len(wire) > 0 {
+		if len(wire) < frameHeaderSize {
+			t.Fatalf("%d bytes left after the last frame", len(wire))
+		}
+		v := binary.BigEndian.Uint32(wire)
+		hdrs = append(hdrs, v)
+		wire = wire[frameHeaderSize+int(v&frameLenMask):]
+	}
+	return hdrs
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	setLimits(t, 16, 64)
+	const more = frameMore
+	tests := []struct {
+		size int
+		hdrs []uint32
+	}{
+		{0, []uint32{0}},
+		{5, []uint32{5}},
+		{16, []uint32{16}},
+		{17, []uint32{more | 16, 1}},
+		{32, []uint32{more | 16, 16}},
+		{50, []uint32{more | 16, more | 16, more | 16, 2}},
+		{64, []uint32{more | 16, more | 16, more | 16, 16}},
+	}
+	for _, tt := range tests {
+		data := bytes.Repeat([]byte{0xa5}, tt.size)
+		var wire bytes.Buffer
+		if err := WriteFrame(&wire, data); err != nil {
+			t.Fatalf("%d bytes: %v", tt.size, err)
+		}
+		hdrs := chunkHeaders(t, wire.Bytes())
+		if len(hdrs) != len(tt.hdrs) {
+			t.Errorf("%d bytes: headers %x, want %x", tt.size, hdrs, tt.hdrs)
+		} else {
+			for i := range hdrs {
+				if hdrs[i] != tt.hdrs[i] {
+					t.Errorf("%d bytes: headers %x, want %x", tt.size, hdrs, tt.hdrs)
+					break
+				}
+			}
+		}
+		got, err := ReadFrame(&wire)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", tt.size, err)
+		}
+		if got == nil || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: read back %x", tt.size, got)
+		}
+	}
+
+	if err := WriteFrame(io.Discard, make([]byte, 65)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("writing 65 bytes: got %v, want %v", err, ErrMessageTooLarge)
+	}
+}
+
+func TestFrameLimits(t *testing.T) {
+	if err := SetLimits(frameLenMask+1, frameLenMask+1); err == nil {
+		t.Error("frame limit beyond 31 bits accepted")
+	}
+	setLimits(t, 16, 40)
+
+	frame := func(hdr uint32, payload int) []byte {
+		b := binary.BigEndian.AppendUint32(nil, hdr)
+		return append(b, make([]byte, payload)...)
+	}
+	join := func(frames ...[]byte) []byte { return bytes.Join(frames, nil) }
+	tests := []struct {
+		name string
+		wire []byte
+		want error
+	}{
+		{"oversize frame", frame(17, 17), ErrFrameTooLarge},
+		{"31-bit length", frame(frameLenMask, 0), ErrFrameTooLarge},
+		{"oversize continued frame", frame(frameMore|frameLenMask, 0), ErrFrameTooLarge},
+		{"oversize message", join(frame(frameMore|16, 16), frame(frameMore|16, 16), frame(9, 9)), ErrMessageTooLarge},
+		{"empty continued frame", join(frame(frameMore, 0), frame(frameMore, 0), frame(4, 4)), ErrEmptyChunk},
+		{"truncated header", []byte{0, 0}, io.ErrUnexpectedEOF},
+		{"truncated payload", frame(8, 4), io.ErrUnexpectedEOF},
+		{"truncated continuation", frame(frameMore|16, 16), io.EOF},
+		{"continuation cut in its payload", join(frame(frameMore|16, 16), frame(4, 2)), io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		if _, err := ReadFrame(bytes.NewReader(tt.wire)); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestTypedFrame(t *testing.T) {
+	f := &Frame{Type: FrameRoom, Flags: FlagEncrypted | 0x8000, Channel: 0x01020304, Payload: []byte("payload")}
+	want := []byte{FrameVersion, byte(FrameRoom), 0x80, 0x01, 1, 2, 3, 4}
+	if !bytes.Equal(f.Header(), want) {
+		t.Errorf("header %x, want %x", f.Header(), want)
+	}
+
+	var wire bytes.Buffer
+	if err := Send(&wire, f); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Recv(&wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != FrameVersion || got.Type != f.Type || got.Flags != f.Flags ||
+		got.Channel != f.Channel || !bytes.Equal(got.Payload, f.Payload) || !got.Encrypted() {
+		t.Errorf("got %+v, want %+v", got, f)
+	}
+
+	wire.Reset()
+	_ = WriteFrame(&wire, []byte{FrameVersion, byte(FrameChat), 0})
+	if _, err := Recv(&wire); !errors.Is(err, ErrFrameHeader) {
+		t.Errorf("short header: got %v, want %v", err, ErrFrameHeader)
+	}
+	wire.Reset()
+	_ = Send(&wire, &Frame{Version: FrameVersion + 1, Type: FrameChat})
+	if _, err := Recv(&wire); !errors.Is(err, ErrFrameVersion) {
+		t.Errorf("version %d: got %v, want %v", FrameVersion+1, err, ErrFrameVersion)
+	}
+}
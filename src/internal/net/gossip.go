@@ -0,0 +1,265 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package net
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Room envelopes can be published over GossipSub, one topic per room,
+// rather than sent over every session. They are signed with ML-DSA and
+// encrypted under the room key already, so libp2p's own message signing
+// is off and messages carry no author: a message is identified by the
+// hash of its data, and only forwarded once the room has checked it.
+
+// GossipTopicPrefix starts the topic of every room.
+const GossipTopicPrefix = "/pqchat/room/1.0.0/"
+
+// How long message IDs are remembered to drop duplicates.
+const gossipSeenTTL = 10 * time.Minute
+
+var (
+	ErrGossipJoined = errors.New("net: already subscribed to this room")
+	ErrGossipTopic  = errors.New("net: not subscribed to this room")
+
+	// ErrIgnore is returned by validators for messages they cannot judge,
+	// e.g. from an epoch they do not know yet. Such messages are dropped
+	// without penalizing the peer that forwarded them.
+	ErrIgnore = errors.New("net: message ignored")
+)
+
+// Validate checks a message before it is delivered and forwarded. What it
+// returns is passed to the deliver function.
+type Validate func(data []byte) (any, error)
+
+// Gossip publishes room envelopes over GossipSub.
+type Gossip struct {
+	ctx context.Context
+	h   host.Host
+	ps  *pubsub.PubSub
+
+	mu     sync.Mutex
+	topics map[string]*pubsub.Topic // joined once, kept for rejoining
+	subs   map[string]*gossipSub
+}
+
+type gossipSub struct {
+	sub    *pubsub.Subscription
+	cancel context.CancelFunc
+}
+
+// NewGossip starts GossipSub on h, with peer scoring.
+func NewGossip(ctx context.Context, h host.Host) (*Gossip, error) {
+	ps, err := pubsub.NewGossipSub(ctx, h,
+		pubsub.WithMessageSignaturePolicy(pubsub.StrictNoSign),
+		pubsub.WithNoAuthor(),
+		pubsub.WithMessageIdFn(gossipMessageID),
+		pubsub.WithSeenMessagesTTL(gossipSeenTTL),
+		pubsub.WithPeerScore(gossipScoreParams(), gossipScoreThresholds()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Gossip{
+		ctx:    ctx,
+		h:      h,
+		ps:     ps,
+		topics: make(map[string]*pubsub.Topic),
+		subs:   make(map[string]*gossipSub),
+	}, nil
+}
+
+// GossipTopic returns the topic of a room. The name is hashed so topics
+// have a fixed size.
+func GossipTopic(room string) string {
+	sum := sha256.Sum256([]byte(room))
+	return GossipTopicPrefix + hex.EncodeToString(sum[:16])
+}
+
+// Join subscribes to a room. Messages from other peers are passed to
+// validate, then, when accepted, to deliver and the mesh.
+func (g *Gossip) Join(room string, validate Validate, deliver func(v any)) error {
+	name := GossipTopic(room)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.subs[name] != nil {
+		return ErrGossipJoined
+	}
+
+	err := g.ps.RegisterTopicValidator(name, func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		v, err := validate(msg.Data)
+		switch {
+		case errors.Is(err, ErrIgnore):
+			return pubsub.ValidationIgnore
+		case err != nil:
+			return pubsub.ValidationReject
+		}
+		msg.ValidatorData = v
+		return pubsub.ValidationAccept
+	})
+	if err != nil {
+		return err
+	}
+	topic, err := g.topic(name)
+	if err != nil {
+		_ = g.ps.UnregisterTopicValidator(name)
+		return err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		_ = g.ps.UnregisterTopicValidator(name)
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(g.ctx)
+	g.subs[name] = &gossipSub{sub: sub, cancel: cancel}
+	go g.read(ctx, sub, deliver)
+	return nil
+}
+
+// topic joins a topic the first time it is needed. g.mu is held.
+func (g *Gossip) topic(name string) (*pubsub.Topic, error) {
+	if t := g.topics[name]; t != nil {
+		return t, nil
+	}
+	t, err := g.ps.Join(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.SetScoreParams(gossipTopicParams()); err != nil {
+		_ = t.Close()
+		return nil, err
+	}
+	g.topics[name] = t
+	return t, nil
+}
+
+func (g *Gossip) read(ctx context.Context, sub *pubsub.Subscription, deliver func(v any)) {
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		// Our own messages come back to us
+		if msg.ReceivedFrom == g.h.ID() {
+			continue
+		}
+		deliver(msg.ValidatorData)
+	}
+}
+
+// Publish sends data to the peers subscribed to a room. It goes through
+// the room's validator first, like any other message.
+func (g *Gossip) Publish(room string, data []byte) error {
+	name := GossipTopic(room)
+	g.mu.Lock()
+	t := g.topics[name]
+	joined := g.subs[name] != nil
+	g.mu.Unlock()
+	if !joined {
+		return ErrGossipTopic
+	}
+	return t.Publish(g.ctx, data)
+}
+
+// Leave unsubscribes from a room.
+func (g *Gossip) Leave(room string) {
+	g.leave(GossipTopic(room))
+}
+
+// Close leaves every room.
+func (g *Gossip) Close() {
+	g.mu.Lock()
+	var names []string
+	for name := range g.subs {
+		names = append(names, name)
+	}
+	g.mu.Unlock()
+	for _, name := range names {
+		g.leave(name)
+	}
+}
+
+func (g *Gossip) leave(name string) {
+	g.mu.Lock()
+	s := g.subs[name]
+	delete(g.subs, name)
+	g.mu.Unlock()
+	if s == nil {
+		return
+	}
+	s.cancel()
+	s.sub.Cancel()
+	_ = g.ps.UnregisterTopicValidator(name)
+}
+
+// gossipMessageID identifies messages by content, as they have no author
+// nor sequence number: the same envelope is the same message.
+func gossipMessageID(m *pb.Message) string {
+	sum := sha256.Sum256(m.Data)
+	return string(sum[:])
+}
+
+// Peer scoring: peers forwarding messages the rooms reject sink fast and
+// get pruned, then graylisted. Rooms are quiet, so there is no penalty for
+// delivering few messages.
+func gossipScoreParams() *pubsub.PeerScoreParams {
+	return &pubsub.PeerScoreParams{
+		Topics:                      make(map[string]*pubsub.TopicScoreParams),
+		AppSpecificScore:            func(peer.ID) float64 { return 0 },
+		IPColocationFactorWeight:    -10,
+		IPColocationFactorThreshold: 8,
+		BehaviourPenaltyWeight:      -10,
+		BehaviourPenaltyThreshold:   6,
+		BehaviourPenaltyDecay:       pubsub.ScoreParameterDecay(time.Hour),
+		DecayInterval:               time.Second,
+		DecayToZero:                 0.01,
+		RetainScore:                 30 * time.Minute,
+	}
+}
+
+func gossipScoreThresholds() *pubsub.PeerScoreThresholds {
+	return &pubsub.PeerScoreThresholds{
+		GossipThreshold:             -100,
+		PublishThreshold:            -500,
+		GraylistThreshold:           -1000,
+		AcceptPXThreshold:           100,
+		OpportunisticGraftThreshold: 5,
+	}
+}
+
+func gossipTopicParams() *pubsub.TopicScoreParams {
+	return &pubsub.TopicScoreParams{
+		TopicWeight:                    1,
+		TimeInMeshWeight:               0.01,
+		TimeInMeshQuantum:              time.Second,
+		TimeInMeshCap:                  300,
+		FirstMessageDeliveriesWeight:   1,
+		FirstMessageDeliveriesDecay:    pubsub.ScoreParameterDecay(10 * time.Minute),
+		FirstMessageDeliveriesCap:      50,
+		InvalidMessageDeliveriesWeight: -100,
+		InvalidMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(time.Hour),
+	}
+}
@@ -22,12 +22,14 @@ import (
 	"github.com/libp2p/go-libp2p/core/host"
 )
 
-func NewHost(listen string) (host.Host, error) {
-	return libp2p.New(
+// NewHost returns a host listening on listen. opts come on top of ours,
+// e.g. dht.Routing to build it with a DHT node.
+func NewHost(listen string, opts ...libp2p.Option) (host.Host, error) {
+	return libp2p.New(append([]libp2p.Option{
 		libp2p.Security(noisy.ID, noisy.New),
 		libp2p.Transport(tcp.NewTCPTransport),
 		libp2p.Transport(quic.NewTransport),
 		libp2p.ListenAddrStrings(listen),
 		libp2p.EnableRelay(),
-	)
+	}, opts...)...)
 }
@@ -21,8 +21,8 @@ import (
 	tcp "github.com/libp2p/go-libp2p/p2p/transport/tcp"
 )
 
-func NewRelayHost() (host.Host, error) {
-	h, err := libp2p.New(
+func NewRelayHost(opts ...libp2p.Option) (host.Host, error) {
+	h, err := libp2p.New(append([]libp2p.Option{
 		libp2p.ListenAddrStrings(
 			"/ip4/0.0.0.0/tcp/4001",
 			"/ip4/0.0.0.0/udp/4001/quic-v1",
@@ -31,7 +31,7 @@ func NewRelayHost() (host.Host, error) {
 		libp2p.EnableRelayService(), // act as relay
 		libp2p.Transport(tcp.NewTCPTransport),
 		libp2p.Transport(quic.NewTransport),
-	)
+	}, opts...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -15,25 +15,108 @@ package net
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+)
+
+// Framing v2. Each frame is a 4-byte big endian header followed by its
+// payload. The low 31 bits of the header give the payload length; the top
+// bit is set when the payload continues in the next frame, so a message
+// larger than the frame limit is sent as several chunks:
+//
+//	[1|len][chunk] [1|len][chunk] ... [0|len][last chunk]
+//
+// Both limits are enforced on read, before anything gets allocated. Only
+// the last chunk may be empty, so a peer cannot keep us reading forever.
+const (
+	DefaultMaxFrameSize   = 1 << 20  // 1 MiB per frame
+	DefaultMaxMessageSize = 16 << 20 // 16 MiB per reassembled message
 
-	"github.com/libp2p/go-libp2p/core/network"
+	frameHeaderSize = 4
+	frameMore       = 1 << 31
+	frameLenMask    = frameMore - 1
 )
 
-func WriteFrame(s network.Stream, data []byte) error {
-	if err := binary.Write(s, binary.BigEndian, uint16(len(data))); err != nil {
-		return err
+var (
+	ErrFrameTooLarge   = errors.New("net: frame exceeds the maximum size")
+	ErrMessageTooLarge = errors.New("net: message exceeds the maximum size")
+	ErrEmptyChunk      = errors.New("net: empty continued frame")
+)
+
+var (
+	maxFrameSize   = DefaultMaxFrameSize
+	maxMessageSize = DefaultMaxMessageSize
+)
+
+// SetLimits sets the maximum frame and message sizes, for both directions.
+// Peers should agree on them: a peer with a smaller frame limit rejects our
+// larger chunks.
+func SetLimits(frame, message int) error {
+	if frame <= 0 || frame > frameLenMask || message < frame {
+		return fmt.Errorf("net: invalid frame limits %d/%d", frame, message)
+	}
+	maxFrameSize, maxMessageSize = frame, message
+	return nil
+}
+
+// WriteFrame sends data as one message, split in chunks of at most the
+// maximum frame size. Writers sharing a stream must not interleave calls.
+func WriteFrame(w io.Writer, data []byte) error {
+	if len(data) > maxMessageSize {
+		return ErrMessageTooLarge
+	}
+	for {
+		n, hdr := len(data), uint32(len(data))
+		if n > maxFrameSize {
+			n, hdr = maxFrameSize, uint32(maxFrameSize)|frameMore
+		}
+		// One Write per frame, so a frame never gets split by the transport
+		// between two writers
+		buf := make([]byte, 0, frameHeaderSize+n)
+		buf = binary.BigEndian.AppendUint32(buf, hdr)
+		buf = append(buf, data[:n]...)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		data = data[n:]
+		if hdr&frameMore == 0 {
+			return nil
+		}
 	}
-	_, err := s.Write(data)
-	return err
 }
 
+// ReadFrame reads one message, reassembling its chunks.
 func ReadFrame(rd io.Reader) ([]byte, error) {
-	var sz uint16
-	if err := binary.Read(rd, binary.BigEndian, &sz); err != nil {
-		return nil, err
+	var msg []byte
+	for {
+		var hdr [frameHeaderSize]byte
+		if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+			return nil, err
+		}
+		v := binary.BigEndian.Uint32(hdr[:])
+		sz := int(v & frameLenMask)
+		if sz > maxFrameSize {
+			return nil, ErrFrameTooLarge
+		}
+		if sz == 0 && v&frameMore != 0 {
+			return nil, ErrEmptyChunk
+		}
+		if len(msg)+sz > maxMessageSize {
+			return nil, ErrMessageTooLarge
+		}
+
+		// Never allocate more than one frame ahead of the received data
+		off := len(msg)
+		msg = append(msg, make([]byte, sz)...)
+		if _, err := io.ReadFull(rd, msg[off:]); err != nil {
+			return nil, err
+		}
+		if v&frameMore == 0 {
+			if msg == nil {
+				msg = []byte{}
+			}
+			return msg, nil
+		}
 	}
-	buf := make([]byte, sz)
-	_, err := io.ReadFull(rd, buf)
-	return buf, err
 }
@@ -0,0 +1,132 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	msmux "github.com/multiformats/go-multistream"
+)
+
+// ProtocolPrefix starts the libp2p protocol ID of pqchat streams, the
+// version following it: /pqchat/2.0.0
+const ProtocolPrefix = "/pqchat/"
+
+// Version of the /pqchat stream protocol (handshake and framing). Both ends
+// register one stream handler per version they speak, and multistream-select
+// picks the highest one they have in common when a stream is opened.
+type Version struct {
+	Major, Minor int
+}
+
+// Versions spoken by this build, newest first. 1.0 (uint16 frames and an
+// anonymous ML-KEM handshake) was dropped as it could not be authenticated,
+// so 2.0 is the only one on purpose: negotiation is there for the next.
+var versions = []Version{
+	{2, 0},
+}
+
+var ErrNoVersion = errors.New("net: no protocol version in common with the peer")
+
+func (v Version) ID() protocol.ID {
+	return protocol.ID(fmt.Sprintf("%s%d.%d.0", ProtocolPrefix, v.Major, v.Minor))
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// Versions returns the versions spoken by this build, newest first.
+func Versions() []Version {
+	return slices.Clone(versions)
+}
+
+// ParseVersions parses a comma-separated list such as "2.0" into supported
+// versions, newest first. An empty list means all of them.
+func ParseVersions(list string) ([]Version, error) {
+	if strings.TrimSpace(list) == "" {
+		return Versions(), nil
+	}
+	var out []Version
+	for _, s := range strings.Split(list, ",") {
+		var v Version
+		if _, err := fmt.Sscanf(strings.TrimSpace(s), "%d.%d", &v.Major, &v.Minor); err != nil {
+			return nil, fmt.Errorf("invalid protocol version %q", s)
+		}
+		if !slices.Contains(versions, v) {
+			return nil, fmt.Errorf("unsupported protocol version %s", v)
+		}
+		if !slices.Contains(out, v) {
+			out = append(out, v)
+		}
+	}
+	slices.SortFunc(out, func(a, b Version) int {
+		if a.Major != b.Major {
+			return b.Major - a.Major
+		}
+		return b.Minor - a.Minor
+	})
+	return out, nil
+}
+
+// VersionOf returns which of vs a stream was opened with.
+func VersionOf(s network.Stream, vs []Version) (Version, bool) {
+	for _, v := range vs {
+		if v.ID() == s.Protocol() {
+			return v, true
+		}
+	}
+	return Version{}, false
+}
+
+// SetStreamHandlers registers handler for each of the given versions, so
+// that peers may open streams with any of them.
+func SetStreamHandlers(h host.Host, vs []Version, handler func(Version, network.Stream)) {
+	for _, v := range vs {
+		h.SetStreamHandler(v.ID(), func(s network.Stream) {
+			handler(v, s)
+		})
+	}
+}
+
+// OpenStream opens a /pqchat stream to p, speaking the highest of the given
+// versions that p supports. It fails with ErrNoVersion if p speaks none.
+func OpenStream(ctx context.Context, h host.Host, p peer.ID, vs []Version) (network.Stream, Version, error) {
+	ids := make([]protocol.ID, 0, len(vs))
+	for _, v := range vs {
+		ids = append(ids, v.ID())
+	}
+	// multistream-select tries the IDs in order
+	s, err := h.NewStream(ctx, p, ids...)
+	if errors.Is(err, msmux.ErrNotSupported[protocol.ID]{}) {
+		return nil, Version{}, fmt.Errorf("%w (offered %v)", ErrNoVersion, vs)
+	}
+	if err != nil {
+		return nil, Version{}, err
+	}
+	v, ok := VersionOf(s, vs)
+	if !ok {
+		_ = s.Reset()
+		return nil, Version{}, fmt.Errorf("peer chose unknown protocol %s", s.Protocol())
+	}
+	return s, v, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package net
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// The versions below need not exist: negotiation only depends on the
+// lists each side registers and offers. The last cases use those of this
+// build.
+func TestOpenStreamVersions(t *testing.T) {
+	var (
+		v1  = Version{1, 0}
+		v20 = Version{2, 0}
+		v21 = Version{2, 1}
+		v3  = Version{3, 0}
+	)
+	tests := []struct {
+		name             string
+		dialer, listener []Version
+		want             Version
+		err              error
+	}{
+		{"same versions", []Version{v21, v20}, []Version{v21, v20}, v21, nil},
+		{"highest in common", []Version{v3, v21, v20, v1}, []Version{v21, v20, v1}, v21, nil},
+		{"listener speaks only an older one", []Version{v21, v20}, []Version{v20}, v20, nil},
+		{"dialer speaks only an older one", []Version{v20}, []Version{v3, v21, v20}, v20, nil},
+		{"gap in the lists", []Version{v3, v20}, []Version{v21, v20, v1}, v20, nil},
+		{"no overlap", []Version{v3}, []Version{v21, v20}, Version{}, ErrNoVersion},
+		{"this build", Versions(), Versions(), versions[0], nil},
+		{"peer speaks only an unknown version", Versions(), []Version{{9, 0}}, Version{}, ErrNoVersion},
+		{"we offer only an unknown version", []Version{{9, 0}}, Versions(), Version{}, ErrNoVersion},
+	}
+
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		mn, err := mocknet.FullMeshConnected(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialer, listener := mn.Hosts()[0], mn.Hosts()[1]
+		served := make(chan Version, 1)
+		SetStreamHandlers(listener, tt.listener, func(v Version, s network.Stream) {
+			served <- v
+			_ = s.Close()
+		})
+
+		s, v, err := OpenStream(ctx, dialer, listener.ID(), tt.dialer)
+		switch {
+		case tt.err != nil:
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		default:
+			// The listener learns the version once we write
+			_, _ = s.Write([]byte{0})
+			if v != tt.want {
+				t.Errorf("%s: dialer got %s, want %s", tt.name, v, tt.want)
+			}
+			select {
+			case got := <-served:
+				if got != tt.want {
+					t.Errorf("%s: listener got %s, want %s", tt.name, got, tt.want)
+				}
+			case <-ctx.Done():
+				t.Errorf("%s: stream never reached the listener", tt.name)
+			}
+			_ = s.Close()
+		}
+		_ = mn.Close()
+		cancel()
+	}
+}
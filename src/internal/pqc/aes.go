@@ -14,14 +14,11 @@
 package pqc
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"errors"
-	"io"
-
-	"golang.org/x/crypto/hkdf"
 )
 
 const (
@@ -32,21 +29,20 @@ const (
 // AESGCM wraps a cipher.AEAD for easier use.
 type AESGCM struct {
 	aead cipher.AEAD
-	key  []byte // Store the raw key for debug access
+	raw  *Secret // copy of the key, only kept in debug builds
 }
 
-// DeriveKey derives a 256-bit AES key from a ML-KEM shared secret
-// using HKDF-SHA256. contextInfo can be "pqchat-session", peer IDs, etc.
-func DeriveKey(sharedSecret []byte, contextInfo []byte) ([]byte, error) {
-	if len(sharedSecret) == 0 {
-		return nil, errors.New("pqc: empty shared secret")
-	}
-	h := hkdf.New(sha256.New, sharedSecret, nil, contextInfo)
-	key := make([]byte, AESKeySize)
-	if _, err := io.ReadFull(h, key); err != nil {
-		return nil, err
-	}
-	return key, nil
+// CombineSecrets merges the ML-KEM and X25519 shared secrets of the hybrid
+// key exchange. As in TLS X25519MLKEM768, they are simply concatenated
+// (ML-KEM first) before HKDF, so the derived keys stay safe as long as one
+// of the two exchanges is unbroken. Both inputs are wiped.
+func CombineSecrets(mlkemSecret, x25519Secret []byte) []byte {
+	combined := make([]byte, 0, len(mlkemSecret)+len(x25519Secret))
+	combined = append(combined, mlkemSecret...)
+	combined = append(combined, x25519Secret...)
+	wipe(mlkemSecret)
+	wipe(x25519Secret)
+	return combined
 }
 
 // NewAESGCM creates an AES-GCM instance from a raw key.
@@ -62,10 +58,11 @@ func NewAESGCM(key []byte) (*AESGCM, error) {
 	if err != nil {
 		return nil, err
 	}
-	// Store a copy of the key for debug access
-	keyCopy := make([]byte, len(key))
-	copy(keyCopy, key)
-	return &AESGCM{aead: aead, key: keyCopy}, nil
+	a := &AESGCM{aead: aead}
+	if keepRawKey {
+		a.raw = NewSecret(bytes.Clone(key))
+	}
+	return a, nil
 }
 
 // Encrypt encrypts plaintext and returns nonce || ciphertext.
@@ -81,6 +78,17 @@ func (a *AESGCM) Encrypt(plaintext []byte) ([]byte, error) {
 	return out, nil
 }
 
+// Seal encrypts plaintext with an explicit nonce, which the caller must
+// never reuse under the same key.
+func (a *AESGCM) Seal(nonce, plaintext, ad []byte) []byte {
+	return a.aead.Seal(nil, nonce, plaintext, ad)
+}
+
+// Open decrypts a ciphertext produced by Seal.
+func (a *AESGCM) Open(nonce, ciphertext, ad []byte) ([]byte, error) {
+	return a.aead.Open(nil, nonce, ciphertext, ad)
+}
+
 // Decrypt expects nonce || ciphertext.
 func (a *AESGCM) Decrypt(data []byte) ([]byte, error) {
 	if len(data) < AESNonceSize {
@@ -91,12 +99,9 @@ func (a *AESGCM) Decrypt(data []byte) ([]byte, error) {
 	return a.aead.Open(nil, nonce, ct, nil)
 }
 
-// RawKey returns a copy of the raw AES key (for debugging purposes).
-func (a *AESGCM) RawKey() []byte {
-	if a.key == nil {
-		return nil
-	}
-	keyCopy := make([]byte, len(a.key))
-	copy(keyCopy, a.key)
-	return keyCopy
+// Close drops the cipher and wipes the debug key copy. The instance must
+// not be used afterwards.
+func (a *AESGCM) Close() {
+	a.raw.Close()
+	a.aead = nil
 }
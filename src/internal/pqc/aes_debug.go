@@ -0,0 +1,29 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+
+//go:build debug
+
+package pqc
+
+import (
+	"bytes"
+)
+
+// Only debug builds (go build -tags debug) keep raw keys around.
+const keepRawKey = true
+
+// RawKey returns a copy of the raw AES key (for debugging purposes).
+func (a *AESGCM) RawKey() []byte {
+	return bytes.Clone(a.raw.Bytes())
+}
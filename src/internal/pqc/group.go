@@ -0,0 +1,119 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package pqc
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// Group keys encrypt room messages for every member at once. A new one is
+// drawn at each membership change and sent to each member encapsulated to
+// its ML-KEM key; context binds keys and messages to a room and epoch.
+
+// GroupKeySize is the size of a room's group key.
+const GroupKeySize = 32
+
+var ErrGroupKey = errors.New("pqc: cannot open group key")
+
+// NewGroupKey draws a random group key.
+func NewGroupKey() ([]byte, error) {
+	k := make([]byte, GroupKeySize)
+	if _, err := rand.Read(k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// WrapGroupKey encapsulates to a member's kemAlg public key and encrypts
+// groupKey under the shared secret.
+func WrapGroupKey(kemAlg string, kemPub, groupKey, context []byte) (ct, wrapped []byte, err error) {
+	ct, ss, err := EncapsulateWith(kemAlg, kemPub)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(ss)
+
+	a, nonce, err := contextCipher(ss, context, "pqchat-room-welcome-v1")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer a.Close()
+	return ct, a.Seal(nonce, groupKey, context), nil
+}
+
+// UnwrapGroupKey opens a group key wrapped to the key pair held by k.
+func UnwrapGroupKey(k *KEM, ct, wrapped, context []byte) ([]byte, error) {
+	ss, err := k.Decapsulate(ct)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(ss)
+
+	a, nonce, err := contextCipher(ss, context, "pqchat-room-welcome-v1")
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	key, err := a.Open(nonce, wrapped, context)
+	if err != nil || len(key) != GroupKeySize {
+		return nil, ErrGroupKey
+	}
+	return key, nil
+}
+
+// SealGroupMessage encrypts a room message under the group key. Messages
+// share the key, so each one gets a random nonce.
+func SealGroupMessage(groupKey, plaintext, context []byte) (nonce, ct []byte, err error) {
+	a, _, err := contextCipher(groupKey, context, "pqchat-room-msg-v1")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer a.Close()
+
+	nonce = make([]byte, AESNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, a.Seal(nonce, plaintext, context), nil
+}
+
+// OpenGroupMessage decrypts a message produced by SealGroupMessage.
+func OpenGroupMessage(groupKey, nonce, ct, context []byte) ([]byte, error) {
+	if len(nonce) != AESNonceSize {
+		return nil, errors.New("pqc: bad nonce size")
+	}
+	a, _, err := contextCipher(groupKey, context, "pqchat-room-msg-v1")
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	return a.Open(nonce, ct, context)
+}
+
+// contextCipher expands secret into an AES-256-GCM key, and a nonce for
+// single-use keys.
+func contextCipher(secret, context []byte, info string) (*AESGCM, []byte, error) {
+	out, err := expand(secret, context, info, AESKeySize+AESNonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(out[:AESKeySize])
+
+	a, err := NewAESGCM(out[:AESKeySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	return a, out[AESKeySize:], nil
+}
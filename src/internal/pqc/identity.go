@@ -0,0 +1,315 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package pqc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrNoPrivKey = errors.New("pqc: identity has no private key")
+)
+
+// Identity is the long-term post-quantum signing identity of a user.
+type Identity struct {
+	Pseudo string
+	UserID string // hex(SHA256(pub || pseudo))
+	Alg    string // signature algorithm, SigAlgorithm unless chosen otherwise
+	Pub    []byte
+	priv   []byte
+	sealed bool
+}
+
+// ComputeUserID returns hex(SHA256(pub || pseudo)).
+func ComputeUserID(pub []byte, pseudo string) string {
+	h := sha256.New()
+	h.Write(pub)
+	h.Write([]byte(pseudo))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Fingerprint returns a digest of a public key for users to compare out of
+// band: the first 20 bytes of SHA256(pub), in groups of 4 hex digits.
+func Fingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	digits := strings.ToUpper(hex.EncodeToString(sum[:20]))
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// NewIdentity generates a fresh keypair for the given pseudo. An empty alg
+// means SigAlgorithm.
+func NewIdentity(pseudo, alg string) (*Identity, error) {
+	if alg == "" {
+		alg = SigAlgorithm
+	}
+	pub, priv, err := SigKeygenWith(alg)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		Pseudo: pseudo,
+		UserID: ComputeUserID(pub, pseudo),
+		Alg:    alg,
+		Pub:    pub,
+		priv:   priv,
+	}, nil
+}
+
+// LoadIdentity reads an alg identity keypair from privPath and pubPath.
+// An empty alg means SigAlgorithm. Encrypted private key files are opened
+// with the passphrase returned by pass; legacy plaintext files are loaded
+// as is (see Sealed).
+func LoadIdentity(pseudo, alg, privPath, pubPath string, pass PassphraseFunc) (*Identity, error) {
+	if alg == "" {
+		alg = SigAlgorithm
+	}
+	data, err := os.ReadFile(privPath)
+	if err != nil {
+		return nil, fmt.Errorf("read priv key: %w", err)
+	}
+	pub, err := os.ReadFile(pubPath)
+	if err != nil {
+		return nil, fmt.Errorf("read pub key: %w", err)
+	}
+	priv := data
+	sealed := IsSealedKey(data)
+	if sealed {
+		passphrase, err := pass(false)
+		if err != nil {
+			return nil, fmt.Errorf("passphrase: %w", err)
+		}
+		defer wipe(passphrase)
+		if priv, err = OpenPrivKey(data, passphrase); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkSigKeys(alg, pub, priv); err != nil {
+		if sealed {
+			wipe(priv)
+		}
+		return nil, err
+	}
+
+	return &Identity{
+		Pseudo: pseudo,
+		UserID: ComputeUserID(pub, pseudo),
+		Alg:    alg,
+		Pub:    pub,
+		priv:   priv,
+		sealed: sealed,
+	}, nil
+}
+
+// LoadOrCreateIdentity loads the alg identity stored at privPath/pubPath.
+// If neither file exists, a new alg keypair is generated and saved there,
+// encrypted under the passphrase returned by pass; created is then true
+// so the caller can warn the user.
+func LoadOrCreateIdentity(pseudo, alg, privPath, pubPath string, pass PassphraseFunc) (id *Identity, created bool, err error) {
+	_, errPriv := os.Stat(privPath)
+	_, errPub := os.Stat(pubPath)
+
+	switch {
+	case errPriv == nil && errPub == nil:
+		id, err = LoadIdentity(pseudo, alg, privPath, pubPath, pass)
+		return id, false, err
+	case os.IsNotExist(errPriv) && os.IsNotExist(errPub):
+		// Nothing on disk yet, generate below
+	case errPriv != nil && !os.IsNotExist(errPriv):
+		return nil, false, fmt.Errorf("stat priv key: %w", errPriv)
+	case errPub != nil && !os.IsNotExist(errPub):
+		return nil, false, fmt.Errorf("stat pub key: %w", errPub)
+	default:
+		return nil, false, errors.New("pqc: only one of the identity key files exists")
+	}
+
+	passphrase, err := pass(true)
+	if err != nil {
+		return nil, false, fmt.Errorf("passphrase: %w", err)
+	}
+	defer wipe(passphrase)
+
+	id, err = NewIdentity(pseudo, alg)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := id.Save(privPath, pubPath, passphrase); err != nil {
+		return nil, false, err
+	}
+	return id, true, nil
+}
+
+// ChangePassphrase re-encrypts the private key file at privPath. A legacy
+// plaintext file is encrypted for the first time and oldPass is not called.
+func ChangePassphrase(privPath string, oldPass, newPass PassphraseFunc) error {
+	data, err := os.ReadFile(privPath)
+	if err != nil {
+		return fmt.Errorf("read priv key: %w", err)
+	}
+
+	priv := data
+	if IsSealedKey(data) {
+		oldPassphrase, err := oldPass(false)
+		if err != nil {
+			return fmt.Errorf("old passphrase: %w", err)
+		}
+		defer wipe(oldPassphrase)
+		if priv, err = OpenPrivKey(data, oldPassphrase); err != nil {
+			return err
+		}
+	}
+	defer wipe(priv)
+
+	newPassphrase, err := newPass(true)
+	if err != nil {
+		return fmt.Errorf("new passphrase: %w", err)
+	}
+	defer wipe(newPassphrase)
+
+	sealed, err := SealPrivKey(priv, newPassphrase)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(privPath, sealed, 0o600)
+}
+
+// Save writes the keypair to disk, the private key being encrypted under
+// passphrase. The private key file is only readable by its owner.
+func (id *Identity) Save(privPath, pubPath string, passphrase []byte) error {
+	if id.priv == nil {
+		return ErrNoPrivKey
+	}
+	sealed, err := SealPrivKey(id.priv, passphrase)
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{privPath, pubPath} {
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			return fmt.Errorf("create key dir: %w", err)
+		}
+	}
+	if err := WriteFileAtomic(privPath, sealed, 0o600); err != nil {
+		return fmt.Errorf("write priv key: %w", err)
+	}
+	if err := WriteFileAtomic(pubPath, id.Pub, 0o644); err != nil {
+		return fmt.Errorf("write pub key: %w", err)
+	}
+	id.sealed = true
+	return nil
+}
+
+// Sealed reports whether the private key was loaded from (or saved to) an
+// encrypted key file. It is false for ephemeral and legacy plaintext keys.
+func (id *Identity) Sealed() bool {
+	return id.sealed
+}
+
+// Fingerprint returns the fingerprint of the identity's public key.
+func (id *Identity) Fingerprint() string {
+	return Fingerprint(id.Pub)
+}
+
+// Renamed returns the identity under another pseudo, hence another user
+// ID. It holds its own copy of the private key, so each must be closed.
+func (id *Identity) Renamed(pseudo string) *Identity {
+	r := *id
+	r.priv = bytes.Clone(id.priv)
+	r.Pseudo = pseudo
+	r.UserID = ComputeUserID(id.Pub, pseudo)
+	return &r
+}
+
+// Sign signs message with the identity's private key.
+func (id *Identity) Sign(message []byte) ([]byte, error) {
+	if id.priv == nil {
+		return nil, ErrNoPrivKey
+	}
+	return SignWith(id.Alg, message, id.priv)
+}
+
+// SealData encrypts local state tied to the identity, such as prekeys,
+// under a key derived from the private key. info separates the uses.
+func (id *Identity) SealData(info string, data []byte) ([]byte, error) {
+	a, err := id.dataCipher(info)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	return a.Encrypt(data)
+}
+
+// OpenData decrypts what SealData returned for the same info.
+func (id *Identity) OpenData(info string, sealed []byte) ([]byte, error) {
+	a, err := id.dataCipher(info)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	return a.Decrypt(sealed)
+}
+
+func (id *Identity) dataCipher(info string) (*AESGCM, error) {
+	if id.priv == nil {
+		return nil, ErrNoPrivKey
+	}
+	key, err := expand(id.priv, nil, info, AESKeySize)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	return NewAESGCM(key)
+}
+
+// Close wipes the private key; the identity can no longer sign.
+func (id *Identity) Close() {
+	wipe(id.priv)
+	id.priv = nil
+}
+
+// WriteFileAtomic writes data to a temporary file next to path and renames
+// it, so an interrupted write never leaves a truncated key behind.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
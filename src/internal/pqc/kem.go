@@ -14,6 +14,8 @@
 package pqc
 
 import (
+	"bytes"
+
 	"github.com/open-quantum-safe/liboqs-go/oqs"
 )
 
@@ -25,26 +27,44 @@ type KEM struct {
 }
 
 func NewKEM() (*KEM, error) {
+	return NewKEMWith(DefaultKEM)
+}
+
+// NewKEMWith creates a KEM instance for the given liboqs algorithm name.
+func NewKEMWith(alg string) (*KEM, error) {
 	kem := &oqs.KeyEncapsulation{}
-	if err := kem.Init(DefaultKEM, nil); err != nil {
+	if err := kem.Init(alg, nil); err != nil {
 		return nil, err
 	}
 	return &KEM{obj: kem}, nil
 }
 
-// Generate and keep the SAME KEM object for keygen
-func (k *KEM) Keygen() (pub, priv []byte, err error) {
-	pub, err = k.obj.GenerateKeyPair()
-	if err != nil {
-		return nil, nil, err
+// NewKEMFromSecret restores a KEM instance from a secret key saved with
+// ExportSecret, e.g. a prekey that must outlive the process. The object
+// keeps its own copy of secret.
+func NewKEMFromSecret(alg string, secret []byte) (*KEM, error) {
+	kem := &oqs.KeyEncapsulation{}
+	if err := kem.Init(alg, bytes.Clone(secret)); err != nil {
+		return nil, err
 	}
-	priv = k.obj.ExportSecretKey()
-	return pub, priv, nil
+	return &KEM{obj: kem}, nil
+}
+
+// Generate and keep the SAME KEM object for keygen. The secret key never
+// leaves the object, it is wiped by Clean.
+func (k *KEM) Keygen() (pub []byte, err error) {
+	return k.obj.GenerateKeyPair()
 }
 
-// Encapsulate: stateless, ok to use new object
+// Encapsulate: stateless, ok to use new object. The caller wipes ss once
+// keys are derived from it.
 func Encapsulate(peerPub []byte) (ct, ss []byte, err error) {
-	k, err := NewKEM()
+	return EncapsulateWith(DefaultKEM, peerPub)
+}
+
+// EncapsulateWith encapsulates to a public key of the given algorithm.
+func EncapsulateWith(alg string, peerPub []byte) (ct, ss []byte, err error) {
+	k, err := NewKEMWith(alg)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -54,14 +74,23 @@ func Encapsulate(peerPub []byte) (ct, ss []byte, err error) {
 	return k.obj.EncapSecret(peerPub)
 }
 
-// Decapsulate MUST use the SAME k.obj that created the priv
+// Decapsulate MUST use the SAME k.obj that created the priv. The caller
+// wipes the shared secret once keys are derived from it.
 func (k *KEM) Decapsulate(ct []byte) ([]byte, error) {
 	return k.obj.DecapSecret(ct)
 }
 
-// Clean cleans up the KEM object
+// ExportSecret returns a copy of the secret key, to be stored encrypted.
+// The caller wipes it once saved.
+func (k *KEM) ExportSecret() []byte {
+	return bytes.Clone(k.obj.ExportSecretKey())
+}
+
+// Clean wipes the secret key and frees the KEM object. It may be called
+// more than once.
 func (k *KEM) Clean() {
 	if k.obj != nil {
 		k.obj.Clean()
+		k.obj = nil
 	}
 }
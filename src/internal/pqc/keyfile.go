@@ -0,0 +1,155 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package pqc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Encrypted key file layout (all integers big endian):
+//
+//	magic   "PQCK"  4 bytes
+//	version         1 byte
+//	kdf             1 byte  (1 = Argon2id)
+//	time            4 bytes
+//	memory (KiB)    4 bytes
+//	threads         1 byte
+//	salt           16 bytes
+//	nonce          12 bytes
+//	AES-256-GCM(secret key), with the header above as additional data
+const (
+	KeyFileVersion = 1
+
+	kdfArgon2id = 1
+
+	keyFileSaltSize   = 16
+	keyFileHeaderSize = 4 + 1 + 1 + 4 + 4 + 1 + keyFileSaltSize + AESNonceSize
+)
+
+var keyFileMagic = []byte("PQCK")
+
+// Default Argon2id cost, as recommended by RFC 9106 for memory-constrained use.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+
+	// Refuse to open files asking for more than 4 GiB of KDF memory, 32
+	// passes or 64 lanes: the header is read before the passphrase is
+	// checked, a crafted file must not keep us busy for hours.
+	argon2MaxMemory  = 4 * 1024 * 1024
+	argon2MaxTime    = 32
+	argon2MaxThreads = 64
+)
+
+var (
+	ErrEmptyPassphrase = errors.New("pqc: empty passphrase")
+	ErrBadPassphrase   = errors.New("pqc: wrong passphrase or corrupted key file")
+	ErrKeyFileFormat   = errors.New("pqc: invalid key file")
+	ErrKeyFileVersion  = errors.New("pqc: unsupported key file version")
+)
+
+// PassphraseFunc returns the passphrase protecting a key file.
+// confirm is true when a new key file is about to be written, so
+// interactive implementations can ask twice.
+type PassphraseFunc func(confirm bool) ([]byte, error)
+
+// IsSealedKey reports whether data looks like an encrypted key file.
+func IsSealedKey(data []byte) bool {
+	return len(data) >= len(keyFileMagic) && bytes.Equal(data[:len(keyFileMagic)], keyFileMagic)
+}
+
+// SealPrivKey encrypts a secret key under a passphrase.
+func SealPrivKey(priv, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrEmptyPassphrase
+	}
+
+	hdr := make([]byte, 0, keyFileHeaderSize)
+	hdr = append(hdr, keyFileMagic...)
+	hdr = append(hdr, KeyFileVersion, kdfArgon2id)
+	hdr = binary.BigEndian.AppendUint32(hdr, argon2Time)
+	hdr = binary.BigEndian.AppendUint32(hdr, argon2Memory)
+	hdr = append(hdr, argon2Threads)
+
+	salt := make([]byte, keyFileSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, AESNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	hdr = append(hdr, salt...)
+	hdr = append(hdr, nonce...)
+
+	aead, err := keyFileAEAD(passphrase, salt, argon2Time, argon2Memory, argon2Threads)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(hdr, nonce, priv, hdr), nil
+}
+
+// OpenPrivKey decrypts a key file produced by SealPrivKey.
+func OpenPrivKey(data, passphrase []byte) ([]byte, error) {
+	if !IsSealedKey(data) || len(data) < keyFileHeaderSize {
+		return nil, ErrKeyFileFormat
+	}
+	hdr := data[:keyFileHeaderSize]
+	if hdr[4] != KeyFileVersion {
+		return nil, ErrKeyFileVersion
+	}
+	if hdr[5] != kdfArgon2id {
+		return nil, ErrKeyFileFormat
+	}
+	t := binary.BigEndian.Uint32(hdr[6:10])
+	m := binary.BigEndian.Uint32(hdr[10:14])
+	p := hdr[14]
+	salt := hdr[15 : 15+keyFileSaltSize]
+	nonce := hdr[15+keyFileSaltSize:]
+
+	aead, err := keyFileAEAD(passphrase, salt, t, m, p)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := aead.Open(nil, nonce, data[keyFileHeaderSize:], hdr)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+	return priv, nil
+}
+
+func keyFileAEAD(passphrase, salt []byte, t, m uint32, p uint8) (cipher.AEAD, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrEmptyPassphrase
+	}
+	if t == 0 || t > argon2MaxTime || m == 0 || m > argon2MaxMemory || p == 0 || p > argon2MaxThreads {
+		return nil, ErrKeyFileFormat
+	}
+	key := argon2.IDKey(passphrase, salt, t, m, p, AESKeySize)
+	defer wipe(key)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
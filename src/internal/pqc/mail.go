@@ -0,0 +1,88 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package pqc
+
+import "errors"
+
+// Mail is sent to users who are offline, in the spirit of PQXDH: it is
+// encapsulated to the signed medium-term prekey they published and, when
+// one is left, to a one-time prekey that is deleted once used. The shared
+// secrets are concatenated, as in CombineSecrets, and expanded into the
+// key of the mail; without the one-time prekey, mail stays readable by
+// whoever steals the signed prekey before it is replaced. Each mail has
+// its own key and nonce; context binds them to the recipient and prekeys.
+
+var ErrMail = errors.New("pqc: cannot open mail")
+
+// MailKey is a prekey a mail is encapsulated to.
+type MailKey struct {
+	Alg string
+	Pub []byte
+}
+
+// SealMail encapsulates to each prekey, in order, and encrypts plaintext
+// under the combined shared secrets. It returns one KEM ciphertext per
+// prekey.
+func SealMail(keys []MailKey, plaintext, context []byte) (cts [][]byte, sealed []byte, err error) {
+	if len(keys) == 0 {
+		return nil, nil, ErrMail
+	}
+	secret := make([]byte, 0, 32*len(keys)) // 32-byte ML-KEM secrets: append never copies them
+	defer func() { wipe(secret) }()
+	for _, k := range keys {
+		ct, ss, err := EncapsulateWith(k.Alg, k.Pub)
+		if err != nil {
+			return nil, nil, err
+		}
+		cts = append(cts, ct)
+		secret = append(secret, ss...)
+		wipe(ss)
+	}
+
+	a, nonce, err := contextCipher(secret, context, "pqchat-mail-v1")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer a.Close()
+	return cts, a.Seal(nonce, plaintext, context), nil
+}
+
+// OpenMail decrypts a mail sealed to the prekeys held by ks, given in the
+// order they were sealed to.
+func OpenMail(ks []*KEM, cts [][]byte, sealed, context []byte) ([]byte, error) {
+	if len(ks) == 0 || len(ks) != len(cts) {
+		return nil, ErrMail
+	}
+	secret := make([]byte, 0, 32*len(ks))
+	defer func() { wipe(secret) }()
+	for i, k := range ks {
+		ss, err := k.Decapsulate(cts[i])
+		if err != nil {
+			return nil, err
+		}
+		secret = append(secret, ss...)
+		wipe(ss)
+	}
+
+	a, nonce, err := contextCipher(secret, context, "pqchat-mail-v1")
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	plaintext, err := a.Open(nonce, sealed, context)
+	if err != nil {
+		return nil, ErrMail
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package pqc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Key derivation functions of the session double ratchet, following the
+// Signal specification with ML-KEM shared secrets in place of DH outputs.
+
+// RatchetKeySize is the size of root, chain and message keys.
+const RatchetKeySize = 32
+
+// DeriveRatchetKeys derives the initial root key and the client→server and
+// server→client chain keys from the handshake secret. The transcript (which
+// covers both peer IDs) is used as salt, so the keys are bound to the session.
+func DeriveRatchetKeys(sharedSecret, transcript []byte) (root, c2s, s2c []byte, err error) {
+	if len(sharedSecret) == 0 {
+		return nil, nil, nil, errors.New("pqc: empty shared secret")
+	}
+	out, err := expand(sharedSecret, transcript, "pqchat-session-v2", 3*RatchetKeySize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return out[:RatchetKeySize], out[RatchetKeySize : 2*RatchetKeySize], out[2*RatchetKeySize:], nil
+}
+
+// RootKDF mixes the shared secret of a KEM ratchet step into the root key,
+// returning the next root key and the chain key of the new sending chain.
+func RootKDF(rootKey, sharedSecret []byte) (nextRoot, chainKey []byte, err error) {
+	out, err := expand(sharedSecret, rootKey, "pqchat-ratchet-v1", 2*RatchetKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out[:RatchetKeySize], out[RatchetKeySize:], nil
+}
+
+// ChainKDF advances a symmetric chain by one message. The chain key cannot
+// be recomputed from the next one, so callers should wipe it.
+func ChainKDF(chainKey []byte) (nextChain, messageKey []byte) {
+	m := hmac.New(sha256.New, chainKey)
+	m.Write([]byte{0x01})
+	messageKey = m.Sum(nil)
+
+	m = hmac.New(sha256.New, chainKey)
+	m.Write([]byte{0x02})
+	return m.Sum(nil), messageKey
+}
+
+// SealMessage encrypts one message under its single-use message key.
+func SealMessage(messageKey, plaintext, ad []byte) ([]byte, error) {
+	a, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	return a.Seal(nonce, plaintext, ad), nil
+}
+
+// OpenMessage decrypts a message produced by SealMessage.
+func OpenMessage(messageKey, ciphertext, ad []byte) ([]byte, error) {
+	a, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	return a.Open(nonce, ciphertext, ad)
+}
+
+// messageCipher expands a message key into an AES-256-GCM key and nonce.
+// Each message key is used once, so the nonce needs no counter.
+func messageCipher(messageKey []byte) (*AESGCM, []byte, error) {
+	out, err := expand(messageKey, nil, "pqchat-message-v1", AESKeySize+AESNonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(out[:AESKeySize])
+
+	a, err := NewAESGCM(out[:AESKeySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	return a, out[AESKeySize:], nil
+}
+
+func expand(secret, salt []byte, info string, n int) ([]byte, error) {
+	out := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package pqc
+
+// Secret holds key material and wipes it on Close. Go may still have copied
+// it around (stack growth, GC), so this is best effort, but it keeps keys
+// from outliving their use in our own buffers.
+type Secret struct {
+	b []byte
+}
+
+// NewSecret takes ownership of b, which callers must not keep using.
+func NewSecret(b []byte) *Secret {
+	return &Secret{b: b}
+}
+
+// Bytes returns the key material, nil once closed. The slice is not a copy.
+func (s *Secret) Bytes() []byte {
+	if s == nil {
+		return nil
+	}
+	return s.b
+}
+
+// Close wipes the key material. It may be called more than once.
+func (s *Secret) Close() {
+	if s == nil {
+		return
+	}
+	wipe(s.b)
+	s.b = nil
+}
+
+// Wipe zeroes secret material in place.
+func Wipe(b []byte) {
+	wipe(b)
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
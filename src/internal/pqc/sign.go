@@ -14,25 +14,31 @@
 package pqc
 
 import (
+	"bytes"
 	"errors"
 
 	"github.com/open-quantum-safe/liboqs-go/oqs"
 )
 
 var (
-	ErrSigInit = errors.New("pqc: ML-DSA init failed")
-	ErrSigGen  = errors.New("pqc: ML-DSA keygen failed")
-	ErrSign    = errors.New("pqc: ML-DSA sign failed")
-	ErrVerify  = errors.New("pqc: ML-DSA verify failed")
+	ErrSigInit = errors.New("pqc: signature init failed")
+	ErrSigGen  = errors.New("pqc: signature keygen failed")
+	ErrSign    = errors.New("pqc: sign failed")
+	ErrVerify  = errors.New("pqc: verify failed")
 )
 
-// ML-DSA-65 (Dilithium-3)
+// ML-DSA-65 (Dilithium-3), the default identity algorithm
 const SigAlgorithm = "ML-DSA-65"
 
 // Generate signing keypair (public-key identity + private signing key).
 func SigKeygen() (pub []byte, priv []byte, err error) {
+	return SigKeygenWith(SigAlgorithm)
+}
+
+// SigKeygenWith generates a keypair for the given signature algorithm.
+func SigKeygenWith(alg string) (pub []byte, priv []byte, err error) {
 	sig := oqs.Signature{}
-	if err := sig.Init(SigAlgorithm, nil); err != nil {
+	if err := sig.Init(alg, nil); err != nil {
 		return nil, nil, ErrSigInit
 	}
 	defer sig.Clean()
@@ -42,15 +48,22 @@ func SigKeygen() (pub []byte, priv []byte, err error) {
 		return nil, nil, ErrSigGen
 	}
 
-	priv = sig.ExportSecretKey()
+	// Clean() wipes the exported slice, hand out a copy
+	priv = bytes.Clone(sig.ExportSecretKey())
 	return pub, priv, nil
 }
 
 // Sign returns a signature over the given message using the private key.
 func Sign(message []byte, priv []byte) (sigBytes []byte, err error) {
+	return SignWith(SigAlgorithm, message, priv)
+}
+
+// SignWith signs message with a private key of the given algorithm.
+func SignWith(alg string, message []byte, priv []byte) (sigBytes []byte, err error) {
 	sig := oqs.Signature{}
 
-	if err := sig.Init(SigAlgorithm, priv); err != nil {
+	// Init keeps the slice and Clean() wipes it, so give it a copy
+	if err := sig.Init(alg, bytes.Clone(priv)); err != nil {
 		return nil, ErrSign
 	}
 	defer sig.Clean()
@@ -64,8 +77,13 @@ func Sign(message []byte, priv []byte) (sigBytes []byte, err error) {
 
 // Verify checks if a signature is valid for (message, publicKey).
 func Verify(message, signature, pub []byte) (bool, error) {
+	return VerifyWith(SigAlgorithm, message, signature, pub)
+}
+
+// VerifyWith checks a signature made with the given algorithm.
+func VerifyWith(alg string, message, signature, pub []byte) (bool, error) {
 	sig := oqs.Signature{}
-	if err := sig.Init(SigAlgorithm, nil); err != nil {
+	if err := sig.Init(alg, nil); err != nil {
 		return false, ErrSigInit
 	}
 	defer sig.Clean()
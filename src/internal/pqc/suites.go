@@ -0,0 +1,117 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package pqc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/open-quantum-safe/liboqs-go/oqs"
+)
+
+// KEM algorithms pqchat can negotiate (liboqs names).
+var KEMAlgorithms = []string{
+	"ML-KEM-512",
+	"ML-KEM-768",
+	"ML-KEM-1024",
+}
+
+// Signature algorithms pqchat identities can use (liboqs names). Only the
+// ones enabled in the local liboqs build are actually usable.
+var SigAlgorithms = []string{
+	"ML-DSA-44",
+	"ML-DSA-65",
+	"ML-DSA-87",
+	"Falcon-512",
+	"Falcon-1024",
+	"SLH_DSA_PURE_SHA2_128S",
+	"SLH_DSA_PURE_SHA2_192S",
+	"SLH_DSA_PURE_SHA2_256S",
+}
+
+var (
+	ErrUnknownAlg = errors.New("pqc: unknown or disabled algorithm")
+	ErrKeyAlg     = errors.New("pqc: key files do not match the signature algorithm")
+)
+
+// KEMLevel returns the NIST security level claimed by liboqs for alg.
+func KEMLevel(alg string) (int, error) {
+	if !oqs.IsKEMEnabled(alg) {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownAlg, alg)
+	}
+	kem := oqs.KeyEncapsulation{}
+	if err := kem.Init(alg, nil); err != nil {
+		return 0, err
+	}
+	defer kem.Clean()
+	return kem.Details().ClaimedNISTLevel, nil
+}
+
+// SigLevel returns the NIST security level claimed by liboqs for alg.
+func SigLevel(alg string) (int, error) {
+	d, err := sigDetails(alg)
+	if err != nil {
+		return 0, err
+	}
+	return d.ClaimedNISTLevel, nil
+}
+
+// checkSigKeys checks that pub and priv have the sizes of alg keys. Key
+// sizes do not tell the algorithm, it must be declared.
+func checkSigKeys(alg string, pub, priv []byte) error {
+	d, err := sigDetails(alg)
+	if err != nil {
+		return err
+	}
+	if len(pub) != d.LengthPublicKey || len(priv) != d.LengthSecretKey {
+		return fmt.Errorf("%w: not %s keys", ErrKeyAlg, alg)
+	}
+	return nil
+}
+
+func sigDetails(alg string) (oqs.SignatureDetails, error) {
+	if !oqs.IsSigEnabled(alg) {
+		return oqs.SignatureDetails{}, fmt.Errorf("%w: %s", ErrUnknownAlg, alg)
+	}
+	sig := oqs.Signature{}
+	if err := sig.Init(alg, nil); err != nil {
+		return oqs.SignatureDetails{}, err
+	}
+	defer sig.Clean()
+	return sig.Details(), nil
+}
+
+// MaxSigSizes returns the largest public key and signature of the usable
+// signature algorithms.
+func MaxSigSizes() (pub, sig int) {
+	for _, alg := range SigAlgorithms {
+		if d, err := sigDetails(alg); err == nil {
+			pub, sig = max(pub, d.LengthPublicKey), max(sig, d.MaxLengthSignature)
+		}
+	}
+	return pub, sig
+}
+
+// KEMPublicKeySize returns the size of alg public keys.
+func KEMPublicKeySize(alg string) (int, error) {
+	if !oqs.IsKEMEnabled(alg) {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownAlg, alg)
+	}
+	kem := oqs.KeyEncapsulation{}
+	if err := kem.Init(alg, nil); err != nil {
+		return 0, err
+	}
+	defer kem.Clean()
+	return kem.Details().LengthPublicKey, nil
+}
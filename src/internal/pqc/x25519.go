@@ -0,0 +1,47 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package pqc
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+)
+
+// X25519 holds an ephemeral classical key, used alongside ML-KEM in the
+// hybrid key exchange so that a break of either one alone is not enough.
+type X25519 struct {
+	priv *ecdh.PrivateKey
+}
+
+func NewX25519() (*X25519, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &X25519{priv: priv}, nil
+}
+
+// Pub returns the 32-byte public key to send to the peer.
+func (x *X25519) Pub() []byte {
+	return x.priv.PublicKey().Bytes()
+}
+
+// SharedSecret computes the X25519 shared secret with the peer's public key.
+func (x *X25519) SharedSecret(peerPub []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, err
+	}
+	return x.priv.ECDH(pub)
+}
@@ -0,0 +1,85 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package protocol
+
+import (
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"pqchat/src/internal/pqc"
+)
+
+var (
+	ErrChatType      = errors.New("protocol: not a CHAT message")
+	ErrChatEncoding  = errors.New("protocol: malformed CHAT")
+	ErrChatSignature = errors.New("protocol: invalid CHAT signature")
+)
+
+// BuildChat returns a CHAT message from id to the given user IDs (empty
+// means broadcast), signed with the identity's ML-DSA key. The public key
+// is only embedded when withPub is set, peers normally have it from HELLO.
+func BuildChat(id *pqc.Identity, to []string, body string, withPub bool) (*ChatMessage, []byte, error) {
+	msg := &ChatMessage{
+		Type:      "CHAT",
+		From:      id.UserID,
+		To:        to,
+		Body:      body,
+		Timestamp: time.Now().Unix(),
+	}
+	if withPub {
+		msg.Pub = base64.StdEncoding.EncodeToString(id.Pub)
+	}
+
+	raw, err := SigningBytes(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sig, err := id.Sign(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg.Sig = base64.StdEncoding.EncodeToString(sig)
+	final, err := Marshal(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return msg, final, nil
+}
+
+// VerifyChat checks the signature of msg against pub, the alg public key
+// of msg.From as known from a verified HELLO.
+func VerifyChat(msg *ChatMessage, alg string, pub []byte) error {
+	if msg.Type != "CHAT" {
+		return ErrChatType
+	}
+	sig, err := base64.StdEncoding.DecodeString(msg.Sig)
+	if err != nil || len(sig) == 0 {
+		return ErrChatEncoding
+	}
+
+	raw, err := SigningBytes(msg)
+	if err != nil {
+		return err
+	}
+
+	ok, err := pqc.VerifyWith(alg, raw, sig, pub)
+	if err != nil || !ok {
+		return ErrChatSignature
+	}
+	return nil
+}
@@ -14,19 +14,38 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/base64"
+	"errors"
+
 	"pqchat/src/internal/pqc"
 )
 
-func BuildHello(id *pqc.Identity) (*HelloMessage, []byte, error) {
+var (
+	ErrHelloType          = errors.New("protocol: not a HELLO message")
+	ErrHelloEncoding      = errors.New("protocol: malformed HELLO")
+	ErrUserIDMismatch     = errors.New("protocol: user_id does not match pub||pseudo")
+	ErrTranscriptMismatch = errors.New("protocol: HELLO not bound to this handshake")
+	ErrHelloSignature     = errors.New("protocol: invalid HELLO signature")
+)
+
+// BuildHello returns a signed HELLO for id. When transcript is not nil
+// (the hash of a session handshake), it is embedded in the signed message
+// so the HELLO cannot be replayed in another session.
+func BuildHello(id *pqc.Identity, peerID string, transcript []byte) (*HelloMessage, []byte, error) {
 	msg := &HelloMessage{
 		Type:   "HELLO",
 		Pseudo: id.Pseudo,
 		UserID: id.UserID,
+		Alg:    id.Alg,
 		Pub:    base64.StdEncoding.EncodeToString(id.Pub),
+		PeerID: peerID,
+	}
+	if transcript != nil {
+		msg.Transcript = base64.StdEncoding.EncodeToString(transcript)
 	}
 
-	raw, err := Marshal(msg)
+	raw, err := SigningBytes(msg)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -41,3 +60,48 @@ func BuildHello(id *pqc.Identity) (*HelloMessage, []byte, error) {
 
 	return msg, final, nil
 }
+
+// VerifyHello checks the user_id and the ML-DSA signature of msg, and that
+// msg was signed for the handshake with this transcript. It returns the
+// decoded ML-DSA public key.
+func VerifyHello(msg *HelloMessage, transcript []byte) ([]byte, error) {
+	if msg.Type != "HELLO" {
+		return nil, ErrHelloType
+	}
+	pub, err := base64.StdEncoding.DecodeString(msg.Pub)
+	if err != nil || len(pub) == 0 {
+		return nil, ErrHelloEncoding
+	}
+	sig, err := base64.StdEncoding.DecodeString(msg.Sig)
+	if err != nil || len(sig) == 0 {
+		return nil, ErrHelloEncoding
+	}
+
+	if pqc.ComputeUserID(pub, msg.Pseudo) != msg.UserID {
+		return nil, ErrUserIDMismatch
+	}
+
+	bound, err := base64.StdEncoding.DecodeString(msg.Transcript)
+	if err != nil || len(transcript) == 0 || !bytes.Equal(bound, transcript) {
+		return nil, ErrTranscriptMismatch
+	}
+
+	raw, err := SigningBytes(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := pqc.VerifyWith(msg.SigAlg(), raw, sig, pub)
+	if err != nil || !ok {
+		return nil, ErrHelloSignature
+	}
+	return pub, nil
+}
+
+// SigAlg returns the signature algorithm of the sender's identity.
+func (m *HelloMessage) SigAlg() string {
+	if m.Alg == "" {
+		return pqc.SigAlgorithm
+	}
+	return m.Alg
+}
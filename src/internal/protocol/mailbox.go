@@ -0,0 +1,207 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package protocol
+
+import (
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"pqchat/src/internal/pqc"
+)
+
+var (
+	ErrBundle       = errors.New("protocol: invalid prekey bundle")
+	ErrMailEncoding = errors.New("protocol: malformed mail")
+	ErrMailboxAuth  = errors.New("protocol: invalid mailbox authentication")
+)
+
+// NewBundle returns the prekey bundle of id, signed. The one-time prekeys
+// must be signed with SignOneTime already.
+func NewBundle(id *pqc.Identity, signed Prekey, oneTime []Prekey) (*PrekeyBundle, error) {
+	b := &PrekeyBundle{
+		Type:      "PREKEYS",
+		UserID:    id.UserID,
+		Pseudo:    id.Pseudo,
+		Alg:       id.Alg,
+		Pub:       base64.StdEncoding.EncodeToString(id.Pub),
+		Signed:    signed,
+		Timestamp: time.Now().Unix(),
+	}
+	if err := Sign(id, b, &b.Sig); err != nil {
+		return nil, err
+	}
+	b.OneTime = oneTime
+	return b, nil
+}
+
+// Verify checks that the bundle and its one-time prekeys are signed by the
+// identity key its user ID commits to, and returns that key.
+func (b *PrekeyBundle) Verify() (pub []byte, err error) {
+	if b.Type != "PREKEYS" {
+		return nil, ErrBundle
+	}
+	pub, err = decodeIdentity(b.UserID, b.Pseudo, b.Pub, ErrBundle)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.Signed.Key(); err != nil {
+		return nil, err
+	}
+	signed := *b
+	signed.OneTime = nil
+	if err := Verify(&signed, b.Sig, b.Alg, pub); err != nil {
+		return nil, ErrBundle
+	}
+	for i := range b.OneTime {
+		if err := b.VerifyOneTime(&b.OneTime[i], pub); err != nil {
+			return nil, err
+		}
+	}
+	return pub, nil
+}
+
+// oneTimePrekey is what the signature of a one-time prekey covers.
+type oneTimePrekey struct {
+	Type   string `json:"type"` // ONE_TIME_PREKEY
+	UserID string `json:"user_id"`
+	Prekey Prekey `json:"prekey"` // with an empty sig
+}
+
+// SignOneTime signs a one-time prekey of id in place.
+func SignOneTime(id *pqc.Identity, p *Prekey) error {
+	p.Sig = ""
+	m := oneTimePrekey{Type: "ONE_TIME_PREKEY", UserID: id.UserID, Prekey: *p}
+	var sig string
+	if err := Sign(id, &m, &sig); err != nil {
+		return err
+	}
+	p.Sig = sig
+	return nil
+}
+
+// VerifyOneTime checks a one-time prekey of the bundle's owner, whose
+// identity key is pub.
+func (b *PrekeyBundle) VerifyOneTime(p *Prekey, pub []byte) error {
+	if _, err := p.Key(); err != nil {
+		return err
+	}
+	m := oneTimePrekey{Type: "ONE_TIME_PREKEY", UserID: b.UserID, Prekey: *p}
+	m.Prekey.Sig = ""
+	if err := Verify(&m, p.Sig, b.Alg, pub); err != nil {
+		return ErrBundle
+	}
+	return nil
+}
+
+// Key decodes the public key of a prekey.
+func (p *Prekey) Key() ([]byte, error) {
+	pub, err := base64.StdEncoding.DecodeString(p.Pub)
+	if err != nil || len(pub) == 0 || p.ID == "" || p.KEMAlg == "" {
+		return nil, ErrBundle
+	}
+	return pub, nil
+}
+
+// BuildMailChat returns a CHAT message from id to one user, signed like
+// BuildChat. It embeds the public key, algorithm and pseudo of id: the
+// recipient may never have met us, it checks the user ID against them.
+func BuildMailChat(id *pqc.Identity, to, body string) (*ChatMessage, []byte, error) {
+	msg := &ChatMessage{
+		Type:      "CHAT",
+		From:      id.UserID,
+		To:        []string{to},
+		Body:      body,
+		Timestamp: time.Now().Unix(),
+		Pub:       base64.StdEncoding.EncodeToString(id.Pub),
+		Pseudo:    id.Pseudo,
+		Alg:       id.Alg,
+	}
+	if err := Sign(id, msg, &msg.Sig); err != nil {
+		return nil, nil, err
+	}
+	raw, err := Marshal(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, raw, nil
+}
+
+// VerifyMailChat checks a CHAT message built by BuildMailChat against the
+// key and algorithm it embeds, and returns the sender's key.
+func VerifyMailChat(msg *ChatMessage) (pub []byte, err error) {
+	pub, err = decodeIdentity(msg.From, msg.Pseudo, msg.Pub, ErrChatEncoding)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Alg == "" {
+		return nil, ErrChatEncoding
+	}
+	if err := VerifyChat(msg, msg.Alg, pub); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// MailContext binds a mail to its recipient and prekeys. oneTime is empty
+// when no one-time prekey was used.
+func MailContext(to, prekey, oneTime string) []byte {
+	return []byte("pqchat-mail|" + to + "|" + prekey + "|" + oneTime)
+}
+
+// NewMailboxAuth signs the challenge of a relayer's mailbox stream.
+func NewMailboxAuth(id *pqc.Identity, relay string, challenge []byte) (*MailboxAuth, error) {
+	a := &MailboxAuth{
+		Type:      "MAILBOX_AUTH",
+		UserID:    id.UserID,
+		Pseudo:    id.Pseudo,
+		Alg:       id.Alg,
+		Pub:       base64.StdEncoding.EncodeToString(id.Pub),
+		Relay:     relay,
+		Challenge: base64.StdEncoding.EncodeToString(challenge),
+	}
+	if err := Sign(id, a, &a.Sig); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Verify checks that a signed the challenge of this relayer's stream.
+func (a *MailboxAuth) Verify(relay string, challenge []byte) error {
+	if a.Type != "MAILBOX_AUTH" || a.Relay != relay ||
+		a.Challenge != base64.StdEncoding.EncodeToString(challenge) {
+		return ErrMailboxAuth
+	}
+	pub, err := decodeIdentity(a.UserID, a.Pseudo, a.Pub, ErrMailboxAuth)
+	if err != nil {
+		return err
+	}
+	if err := Verify(a, a.Sig, a.Alg, pub); err != nil {
+		return ErrMailboxAuth
+	}
+	return nil
+}
+
+// decodeIdentity decodes a public key and checks that userID commits to
+// it. A key that does not decode gives malformed.
+func decodeIdentity(userID, pseudo, pub64 string, malformed error) ([]byte, error) {
+	pub, err := base64.StdEncoding.DecodeString(pub64)
+	if err != nil || len(pub) == 0 {
+		return nil, malformed
+	}
+	if pqc.ComputeUserID(pub, pseudo) != userID {
+		return nil, ErrUserIDMismatch
+	}
+	return pub, nil
+}
@@ -13,13 +13,185 @@
 // limitations under the License.
 package protocol
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+)
 
-// Marshal canonical JSON
+// Marshal canonical JSON (RFC 8785, JSON Canonicalization Scheme):
+// object keys sorted by UTF-16 code units, no insignificant whitespace,
+// numbers in their shortest ECMAScript form and minimal string escaping
+// (no HTML escaping).
 func Marshal(v any) ([]byte, error) {
-	return json.Marshal(v)
+	tree, err := toTree(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeCanonical(&buf, tree); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SigningBytes returns the canonical JSON of a message with its top-level
+// "sig" field removed. This is what gets signed with ML-DSA.
+func SigningBytes(v any) ([]byte, error) {
+	tree, err := toTree(v)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := tree.(map[string]any)
+	if !ok {
+		return nil, errors.New("protocol: signed value is not a JSON object")
+	}
+	delete(obj, "sig")
+
+	var buf bytes.Buffer
+	if err := writeCanonical(&buf, obj); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func Unmarshal(data []byte, v any) error {
 	return json.Unmarshal(data, v)
 }
+
+// toTree turns v into generic JSON values, keeping numbers as json.Number.
+func toTree(v any) (any, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var tree any
+	if err := dec.Decode(&tree); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+func writeCanonical(buf *bytes.Buffer, v any) error {
+	switch x := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		if x {
+			buf.WriteString("true")
+		} else {
+			buf.WriteString("false")
+		}
+	case json.Number:
+		return writeNumber(buf, x)
+	case string:
+		writeString(buf, x)
+	case []any:
+		buf.WriteByte('[')
+		for i, e := range x {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonical(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]any:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return lessUTF16(keys[i], keys[j]) })
+
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeString(buf, k)
+			buf.WriteByte(':')
+			if err := writeCanonical(buf, x[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("protocol: unexpected JSON value %T", v)
+	}
+	return nil
+}
+
+// writeNumber formats n like ECMAScript's Number.prototype.toString,
+// which is what encoding/json does for float64 values.
+func writeNumber(buf *bytes.Buffer, n json.Number) error {
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return fmt.Errorf("protocol: number %s cannot be canonicalized", n)
+	}
+	if f == 0 {
+		f = 0 // -0 → 0
+	}
+	out, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	buf.Write(out)
+	return nil
+}
+
+// writeString only escapes what JSON requires. s comes from encoding/json
+// so it is already valid UTF-8.
+func writeString(buf *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if c < 0x20 {
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hex[c>>4])
+				buf.WriteByte(hex[c&0xf])
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// lessUTF16 compares two strings by their UTF-16 code units, as required
+// for JCS property sorting.
+func lessUTF16(a, b string) bool {
+	ua := utf16.Encode([]rune(a))
+	ub := utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
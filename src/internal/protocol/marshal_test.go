@@ -0,0 +1,138 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Vectors from RFC 8785: section 3.2.2 for the full example, 3.2.3 for
+// property sorting and appendix B for numbers.
+func TestMarshalRFC8785(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{
+			"full example",
+			`{"numbers": [333333333.33333329, 1E30, 4.50, 2e-3, 0.000000000000000000000000001],
+			  "string": "\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"\/",
+			  "literals": [null, true, false]}`,
+			`{"literals":[null,true,false],"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],"string":"€$\u000f\nA'B\"\\\\\"/"}`,
+		},
+		{
+			"sorting by UTF-16 code units",
+			`{"\u20ac": "Euro Sign", "\r": "Carriage Return", "\ufb33": "Hebrew Letter Dalet With Dagesh",
+			  "1": "One", "\ud83d\ude00": "Emoji: Grinning Face", "\u0080": "Control",
+			  "\u00f6": "Latin Small Letter O With Diaeresis"}`,
+			"{\"\\r\":\"Carriage Return\",\"1\":\"One\",\"\u0080\":\"Control\",\"ö\":\"Latin Small Letter O With Diaeresis\"," +
+				"\"€\":\"Euro Sign\",\"😀\":\"Emoji: Grinning Face\",\"דּ\":\"Hebrew Letter Dalet With Dagesh\"}",
+		},
+		{
+			"nested objects are sorted too",
+			`{"b": {"z": 1, "a": [{"y": 2, "x": 3}]}, "a": 0}`,
+			`{"a":0,"b":{"a":[{"x":3,"y":2}],"z":1}}`,
+		},
+		{
+			"no HTML escaping",
+			`{"s": "<a href=\"x\">&</a>"}`,
+			`{"s":"<a href=\"x\">&</a>"}`,
+		},
+		{
+			"string escapes",
+			`["\b\f\n\r\t", "\u0000\u001f\u007f", "\u2028"]`,
+			"[\"\\b\\f\\n\\r\\t\",\"\\u0000\\u001f\u007f\",\"\u2028\"]",
+		},
+	}
+	for _, tt := range tests {
+		got, err := Marshal(json.RawMessage(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMarshalNumbers(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"0", "0"},
+		{"-0", "0"},
+		{"-0.0", "0"},
+		{"1", "1"},
+		{"4.50", "4.5"},
+		{"2e-3", "0.002"},
+		{"1e-6", "0.000001"},
+		{"1e-7", "1e-7"},
+		{"1e21", "1e+21"},
+		{"1e20", "100000000000000000000"},
+		{"9007199254740992", "9007199254740992"},
+		{"9007199254740993", "9007199254740992"},
+		{"295147905179352830000", "295147905179352830000"},
+		{"-1.7976931348623157e+308", "-1.7976931348623157e+308"},
+		{"5e-324", "5e-324"},
+		{"9.999999999999997e+22", "9.999999999999997e+22"},
+		{"1e+23", "1e+23"},
+		{"333333333.33333329", "333333333.3333333"},
+		{"0.1", "0.1"},
+		{"-123.456", "-123.456"},
+	}
+	for _, tt := range tests {
+		got, err := Marshal(json.RawMessage(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := Marshal(json.RawMessage("1e400")); err == nil {
+		t.Error("1e400: no error for a number out of range")
+	}
+}
+
+func TestSigningBytes(t *testing.T) {
+	in := json.RawMessage(`{"type": "X", "sig": "top", "inner": {"sig": "kept"}, "list": [{"sig": "kept"}]}`)
+	got, err := SigningBytes(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"inner":{"sig":"kept"},"list":[{"sig":"kept"}],"type":"X"}`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// Signing a message must not depend on its signature
+	msg := &ChatMessage{Type: "CHAT", From: "a", To: []string{"b"}, Body: "hi", Timestamp: 1}
+	unsigned, err := SigningBytes(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Sig = "c2ln"
+	signed, err := SigningBytes(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(signed) != string(unsigned) {
+		t.Errorf("sig changes the signing bytes:\n%s\n%s", unsigned, signed)
+	}
+
+	if _, err := SigningBytes(json.RawMessage(`["sig"]`)); err == nil {
+		t.Error("no error for a value that is not an object")
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package protocol
+
+import (
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"pqchat/src/internal/pqc"
+)
+
+var ErrPeerRecord = errors.New("protocol: invalid peer record")
+
+// NewPeerRecord returns a record, signed by id, saying it runs on peerID
+// at addrs.
+func NewPeerRecord(id *pqc.Identity, peerID string, addrs []string) (*PeerRecord, error) {
+	r := &PeerRecord{
+		Type:      "PEER_RECORD",
+		UserID:    id.UserID,
+		Pseudo:    id.Pseudo,
+		Alg:       id.Alg,
+		Pub:       base64.StdEncoding.EncodeToString(id.Pub),
+		PeerID:    peerID,
+		Addrs:     addrs,
+		Timestamp: time.Now().Unix(),
+	}
+	if err := Sign(id, r, &r.Sig); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Verify checks that the record is signed by the identity key its user ID
+// commits to. Whether it is recent enough is up to the caller.
+func (r *PeerRecord) Verify() error {
+	if r.Type != "PEER_RECORD" || r.PeerID == "" {
+		return ErrPeerRecord
+	}
+	pub, err := decodeIdentity(r.UserID, r.Pseudo, r.Pub, ErrPeerRecord)
+	if err != nil {
+		return err
+	}
+	if err := Verify(r, r.Sig, r.Alg, pub); err != nil {
+		return ErrPeerRecord
+	}
+	return nil
+}
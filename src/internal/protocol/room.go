@@ -0,0 +1,128 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package protocol
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"pqchat/src/internal/pqc"
+)
+
+var (
+	ErrRoomEncoding  = errors.New("protocol: malformed room message")
+	ErrRoomSignature = errors.New("protocol: invalid room message signature")
+)
+
+// MessageType returns the "type" field of a JSON message.
+func MessageType(raw []byte) (string, error) {
+	var m struct {
+		Type string `json:"type"`
+	}
+	if err := Unmarshal(raw, &m); err != nil {
+		return "", err
+	}
+	return m.Type, nil
+}
+
+// NewMember describes id in a room, with the ML-KEM key its group keys are
+// wrapped to.
+func NewMember(id *pqc.Identity, kemAlg string, kemPub []byte) RoomMember {
+	return RoomMember{
+		UserID: id.UserID,
+		Pseudo: id.Pseudo,
+		Alg:    id.Alg,
+		Pub:    base64.StdEncoding.EncodeToString(id.Pub),
+		KEMAlg: kemAlg,
+		KEMPub: base64.StdEncoding.EncodeToString(kemPub),
+	}
+}
+
+// Keys decodes the member's public keys and checks that its user ID
+// commits to the signature key.
+func (m *RoomMember) Keys() (pub, kemPub []byte, err error) {
+	pub, err = base64.StdEncoding.DecodeString(m.Pub)
+	if err != nil || len(pub) == 0 {
+		return nil, nil, ErrRoomEncoding
+	}
+	kemPub, err = base64.StdEncoding.DecodeString(m.KEMPub)
+	if err != nil || len(kemPub) == 0 {
+		return nil, nil, ErrRoomEncoding
+	}
+	if pqc.ComputeUserID(pub, m.Pseudo) != m.UserID {
+		return nil, nil, ErrUserIDMismatch
+	}
+	return pub, kemPub, nil
+}
+
+// BuildRoomChat returns a CHAT message from id to a room, signed like
+// BuildChat. It is then sealed under the room's group key.
+func BuildRoomChat(id *pqc.Identity, room string, epoch uint64, body string) (*ChatMessage, []byte, error) {
+	msg := &ChatMessage{
+		Type:      "CHAT",
+		From:      id.UserID,
+		Room:      room,
+		Epoch:     epoch,
+		Body:      body,
+		Timestamp: time.Now().Unix(),
+	}
+	if err := Sign(id, msg, &msg.Sig); err != nil {
+		return nil, nil, err
+	}
+	raw, err := Marshal(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, raw, nil
+}
+
+// Sign signs a room message in place. msg is one of the signed Room*
+// types, sig points to its Sig field.
+func Sign(id *pqc.Identity, msg any, sig *string) error {
+	*sig = ""
+	raw, err := SigningBytes(msg)
+	if err != nil {
+		return err
+	}
+	s, err := id.Sign(raw)
+	if err != nil {
+		return err
+	}
+	*sig = base64.StdEncoding.EncodeToString(s)
+	return nil
+}
+
+// Verify checks the signature sig of msg with an alg public key.
+func Verify(msg any, sig, alg string, pub []byte) error {
+	s, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil || len(s) == 0 {
+		return ErrRoomEncoding
+	}
+	raw, err := SigningBytes(msg)
+	if err != nil {
+		return err
+	}
+	ok, err := pqc.VerifyWith(alg, raw, s, pub)
+	if err != nil || !ok {
+		return ErrRoomSignature
+	}
+	return nil
+}
+
+// RoomContext binds keys and messages to a room and epoch.
+func RoomContext(room string, epoch uint64) []byte {
+	return fmt.Appendf(nil, "pqchat-room|%s|%d", room, epoch)
+}
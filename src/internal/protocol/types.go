@@ -14,19 +14,195 @@
 package protocol
 
 type HelloMessage struct {
-	Type   string `json:"type"`
-	Pseudo string `json:"pseudo"`
-	UserID string `json:"user_id"`
-	Pub    string `json:"pub"` // base64
-	Sig    string `json:"sig"` // base64
+	Type       string `json:"type"`
+	Pseudo     string `json:"pseudo"`
+	UserID     string `json:"user_id"`
+	Alg        string `json:"alg,omitempty"` // signature algorithm, empty means ML-DSA-65
+	Pub        string `json:"pub"`           // base64
+	PeerID     string `json:"libp2p_peer_id,omitempty"`
+	Transcript string `json:"transcript,omitempty"` // base64(SHA256(handshake transcript))
+	Sig        string `json:"sig"`                  // base64
 }
 
 type ChatMessage struct {
 	Type      string   `json:"type"`
 	From      string   `json:"from"`
 	To        []string `json:"to"`
+	Room      string   `json:"room,omitempty"`  // room name, the message is then sealed in a RoomMessage
+	Epoch     uint64   `json:"epoch,omitempty"` // with room: epoch whose group key seals it
 	Body      string   `json:"body"`
 	Timestamp int64    `json:"timestamp"`
+	Sig       string   `json:"sig"`              // base64, over the message with an empty sig
+	Pub       string   `json:"pub,omitempty"`    // base64, omitted when cached from HELLO
+	Pseudo    string   `json:"pseudo,omitempty"` // with pub in mail, the sender may be unknown
+	Alg       string   `json:"alg,omitempty"`    // with pub in mail: signature algorithm of pub
+}
+
+// RoomMember is a member of a room, as listed by commits. The keys let any
+// member check the others' messages and the next owner wrap group keys.
+type RoomMember struct {
+	UserID string `json:"user_id"`
+	Pseudo string `json:"pseudo"`
+	Alg    string `json:"alg"` // signature algorithm
+	Pub    string `json:"pub"` // base64
+	KEMAlg string `json:"kem_alg"`
+	KEMPub string `json:"kem_pub"` // base64, group keys are wrapped to it
+}
+
+// RoomInvite is sent by the owner of a room to a peer it adds.
+type RoomInvite struct {
+	Type      string `json:"type"` // ROOM_INVITE
+	Room      string `json:"room"`
+	From      string `json:"from"`
+	Epoch     uint64 `json:"epoch"`
+	Timestamp int64  `json:"timestamp"`
+	Sig       string `json:"sig"`
+}
+
+// RoomJoin answers an invite, with the key the group key is wrapped to.
+type RoomJoin struct {
+	Type      string     `json:"type"` // ROOM_JOIN
+	Room      string     `json:"room"`
+	Member    RoomMember `json:"member"`
+	Timestamp int64      `json:"timestamp"`
+	Sig       string     `json:"sig"`
+}
+
+// RoomLeave asks the owner to remove the sender from the room. An owner
+// leaving names the next owner instead, which commits it out.
+type RoomLeave struct {
+	Type      string `json:"type"` // ROOM_LEAVE
+	Room      string `json:"room"`
+	From      string `json:"from"`
+	Owner     string `json:"owner,omitempty"` // user ID of the next owner
+	Epoch     uint64 `json:"epoch"`
+	Timestamp int64  `json:"timestamp"`
+	Sig       string `json:"sig"`
+}
+
+// RoomWelcome carries the group key of an epoch for one member.
+type RoomWelcome struct {
+	UserID string `json:"user_id"`
+	CT     string `json:"ct"`  // base64 ML-KEM ciphertext
+	Key    string `json:"key"` // base64 group key, AES-GCM under the shared secret
+}
+
+// RoomCommit starts a new epoch of a room: its members, its owner and a
+// fresh group key for each member. Only the owner commits.
+type RoomCommit struct {
+	Type      string        `json:"type"` // ROOM_COMMIT
+	Room      string        `json:"room"`
+	Epoch     uint64        `json:"epoch"`
+	Owner     string        `json:"owner"` // user ID of the next committer
+	Members   []RoomMember  `json:"members"`
+	Welcomes  []RoomWelcome `json:"welcomes"`
+	Handover  *RoomLeave    `json:"handover,omitempty"` // of the previous owner, naming the committer
+	Timestamp int64         `json:"timestamp"`
+	Sig       string        `json:"sig"` // by the owner of the previous epoch, or the one it named
+}
+
+// RoomMessage is a signed ChatMessage encrypted once under the group key
+// of an epoch.
+type RoomMessage struct {
+	Type  string `json:"type"` // ROOM_MSG
+	Room  string `json:"room"`
+	Epoch uint64 `json:"epoch"`
+	Nonce string `json:"nonce"` // base64
+	CT    string `json:"ct"`    // base64
+}
+
+// Prekey is an ML-KEM public key a user publishes so that peers can
+// encrypt to it while the user is offline.
+type Prekey struct {
+	ID      string `json:"id"` // hex, picked by the owner
+	KEMAlg  string `json:"kem_alg"`
+	Pub     string `json:"pub"`               // base64
+	Created int64  `json:"created,omitempty"` // one-time prekeys only
+	Sig     string `json:"sig,omitempty"`     // one-time prekeys only, see SignOneTime
+}
+
+// PrekeyBundle lists the prekeys of a user, signed with its identity key.
+// One-time prekeys are signed one by one: the relayer hands them out one
+// at a time, each to a single sender.
+type PrekeyBundle struct {
+	Type      string   `json:"type"` // PREKEYS
+	UserID    string   `json:"user_id"`
+	Pseudo    string   `json:"pseudo"`
+	Alg       string   `json:"alg"`
+	Pub       string   `json:"pub"`                // base64 identity key
+	Signed    Prekey   `json:"signed"`             // medium-term, replaced from time to time
+	OneTime   []Prekey `json:"one_time,omitempty"` // not covered by sig
+	Timestamp int64    `json:"timestamp"`
+	Sig       string   `json:"sig"`
+}
+
+// Mail is a message left on a relayer for a user who is offline. All the
+// relayer learns is the recipient: the sender and the body are in CT, a
+// signed ChatMessage encrypted to one of the recipient's prekeys.
+type Mail struct {
+	Type   string `json:"type"`   // MAIL
+	To     string `json:"to"`     // user ID
+	Prekey string `json:"prekey"` // ID of the signed prekey encapsulated to
+	KEMCT  string `json:"kem_ct"` // base64
+
+	// The one-time prekey encapsulated to as well, if the relayer had one
+	OneTime   string `json:"one_time,omitempty"`
+	OneTimeCT string `json:"one_time_ct,omitempty"` // base64
+
+	CT string `json:"ct"` // base64
+}
+
+// StoredMail is a mail as handed back by the relayer.
+type StoredMail struct {
+	ID       string `json:"id"`
+	Received int64  `json:"received"`
+	Mail     Mail   `json:"mail"`
+}
+
+// MailboxAuth proves that a client holds the identity key of a mailbox,
+// by signing the challenge the relayer opened the stream with.
+type MailboxAuth struct {
+	Type      string `json:"type"` // MAILBOX_AUTH
+	UserID    string `json:"user_id"`
+	Pseudo    string `json:"pseudo"`
+	Alg       string `json:"alg"`
+	Pub       string `json:"pub"`       // base64
+	Relay     string `json:"relay"`     // peer ID of the relayer
+	Challenge string `json:"challenge"` // base64
+	Sig       string `json:"sig"`
+}
+
+// MailboxRequest is sent by a client on a mailbox stream.
+type MailboxRequest struct {
+	Op     string        `json:"op"`                // put, fetch, ack, publish or prekeys
+	Mail   *Mail         `json:"mail,omitempty"`    // put
+	Bundle *PrekeyBundle `json:"bundle,omitempty"`  // publish
+	UserID string        `json:"user_id,omitempty"` // prekeys
+	IDs    []string      `json:"ids,omitempty"`     // ack
+	Auth   *MailboxAuth  `json:"auth,omitempty"`    // fetch and ack
+}
+
+// MailboxResponse is sent by the relayer: first a challenge alone, then
+// the answer to the request.
+type MailboxResponse struct {
+	Challenge string        `json:"challenge,omitempty"` // base64
+	Error     string        `json:"error,omitempty"`
+	Mails     []StoredMail  `json:"mails,omitempty"`    // fetch
+	OneTime   int           `json:"one_time,omitempty"` // fetch: one-time prekeys left
+	Bundle    *PrekeyBundle `json:"bundle,omitempty"`   // prekeys, with one one-time prekey at most
+}
+
+// PeerRecord maps a user to the libp2p peer it runs on and where to dial
+// it. It is stored in the DHT under the user ID, which commits to the key
+// that signs it.
+type PeerRecord struct {
+	Type      string   `json:"type"` // PEER_RECORD
+	UserID    string   `json:"user_id"`
+	Pseudo    string   `json:"pseudo"`
+	Alg       string   `json:"alg"`
+	Pub       string   `json:"pub"` // base64
+	PeerID    string   `json:"peer_id"`
+	Addrs     []string `json:"addrs"` // multiaddrs, without /p2p/<peer_id>
+	Timestamp int64    `json:"timestamp"`
 	Sig       string   `json:"sig"`
-	Pub       string   `json:"pub"`
 }
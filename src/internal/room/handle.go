@@ -0,0 +1,501 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package room
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/protocol"
+)
+
+// Handle processes a room frame received from a connected user. Copies of
+// commits and messages already seen are dropped silently.
+func (rs *Rooms) Handle(from string, payload []byte) error {
+	typ, err := protocol.MessageType(payload)
+	if err != nil {
+		return protocol.ErrRoomEncoding
+	}
+	switch typ {
+	case "ROOM_INVITE":
+		var m protocol.RoomInvite
+		if err := protocol.Unmarshal(payload, &m); err != nil {
+			return protocol.ErrRoomEncoding
+		}
+		return rs.handleInvite(from, &m)
+	case "ROOM_JOIN":
+		var m protocol.RoomJoin
+		if err := protocol.Unmarshal(payload, &m); err != nil {
+			return protocol.ErrRoomEncoding
+		}
+		return rs.handleJoin(from, &m)
+	case "ROOM_LEAVE":
+		var m protocol.RoomLeave
+		if err := protocol.Unmarshal(payload, &m); err != nil {
+			return protocol.ErrRoomEncoding
+		}
+		return rs.handleLeave(from, &m)
+	case "ROOM_COMMIT":
+		var m protocol.RoomCommit
+		if err := protocol.Unmarshal(payload, &m); err != nil {
+			return protocol.ErrRoomEncoding
+		}
+		return rs.handleCommit(from, &m)
+	case "ROOM_MSG":
+		var m protocol.RoomMessage
+		if err := protocol.Unmarshal(payload, &m); err != nil {
+			return protocol.ErrRoomEncoding
+		}
+		return rs.handleMessage(from, &m)
+	default:
+		return fmt.Errorf("%w %q", ErrUnexpected, typ)
+	}
+}
+
+// handleInvite keeps an invite until our user accepts it, replacing an
+// earlier one to the same room. Invites come straight from the owner,
+// whose key is known from our session.
+func (rs *Rooms) handleInvite(from string, inv *protocol.RoomInvite) error {
+	p, ok := rs.lookup(from)
+	if !ok || inv.From != from {
+		return ErrUnexpected
+	}
+	if err := protocol.Verify(inv, inv.Sig, p.Alg, p.Pub); err != nil {
+		return err
+	}
+	if err := checkName(inv.Room); err != nil {
+		return err
+	}
+
+	rs.mu.Lock()
+	switch {
+	case rs.rooms[inv.Room] != nil:
+		rs.mu.Unlock()
+		return ErrExists
+	case rs.invites[inv.Room] == nil && len(rs.invites) >= maxInvites:
+		rs.mu.Unlock()
+		return ErrInvites
+	}
+	rs.invites[inv.Room] = &invite{from: from, peer: p, epoch: inv.Epoch}
+	rs.mu.Unlock()
+
+	if rs.on.Invite != nil {
+		rs.on.Invite(inv.Room, p.Pseudo)
+	} else {
+		rs.notice(inv.Room, p.Pseudo+" invited you")
+	}
+	return nil
+}
+
+// handleJoin adds an invited user to a room we own.
+func (rs *Rooms) handleJoin(from string, j *protocol.RoomJoin) error {
+	if j.Member.UserID != from || j.Member.KEMAlg != KEMAlg {
+		return ErrUnexpected
+	}
+	pub, _, err := j.Member.Keys()
+	if err != nil {
+		return err
+	}
+	if err := protocol.Verify(j, j.Sig, j.Member.Alg, pub); err != nil {
+		return err
+	}
+	id := rs.id()
+
+	rs.mu.Lock()
+	r, err := rs.owned(j.Room, id)
+	if err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+	if !r.invited[from] {
+		rs.mu.Unlock()
+		return ErrUnexpected
+	}
+	if _, _, ok := r.cur.member(from); ok {
+		rs.mu.Unlock()
+		return ErrMember
+	}
+	out, err := rs.commit(r, id, append(slices.Clone(r.cur.members), j.Member), r.owner, nil)
+	rs.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	rs.flush(out)
+	rs.notice(r.name, j.Member.Pseudo+" joined")
+	return nil
+}
+
+// handleLeave commits a member out of a room we own, at its request.
+func (rs *Rooms) handleLeave(from string, l *protocol.RoomLeave) error {
+	if l.Owner != "" {
+		return rs.handleHandover(from, l)
+	}
+	if l.From != from {
+		return ErrUnexpected
+	}
+	id := rs.id()
+
+	rs.mu.Lock()
+	r, err := rs.owned(l.Room, id)
+	if err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+	m, pub, ok := r.cur.member(from)
+	if !ok {
+		rs.mu.Unlock()
+		return ErrNotMember
+	}
+	if err := protocol.Verify(l, l.Sig, m.Alg, pub); err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+	out, err := rs.commit(r, id, without(r.cur.members, from), r.owner, nil)
+	rs.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	rs.flush(out)
+	rs.notice(r.name, m.Pseudo+" left")
+	return nil
+}
+
+// handleHandover makes the member named by a leaving owner the owner, and
+// passes the leave on to the members. When that is us, we commit the old
+// owner out under a fresh group key.
+func (rs *Rooms) handleHandover(from string, l *protocol.RoomLeave) error {
+	if err := checkName(l.Room); err != nil {
+		return err
+	}
+	id := rs.id()
+
+	rs.mu.Lock()
+	r := rs.rooms[l.Room]
+	if r == nil || l.From != r.owner || l.Epoch != r.cur.n {
+		// Not one of our rooms, or a copy of a handover already applied
+		rs.mu.Unlock()
+		return nil
+	}
+	if err := checkHandover(r, l); err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+	old, _, _ := r.cur.member(l.From)
+	next, _, _ := r.cur.member(l.Owner)
+	r.owner = l.Owner
+	out, err := rs.toMembers(r.cur, l, id.UserID, from, l.From)
+	if err == nil && l.Owner == id.UserID {
+		var commit []outgoing
+		commit, err = rs.commit(r, id, without(r.cur.members, l.From), id.UserID, l)
+		out = append(out, commit...)
+	}
+	rs.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	rs.flush(out)
+	if l.Owner == id.UserID {
+		rs.notice(r.name, old.Pseudo+" left, you now own the room")
+	} else {
+		rs.notice(r.name, old.Pseudo+" handed the room to "+next.Pseudo)
+	}
+	return nil
+}
+
+// checkHandover checks that l comes from the owner of the current epoch
+// of r, and names another member.
+func checkHandover(r *room, l *protocol.RoomLeave) error {
+	m, pub, ok := r.cur.member(l.From)
+	if !ok || l.Room != r.name || l.From != r.owner || l.Epoch != r.cur.n {
+		return ErrUnexpected
+	}
+	if _, _, ok := r.cur.member(l.Owner); !ok || l.Owner == l.From {
+		return ErrNotMember
+	}
+	return protocol.Verify(l, l.Sig, m.Alg, pub)
+}
+
+// handleCommit moves a room to its next epoch. The commit must be signed
+// by the owner of the current epoch, or the member it handed over to, or
+// by the inviter when we are joining. It is then passed on to the members.
+func (rs *Rooms) handleCommit(from string, c *protocol.RoomCommit) error {
+	if err := checkName(c.Room); err != nil {
+		return err
+	}
+	id := rs.id()
+
+	rs.mu.Lock()
+	r, inv := rs.rooms[c.Room], rs.pending[c.Room]
+	var (
+		signer string
+		alg    string
+		pub    []byte
+		kem    *pqc.KEM
+	)
+	switch {
+	case r != nil:
+		if c.Epoch <= r.cur.n {
+			rs.mu.Unlock()
+			return nil
+		}
+		if c.Epoch != r.cur.n+1 {
+			rs.mu.Unlock()
+			return ErrEpoch
+		}
+		signer = r.owner
+		if h := c.Handover; h != nil && h.Owner != r.owner {
+			// The commit overtook the handover
+			if err := checkHandover(r, h); err != nil {
+				rs.mu.Unlock()
+				return err
+			}
+			signer = h.Owner
+		}
+		m, p, _ := r.cur.member(signer)
+		alg, pub, kem = m.Alg, p, r.kem
+	case inv != nil:
+		if c.Epoch <= inv.epoch {
+			rs.mu.Unlock()
+			return ErrEpoch
+		}
+		signer, alg, pub, kem = inv.from, inv.peer.Alg, inv.peer.Pub, inv.kem
+	default:
+		// Not one of our rooms, or not any more
+		rs.mu.Unlock()
+		return nil
+	}
+	if err := protocol.Verify(c, c.Sig, alg, pub); err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+	next, err := openCommit(c, id, kem)
+	if err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+
+	var (
+		notices []string
+		joined  bool
+	)
+	switch {
+	case next == nil && r != nil:
+		delete(rs.rooms, c.Room)
+		r.close()
+		notices = append(notices, "you were removed")
+	case next == nil:
+		delete(rs.pending, c.Room)
+		inv.kem.Clean()
+	case r == nil:
+		delete(rs.pending, c.Room)
+		r = &room{name: c.Room, owner: c.Owner, cur: next, kem: inv.kem, invited: make(map[string]bool)}
+		rs.rooms[c.Room] = r
+		joined = true
+		notices = append(notices, fmt.Sprintf("you joined, members: %s", pseudos(next.members)))
+	default:
+		for _, m := range next.members {
+			if _, _, ok := r.cur.member(m.UserID); !ok {
+				notices = append(notices, m.Pseudo+" joined")
+			}
+		}
+		for _, m := range r.cur.members {
+			if _, _, ok := next.member(m.UserID); !ok {
+				notices = append(notices, m.Pseudo+" left")
+			}
+		}
+		switch owner, _, _ := next.member(c.Owner); {
+		case c.Owner == r.owner:
+		case c.Owner == id.UserID:
+			notices = append(notices, "you now own the room")
+		default:
+			notices = append(notices, owner.Pseudo+" now owns the room")
+		}
+		r.advance(next, c.Owner)
+	}
+
+	var out []outgoing
+	if next != nil {
+		out, err = rs.toMembers(next, c, id.UserID, from, signer)
+	}
+	rs.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	switch {
+	case joined:
+		if err := rs.subscribe(c.Room); err != nil {
+			return err
+		}
+	case next == nil:
+		rs.unsubscribe(c.Room)
+	}
+	rs.flush(out)
+	for _, text := range notices {
+		rs.notice(c.Room, text)
+	}
+	return nil
+}
+
+// openCommit checks the members of a commit and opens our group key. It
+// returns a nil epoch when we are not a member any more.
+func openCommit(c *protocol.RoomCommit, id *pqc.Identity, kem *pqc.KEM) (*epoch, error) {
+	next := &epoch{n: c.Epoch, members: c.Members, pubs: make(map[string][]byte)}
+	for _, m := range c.Members {
+		pub, _, err := m.Keys()
+		if err != nil {
+			return nil, err
+		}
+		if next.pubs[m.UserID] != nil {
+			return nil, ErrMember
+		}
+		next.pubs[m.UserID] = pub
+	}
+	if next.pubs[c.Owner] == nil {
+		return nil, ErrNotMember
+	}
+	if next.pubs[id.UserID] == nil {
+		return nil, nil
+	}
+
+	i := slices.IndexFunc(c.Welcomes, func(w protocol.RoomWelcome) bool { return w.UserID == id.UserID })
+	if i < 0 {
+		return nil, ErrWelcome
+	}
+	ct, err := base64.StdEncoding.DecodeString(c.Welcomes[i].CT)
+	if err != nil {
+		return nil, protocol.ErrRoomEncoding
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(c.Welcomes[i].Key)
+	if err != nil {
+		return nil, protocol.ErrRoomEncoding
+	}
+	next.key, err = pqc.UnwrapGroupKey(kem, ct, wrapped, protocol.RoomContext(c.Room, c.Epoch))
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// handleMessage opens a room message, checks its signature against the
+// member list of its epoch and passes it on to the members. Copies of a
+// message seen before are dropped.
+func (rs *Rooms) handleMessage(from string, m *protocol.RoomMessage) error {
+	if err := checkName(m.Room); err != nil {
+		return err
+	}
+	id := rs.id()
+
+	rs.mu.Lock()
+	r := rs.rooms[m.Room]
+	if r == nil {
+		rs.mu.Unlock()
+		return nil
+	}
+	e := r.cur
+	if r.prev != nil && m.Epoch == r.prev.n {
+		e = r.prev
+	}
+	if m.Epoch != e.n {
+		rs.mu.Unlock()
+		return ErrEpoch
+	}
+	msg, err := rs.openMessage(e, m)
+	if err != nil || msg == nil {
+		rs.mu.Unlock()
+		return err
+	}
+	out, err := rs.toMembers(e, m, id.UserID, from, msg.From)
+	rs.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	rs.flush(out)
+	if rs.on.Message != nil {
+		rs.on.Message(msg)
+	}
+	return nil
+}
+
+// openMessage decrypts a room message sealed under the key of e, checks
+// the CHAT inside and remembers it. It returns a nil message for one seen
+// before. rs.mu is held.
+func (rs *Rooms) openMessage(e *epoch, m *protocol.RoomMessage) (*protocol.ChatMessage, error) {
+	nonce, err := base64.StdEncoding.DecodeString(m.Nonce)
+	if err != nil {
+		return nil, protocol.ErrRoomEncoding
+	}
+	ct, err := base64.StdEncoding.DecodeString(m.CT)
+	if err != nil {
+		return nil, protocol.ErrRoomEncoding
+	}
+	plain, err := pqc.OpenGroupMessage(e.key, nonce, ct, protocol.RoomContext(m.Room, m.Epoch))
+	if err != nil {
+		return nil, err
+	}
+
+	var msg protocol.ChatMessage
+	if err := protocol.Unmarshal(plain, &msg); err != nil {
+		return nil, protocol.ErrRoomEncoding
+	}
+	if msg.Room != m.Room || msg.Epoch != m.Epoch || len(msg.To) > 0 {
+		return nil, ErrUnexpected
+	}
+	sender, pub, ok := e.member(msg.From)
+	if !ok {
+		return nil, ErrNotMember
+	}
+	key, now := messageKey(&msg), time.Now()
+	if _, ok := rs.seen[key]; ok {
+		return nil, nil
+	}
+	if age := now.Sub(time.Unix(msg.Timestamp, 0)); age > maxMessageAge || age < -maxMessageAge {
+		return nil, ErrStale
+	}
+	if err := protocol.VerifyChat(&msg, sender.Alg, pub); err != nil {
+		return nil, err
+	}
+	if !rs.remember(key, msg.Timestamp, now) {
+		return nil, ErrBusy
+	}
+	return &msg, nil
+}
+
+// checkName only accepts room names in their canonical form.
+func checkName(name string) error {
+	if n, err := Normalize(name); err != nil || n != name {
+		return fmt.Errorf("%w %q", ErrName, name)
+	}
+	return nil
+}
+
+func pseudos(members []protocol.RoomMember) string {
+	names := make([]string, len(members))
+	for i, m := range members {
+		names[i] = m.Pseudo
+	}
+	return strings.Join(names, ", ")
+}
+
+func now() int64 {
+	return time.Now().Unix()
+}
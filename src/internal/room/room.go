@@ -0,0 +1,718 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package room
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pqchat/src/internal/net"
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/protocol"
+)
+
+// A room is a named group with a membership list, in the spirit of MLS
+// with post-quantum primitives but without its ratchet tree:
+//
+//   - the owner invites a peer which, once its user accepts, answers
+//     with a fresh ML-KEM key for this room (ROOM_JOIN);
+//   - every join, leave or kick makes the owner commit a new epoch: a
+//     random group key, wrapped to the ML-KEM key of each member, and
+//     the new member list, signed with the owner's ML-DSA key;
+//   - a leaving owner only names the next owner, which commits it out;
+//   - room messages are signed CHAT messages with their room set,
+//     encrypted once under the group key of the epoch.
+//
+// Commits and messages are flooded to the members one has a session
+// with, so members need not all be connected to each other.
+
+// KEMAlg is the algorithm of the per-room keys group keys are wrapped to.
+const KEMAlg = pqc.DefaultKEM
+
+// A room message is accepted once, within maxMessageAge of when it was
+// signed. Up to maxSeen recent messages are remembered to drop flooded
+// copies and replays. Up to maxInvites invitations wait to be accepted.
+const (
+	maxMessageAge = 5 * time.Minute
+	maxSeen       = 10000
+	maxInvites    = 64
+)
+
+var (
+	ErrName       = errors.New("room: invalid room name")
+	ErrNoRoom     = errors.New("room: no such room")
+	ErrExists     = errors.New("room: already in a room with that name")
+	ErrNotOwner   = errors.New("room: only the owner can change the members")
+	ErrMember     = errors.New("room: already a member")
+	ErrNotMember  = errors.New("room: not a member")
+	ErrUnexpected = errors.New("room: unexpected room message")
+	ErrEpoch      = errors.New("room: unknown epoch")
+	ErrWelcome    = errors.New("room: commit has no group key for us")
+	ErrNoInvite   = errors.New("room: no invitation to this room")
+	ErrInvites    = errors.New("room: too many invitations waiting")
+	ErrStale      = errors.New("room: message too old or from the future")
+	ErrBusy       = errors.New("room: too many recent messages")
+)
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Normalize returns the canonical form of a room name: lowercase, without
+// a leading #.
+func Normalize(name string) (string, error) {
+	name = strings.ToLower(strings.TrimPrefix(name, "#"))
+	if !validName.MatchString(name) {
+		return "", fmt.Errorf("%w %q", ErrName, name)
+	}
+	return name, nil
+}
+
+// Sender delivers a frame to a connected user.
+type Sender interface {
+	Send(userID string, f *net.Frame) error
+}
+
+// Peer is a connected user, as authenticated by its session.
+type Peer struct {
+	Pseudo string
+	Alg    string
+	Pub    []byte
+}
+
+// Lookup returns a connected user.
+type Lookup func(userID string) (Peer, bool)
+
+// Handlers are called without any lock held.
+type Handlers struct {
+	Message func(msg *protocol.ChatMessage) // a verified room message
+	Notice  func(room, text string)         // membership changes
+	Invite  func(room, pseudo string)       // an invitation, joined with Accept
+}
+
+// Invitation is an invitation to a room waiting for Accept.
+type Invitation struct {
+	Room   string
+	From   string // user ID
+	Pseudo string
+}
+
+// Info describes a room at its current epoch.
+type Info struct {
+	Name    string
+	Owner   string // user ID
+	Epoch   uint64
+	Members []protocol.RoomMember
+}
+
+// epoch is the key and members of a room at one point in time.
+type epoch struct {
+	n       uint64
+	key     []byte
+	members []protocol.RoomMember
+	pubs    map[string][]byte // user ID → signature key
+}
+
+func (e *epoch) member(userID string) (protocol.RoomMember, []byte, bool) {
+	for _, m := range e.members {
+		if m.UserID == userID {
+			return m, e.pubs[userID], true
+		}
+	}
+	return protocol.RoomMember{}, nil, false
+}
+
+func (e *epoch) wipe() {
+	clear(e.key)
+}
+
+type room struct {
+	name      string
+	owner     string
+	cur, prev *epoch // prev still opens messages sent before the last commit
+	kem       *pqc.KEM
+	invited   map[string]bool // owner side, pending invites by user ID
+}
+
+func (r *room) close() {
+	r.cur.wipe()
+	if r.prev != nil {
+		r.prev.wipe()
+	}
+	r.kem.Clean()
+}
+
+// invite is an invitation to a room. Once accepted, kem holds our key for
+// the room until the commit that adds us.
+type invite struct {
+	from  string
+	peer  Peer
+	epoch uint64
+	kem   *pqc.KEM
+}
+
+// outgoing is a frame to send once the lock is released.
+type outgoing struct {
+	to string
+	f  *net.Frame
+}
+
+// Rooms holds the rooms we are in.
+type Rooms struct {
+	id     func() *pqc.Identity
+	send   Sender
+	lookup Lookup
+	on     Handlers
+	topics Topics // nil: room messages go over the sessions
+
+	mu      sync.Mutex
+	rooms   map[string]*room
+	invites map[string]*invite // not accepted yet
+	pending map[string]*invite // accepted, waiting for the commit
+	seen    map[string]int64   // see messageKey → timestamp
+}
+
+// New returns an empty set of rooms for the identity returned by id.
+func New(id func() *pqc.Identity, send Sender, lookup Lookup, on Handlers) *Rooms {
+	return &Rooms{
+		id:      id,
+		send:    send,
+		lookup:  lookup,
+		on:      on,
+		rooms:   make(map[string]*room),
+		invites: make(map[string]*invite),
+		pending: make(map[string]*invite),
+		seen:    make(map[string]int64),
+	}
+}
+
+// Create makes a room with ourselves as its only member and owner.
+func (rs *Rooms) Create(name string) error {
+	name, err := Normalize(name)
+	if err != nil {
+		return err
+	}
+	id := rs.id()
+
+	rs.mu.Lock()
+	if rs.rooms[name] != nil || rs.pending[name] != nil {
+		rs.mu.Unlock()
+		return ErrExists
+	}
+	kem, kemPub, err := newKEM()
+	if err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+	key, err := pqc.NewGroupKey()
+	if err != nil {
+		kem.Clean()
+		rs.mu.Unlock()
+		return err
+	}
+	self := protocol.NewMember(id, KEMAlg, kemPub)
+	r := &room{
+		name:  name,
+		owner: id.UserID,
+		cur: &epoch{
+			n:       1,
+			key:     key,
+			members: []protocol.RoomMember{self},
+			pubs:    map[string][]byte{id.UserID: id.Pub},
+		},
+		kem:     kem,
+		invited: make(map[string]bool),
+	}
+	rs.rooms[name] = r
+	rs.mu.Unlock()
+
+	if err := rs.subscribe(name); err != nil {
+		rs.mu.Lock()
+		delete(rs.rooms, name)
+		r.close()
+		rs.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Invite asks a connected user to join a room we own. The user is added
+// by the commit that follows its answer.
+func (rs *Rooms) Invite(name, userID string) error {
+	id := rs.id()
+
+	rs.mu.Lock()
+	r, err := rs.owned(name, id)
+	if err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+	if _, _, ok := r.cur.member(userID); ok {
+		rs.mu.Unlock()
+		return ErrMember
+	}
+	inv := &protocol.RoomInvite{
+		Type:      "ROOM_INVITE",
+		Room:      r.name,
+		From:      id.UserID,
+		Epoch:     r.cur.n,
+		Timestamp: now(),
+	}
+	f, err := signedFrame(id, inv, &inv.Sig)
+	if err == nil {
+		r.invited[userID] = true
+	}
+	rs.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return rs.send.Send(userID, f)
+}
+
+// Accept answers an invitation to a room with a fresh room KEM key. We
+// join with the commit the owner sends back.
+func (rs *Rooms) Accept(name string) error {
+	name, err := Normalize(name)
+	if err != nil {
+		return err
+	}
+	id := rs.id()
+
+	rs.mu.Lock()
+	inv := rs.invites[name]
+	switch {
+	case inv == nil:
+		rs.mu.Unlock()
+		return ErrNoInvite
+	case rs.rooms[name] != nil:
+		rs.mu.Unlock()
+		return ErrExists
+	}
+	kem, kemPub, err := newKEM()
+	if err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+	j := &protocol.RoomJoin{
+		Type:      "ROOM_JOIN",
+		Room:      name,
+		Member:    protocol.NewMember(id, KEMAlg, kemPub),
+		Timestamp: now(),
+	}
+	f, err := signedFrame(id, j, &j.Sig)
+	if err != nil {
+		kem.Clean()
+		rs.mu.Unlock()
+		return err
+	}
+	if old := rs.pending[name]; old != nil {
+		old.kem.Clean()
+	}
+	delete(rs.invites, name)
+	inv.kem = kem
+	rs.pending[name] = inv
+	rs.mu.Unlock()
+
+	return rs.send.Send(inv.from, f)
+}
+
+// Invitations returns the invitations waiting for Accept, sorted by room.
+func (rs *Rooms) Invitations() []Invitation {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	list := make([]Invitation, 0, len(rs.invites))
+	for name, inv := range rs.invites {
+		list = append(list, Invitation{Room: name, From: inv.from, Pseudo: inv.peer.Pseudo})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Room < list[j].Room })
+	return list
+}
+
+// Kick removes a member from a room we own.
+func (rs *Rooms) Kick(name, userID string) error {
+	id := rs.id()
+
+	rs.mu.Lock()
+	r, err := rs.owned(name, id)
+	if err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+	m, _, ok := r.cur.member(userID)
+	if !ok || userID == id.UserID {
+		rs.mu.Unlock()
+		return ErrNotMember
+	}
+	out, err := rs.commit(r, id, without(r.cur.members, userID), r.owner, nil)
+	rs.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	rs.flush(out)
+	rs.notice(r.name, m.Pseudo+" was removed")
+	return nil
+}
+
+// Leave leaves a room. Members ask the owner to commit them out. An owner
+// names the next member in the list as owner, which commits it out: the
+// group key that follows is never known to us.
+func (rs *Rooms) Leave(name string) error {
+	name, err := Normalize(name)
+	if err != nil {
+		return err
+	}
+	id := rs.id()
+
+	rs.mu.Lock()
+	r := rs.rooms[name]
+	if r == nil {
+		rs.mu.Unlock()
+		return ErrNoRoom
+	}
+
+	var out []outgoing
+	if others := without(r.cur.members, id.UserID); len(others) > 0 {
+		l := &protocol.RoomLeave{
+			Type:      "ROOM_LEAVE",
+			Room:      name,
+			From:      id.UserID,
+			Epoch:     r.cur.n,
+			Timestamp: now(),
+		}
+		to := []string{r.owner}
+		if r.owner == id.UserID {
+			// Everybody learns who to take commits from now
+			l.Owner, to = others[0].UserID, nil
+			for _, m := range others {
+				to = append(to, m.UserID)
+			}
+		}
+		var f *net.Frame
+		if f, err = signedFrame(id, l, &l.Sig); err == nil {
+			for _, userID := range to {
+				out = append(out, outgoing{to: userID, f: f})
+			}
+		}
+	}
+	if err == nil {
+		delete(rs.rooms, name)
+		r.close()
+	}
+	rs.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	rs.unsubscribe(name)
+	rs.flush(out)
+	return nil
+}
+
+// Send encrypts a signed message under the room's group key and sends it
+// to the members, or publishes it on the room's topic.
+func (rs *Rooms) Send(name, body string) error {
+	name, err := Normalize(name)
+	if err != nil {
+		return err
+	}
+	rs.mu.Lock()
+	r := rs.rooms[name]
+	if r == nil {
+		rs.mu.Unlock()
+		return ErrNoRoom
+	}
+	chat, raw, err := protocol.BuildRoomChat(rs.id(), name, r.cur.n, body)
+	if err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+	ctx := protocol.RoomContext(name, r.cur.n)
+	nonce, ct, err := pqc.SealGroupMessage(r.cur.key, raw, ctx)
+	if err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+	msg := &protocol.RoomMessage{
+		Type:  "ROOM_MSG",
+		Room:  name,
+		Epoch: r.cur.n,
+		Nonce: base64.StdEncoding.EncodeToString(nonce),
+		CT:    base64.StdEncoding.EncodeToString(ct),
+	}
+	// Copies flooded back to us are dropped
+	rs.remember(messageKey(chat), chat.Timestamp, time.Now())
+	if rs.topics != nil {
+		rs.mu.Unlock()
+		data, err := protocol.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return rs.topics.Publish(name, data)
+	}
+	out, err := rs.toMembers(r.cur, msg, rs.id().UserID)
+	rs.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	rs.flush(out)
+	return nil
+}
+
+// List returns the rooms we are in, sorted by name.
+func (rs *Rooms) List() []Info {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	list := make([]Info, 0, len(rs.rooms))
+	for _, r := range rs.rooms {
+		list = append(list, r.info())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Get returns the room called name.
+func (rs *Rooms) Get(name string) (Info, bool) {
+	name, err := Normalize(name)
+	if err != nil {
+		return Info{}, false
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r := rs.rooms[name]
+	if r == nil {
+		return Info{}, false
+	}
+	return r.info(), true
+}
+
+// Names returns the names of our rooms, sorted.
+func (rs *Rooms) Names() []string {
+	var names []string
+	for _, info := range rs.List() {
+		names = append(names, info.Name)
+	}
+	return names
+}
+
+// Close leaves nothing behind: group keys and room KEM keys are wiped.
+// Other members are not told.
+func (rs *Rooms) Close() {
+	rs.mu.Lock()
+	var names []string
+	for name, r := range rs.rooms {
+		r.close()
+		delete(rs.rooms, name)
+		names = append(names, name)
+	}
+	for name, inv := range rs.pending {
+		inv.kem.Clean()
+		delete(rs.pending, name)
+	}
+	clear(rs.invites)
+	rs.mu.Unlock()
+
+	for _, name := range names {
+		rs.unsubscribe(name)
+	}
+}
+
+func (r *room) info() Info {
+	return Info{
+		Name:    r.name,
+		Owner:   r.owner,
+		Epoch:   r.cur.n,
+		Members: slices.Clone(r.cur.members),
+	}
+}
+
+// owned returns the room called name if we own it.
+func (rs *Rooms) owned(name string, id *pqc.Identity) (*room, error) {
+	name, err := Normalize(name)
+	if err != nil {
+		return nil, err
+	}
+	r := rs.rooms[name]
+	if r == nil {
+		return nil, ErrNoRoom
+	}
+	if r.owner != id.UserID {
+		return nil, ErrNotOwner
+	}
+	return r, nil
+}
+
+// commit starts the next epoch of r with the given members and owner, and
+// returns the frames telling the old and new members. A commit following
+// a handover carries it, for members who have not seen it yet.
+func (rs *Rooms) commit(r *room, id *pqc.Identity, members []protocol.RoomMember, owner string, handover *protocol.RoomLeave) ([]outgoing, error) {
+	key, err := pqc.NewGroupKey()
+	if err != nil {
+		return nil, err
+	}
+	c := &protocol.RoomCommit{
+		Type:      "ROOM_COMMIT",
+		Room:      r.name,
+		Epoch:     r.cur.n + 1,
+		Owner:     owner,
+		Members:   members,
+		Handover:  handover,
+		Timestamp: now(),
+	}
+	next := &epoch{n: c.Epoch, key: key, members: members, pubs: make(map[string][]byte)}
+	ctx := protocol.RoomContext(r.name, c.Epoch)
+	for _, m := range members {
+		pub, kemPub, err := m.Keys()
+		if err != nil {
+			return nil, err
+		}
+		next.pubs[m.UserID] = pub
+		if m.UserID == id.UserID {
+			continue
+		}
+		ct, wrapped, err := pqc.WrapGroupKey(m.KEMAlg, kemPub, key, ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.Welcomes = append(c.Welcomes, protocol.RoomWelcome{
+			UserID: m.UserID,
+			CT:     base64.StdEncoding.EncodeToString(ct),
+			Key:    base64.StdEncoding.EncodeToString(wrapped),
+		})
+	}
+	f, err := signedFrame(id, c, &c.Sig)
+	if err != nil {
+		return nil, err
+	}
+
+	// Removed members learn about it too
+	var out []outgoing
+	for _, m := range append(slices.Clone(r.cur.members), members...) {
+		if m.UserID != id.UserID && !slices.ContainsFunc(out, func(o outgoing) bool { return o.to == m.UserID }) {
+			out = append(out, outgoing{to: m.UserID, f: f})
+		}
+	}
+
+	for _, m := range members {
+		delete(r.invited, m.UserID)
+	}
+	r.advance(next, owner)
+	return out, nil
+}
+
+// advance makes next the current epoch of r.
+func (r *room) advance(next *epoch, owner string) {
+	if r.prev != nil {
+		r.prev.wipe()
+	}
+	r.prev, r.cur = r.cur, next
+	r.owner = owner
+}
+
+// toMembers returns the frames sending msg to the members of e, but for
+// the users in skip.
+func (rs *Rooms) toMembers(e *epoch, msg any, skip ...string) ([]outgoing, error) {
+	raw, err := protocol.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	f := &net.Frame{Type: net.FrameRoom, Payload: raw}
+	var out []outgoing
+	for _, m := range e.members {
+		if !slices.Contains(skip, m.UserID) {
+			out = append(out, outgoing{to: m.UserID, f: f})
+		}
+	}
+	return out, nil
+}
+
+// flush sends frames. Members we have no session with are reached by
+// flooding, so failures are ignored.
+func (rs *Rooms) flush(out []outgoing) {
+	for _, o := range out {
+		_ = rs.send.Send(o.to, o.f)
+	}
+}
+
+// remember records a room message signed at ts, forgetting those too old
+// to be accepted anyway. When as many recent ones are remembered, it
+// reports false rather than forget one. rs.mu is held.
+func (rs *Rooms) remember(key string, ts int64, now time.Time) bool {
+	if len(rs.seen) >= maxSeen {
+		oldest := now.Add(-maxMessageAge).Unix()
+		for k, t := range rs.seen {
+			if t < oldest {
+				delete(rs.seen, k)
+			}
+		}
+		if len(rs.seen) >= maxSeen {
+			return false
+		}
+	}
+	rs.seen[key] = ts
+	return true
+}
+
+// messageKey tells room messages apart by their signed CHAT, whatever the
+// nonce and epoch they were sealed with.
+func messageKey(msg *protocol.ChatMessage) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%s", msg.From, msg.Timestamp, msg.Sig)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (rs *Rooms) notice(room, text string) {
+	if rs.on.Notice != nil {
+		rs.on.Notice(room, text)
+	}
+}
+
+func newKEM() (*pqc.KEM, []byte, error) {
+	kem, err := pqc.NewKEMWith(KEMAlg)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := kem.Keygen()
+	if err != nil {
+		kem.Clean()
+		return nil, nil, err
+	}
+	return kem, pub, nil
+}
+
+// signedFrame signs msg and returns it as a room frame.
+func signedFrame(id *pqc.Identity, msg any, sig *string) (*net.Frame, error) {
+	if err := protocol.Sign(id, msg, sig); err != nil {
+		return nil, err
+	}
+	raw, err := protocol.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &net.Frame{Type: net.FrameRoom, Payload: raw}, nil
+}
+
+func without(members []protocol.RoomMember, userID string) []protocol.RoomMember {
+	return slices.DeleteFunc(slices.Clone(members), func(m protocol.RoomMember) bool {
+		return m.UserID == userID
+	})
+}
@@ -0,0 +1,363 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package room
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"pqchat/src/internal/net"
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/protocol"
+)
+
+// testNet connects users as if they all had sessions with each other.
+// Frames are queued and delivered by run, unless drop says otherwise.
+type testNet struct {
+	t     *testing.T
+	ids   map[string]*pqc.Identity
+	rooms map[string]*Rooms
+	got   map[string][]string // user ID → room message bodies
+	queue []delivery
+	drop  func(d delivery) bool
+}
+
+type delivery struct {
+	from, to string
+	typ      string
+	payload  []byte
+}
+
+type sender struct {
+	n    *testNet
+	from string
+}
+
+func (s sender) Send(userID string, f *net.Frame) error {
+	typ, _ := protocol.MessageType(f.Payload)
+	s.n.queue = append(s.n.queue, delivery{s.from, userID, typ, f.Payload})
+	return nil
+}
+
+func newTestNet(t *testing.T, pseudos ...string) (*testNet, []*pqc.Identity) {
+	n := &testNet{
+		t:     t,
+		ids:   make(map[string]*pqc.Identity),
+		rooms: make(map[string]*Rooms),
+		got:   make(map[string][]string),
+	}
+	lookup := func(userID string) (Peer, bool) {
+		id, ok := n.ids[userID]
+		if !ok {
+			return Peer{}, false
+		}
+		return Peer{Pseudo: id.Pseudo, Alg: id.Alg, Pub: id.Pub}, true
+	}
+	var ids []*pqc.Identity
+	for _, pseudo := range pseudos {
+		id, err := pqc.NewIdentity(pseudo, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.ids[id.UserID] = id
+		rs := New(func() *pqc.Identity { return id }, sender{n, id.UserID}, lookup, Handlers{
+			Message: func(msg *protocol.ChatMessage) { n.got[id.UserID] = append(n.got[id.UserID], msg.Body) },
+		})
+		n.rooms[id.UserID] = rs
+		ids = append(ids, id)
+		t.Cleanup(func() {
+			rs.Close()
+			id.Close()
+		})
+	}
+	return n, ids
+}
+
+// run delivers the queued frames, and those they cause, in order.
+func (n *testNet) run() {
+	for len(n.queue) > 0 {
+		d := n.queue[0]
+		n.queue = n.queue[1:]
+		if n.drop != nil && n.drop(d) {
+			continue
+		}
+		if err := n.rooms[d.to].Handle(d.from, d.payload); err != nil {
+			n.t.Errorf("%s from %s to %s: %v", d.typ, n.ids[d.from].Pseudo, n.ids[d.to].Pseudo, err)
+		}
+	}
+}
+
+// join has owner invite user to a room, and user accept.
+func (n *testNet) join(owner, user *pqc.Identity, name string) {
+	n.t.Helper()
+	if err := n.rooms[owner.UserID].Invite(name, user.UserID); err != nil {
+		n.t.Fatal(err)
+	}
+	n.run()
+	if err := n.rooms[user.UserID].Accept(name); err != nil {
+		n.t.Fatal(err)
+	}
+	n.run()
+}
+
+// room returns the state of a room at user.
+func (n *testNet) room(user *pqc.Identity, name string) (*room, bool) {
+	rs := n.rooms[user.UserID]
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r, ok := rs.rooms[name]
+	return r, ok
+}
+
+func TestOwnerLeave(t *testing.T) {
+	for _, overtaken := range []bool{false, true} {
+		n, ids := newTestNet(t, "alice", "bob", "carol")
+		alice, bob, carol := ids[0], ids[1], ids[2]
+		if err := n.rooms[alice.UserID].Create("proj"); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []*pqc.Identity{bob, carol} {
+			n.join(alice, id, "proj")
+		}
+		before, _ := n.room(alice, "proj")
+		oldKey := bytes.Clone(before.cur.key)
+
+		if overtaken {
+			// Carol only hears of the handover through the commit
+			n.drop = func(d delivery) bool { return d.typ == "ROOM_LEAVE" && d.to == carol.UserID }
+		}
+		if err := n.rooms[alice.UserID].Leave("proj"); err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range n.queue {
+			if d.typ != "ROOM_LEAVE" {
+				t.Errorf("overtaken %v: leaving owner sent %s", overtaken, d.typ)
+			}
+		}
+		n.run()
+
+		if _, ok := n.room(alice, "proj"); ok {
+			t.Fatalf("overtaken %v: alice still in the room", overtaken)
+		}
+		rb, ok1 := n.room(bob, "proj")
+		rc, ok2 := n.room(carol, "proj")
+		if !ok1 || !ok2 {
+			t.Fatalf("overtaken %v: bob or carol out of the room", overtaken)
+		}
+		for _, r := range []*room{rb, rc} {
+			if r.owner != bob.UserID || r.cur.n != 4 || len(r.cur.members) != 2 {
+				t.Errorf("overtaken %v: owner %s, epoch %d, %d members", overtaken, n.ids[r.owner].Pseudo, r.cur.n, len(r.cur.members))
+			}
+			if _, _, ok := r.cur.member(alice.UserID); ok {
+				t.Errorf("overtaken %v: alice still a member", overtaken)
+			}
+			if bytes.Equal(r.cur.key, oldKey) {
+				t.Errorf("overtaken %v: group key not renewed", overtaken)
+			}
+		}
+		if !bytes.Equal(rb.cur.key, rc.cur.key) {
+			t.Errorf("overtaken %v: bob and carol have different group keys", overtaken)
+		}
+
+		if err := n.rooms[carol.UserID].Send("proj", "hi"); err != nil {
+			t.Fatal(err)
+		}
+		n.run()
+		if got := n.got[bob.UserID]; len(got) != 1 || got[0] != "hi" {
+			t.Errorf("overtaken %v: bob got %q", overtaken, got)
+		}
+	}
+}
+
+func TestHandoverChecked(t *testing.T) {
+	n, ids := newTestNet(t, "alice", "bob", "carol")
+	alice, bob, carol := ids[0], ids[1], ids[2]
+	if err := n.rooms[alice.UserID].Create("proj"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []*pqc.Identity{bob, carol} {
+		n.join(alice, id, "proj")
+	}
+
+	// Carol is no owner, she cannot hand the room to herself
+	l := &protocol.RoomLeave{Type: "ROOM_LEAVE", Room: "proj", From: carol.UserID, Owner: carol.UserID, Epoch: 3, Timestamp: now()}
+	f, err := signedFrame(carol, l, &l.Sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = n.rooms[bob.UserID].Handle(carol.UserID, f.Payload)
+	if r, _ := n.room(bob, "proj"); r.owner != alice.UserID {
+		t.Errorf("owner is %s after a forged handover", n.ids[r.owner].Pseudo)
+	}
+
+	// Nor can she forge a commit with a handover
+	r, _ := n.room(carol, "proj")
+	l = &protocol.RoomLeave{Type: "ROOM_LEAVE", Room: "proj", From: alice.UserID, Owner: carol.UserID, Epoch: 3, Timestamp: now()}
+	if _, err := signedFrame(carol, l, &l.Sig); err != nil {
+		t.Fatal(err)
+	}
+	rs := n.rooms[carol.UserID]
+	rs.mu.Lock()
+	out, err := rs.commit(r, carol, without(r.cur.members, alice.UserID), carol.UserID, l)
+	rs.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range out {
+		if o.to == bob.UserID {
+			if err := n.rooms[bob.UserID].Handle(carol.UserID, o.f.Payload); err == nil {
+				t.Error("commit with a forged handover accepted")
+			}
+		}
+	}
+	if r, _ := n.room(bob, "proj"); r.cur.n != 3 {
+		t.Errorf("bob at epoch %d, want 3", r.cur.n)
+	}
+}
+
+func TestInviteAccept(t *testing.T) {
+	n, ids := newTestNet(t, "alice", "bob")
+	alice, bob := ids[0], ids[1]
+	if err := n.rooms[alice.UserID].Create("proj"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.rooms[bob.UserID].Accept("proj"); !errors.Is(err, ErrNoInvite) {
+		t.Errorf("accept without an invitation: got %v, want %v", err, ErrNoInvite)
+	}
+
+	if err := n.rooms[alice.UserID].Invite("proj", bob.UserID); err != nil {
+		t.Fatal(err)
+	}
+	n.run()
+	if len(n.queue) != 0 {
+		t.Errorf("invitation answered before being accepted")
+	}
+	if _, ok := n.room(bob, "proj"); ok {
+		t.Fatal("joined before accepting")
+	}
+	invites := n.rooms[bob.UserID].Invitations()
+	if len(invites) != 1 || invites[0].Room != "proj" || invites[0].From != alice.UserID {
+		t.Fatalf("invitations %+v", invites)
+	}
+
+	if err := n.rooms[bob.UserID].Accept("#Proj"); err != nil {
+		t.Fatal(err)
+	}
+	n.run()
+	if r, ok := n.room(bob, "proj"); !ok || r.cur.n != 2 || len(r.cur.members) != 2 {
+		t.Fatalf("bob not in the room after accepting")
+	}
+	if len(n.rooms[bob.UserID].Invitations()) != 0 {
+		t.Error("invitation still waiting once accepted")
+	}
+	if err := n.rooms[bob.UserID].Accept("proj"); !errors.Is(err, ErrNoInvite) {
+		t.Errorf("second accept: got %v, want %v", err, ErrNoInvite)
+	}
+}
+
+func TestMessageReplay(t *testing.T) {
+	n, ids := newTestNet(t, "alice", "bob", "carol", "dave")
+	alice, bob, carol, dave := ids[0], ids[1], ids[2], ids[3]
+	if err := n.rooms[alice.UserID].Create("proj"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []*pqc.Identity{bob, carol} {
+		n.join(alice, id, "proj")
+	}
+
+	// Bob keeps what alice sends him
+	var sent []byte
+	n.drop = func(d delivery) bool {
+		if d.typ == "ROOM_MSG" && d.from == alice.UserID && d.to == bob.UserID {
+			sent = d.payload
+		}
+		return false
+	}
+	if err := n.rooms[alice.UserID].Send("proj", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	n.run()
+	n.drop = nil
+	var m protocol.RoomMessage
+	if err := protocol.Unmarshal(sent, &m); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := n.room(bob, "proj")
+	nonce, _ := base64.StdEncoding.DecodeString(m.Nonce)
+	ct, _ := base64.StdEncoding.DecodeString(m.CT)
+	chat, err := pqc.OpenGroupMessage(r.cur.key, nonce, ct, protocol.RoomContext("proj", m.Epoch))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// seal has bob seal a CHAT to carol under the current group key
+	seal := func(chat []byte) []byte {
+		t.Helper()
+		r, _ := n.room(bob, "proj")
+		nonce, ct, err := pqc.SealGroupMessage(r.cur.key, chat, protocol.RoomContext("proj", r.cur.n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := protocol.Marshal(&protocol.RoomMessage{
+			Type:  "ROOM_MSG",
+			Room:  "proj",
+			Epoch: r.cur.n,
+			Nonce: base64.StdEncoding.EncodeToString(nonce),
+			CT:    base64.StdEncoding.EncodeToString(ct),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	old := &protocol.ChatMessage{Type: "CHAT", From: alice.UserID, Room: "proj", Epoch: r.cur.n, Body: "old", Timestamp: time.Now().Add(-time.Hour).Unix()}
+	if err := protocol.Sign(alice, old, &old.Sig); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := protocol.Marshal(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+		err     error
+	}{
+		{"same frame", sent, nil},
+		{"sealed again", seal(chat), nil},
+		{"signed an hour ago", seal(stale), ErrStale},
+	}
+	for _, tt := range tests {
+		if err := n.rooms[carol.UserID].Handle(bob.UserID, tt.payload); !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	// Nor in a later epoch, which the CHAT does not name
+	n.join(alice, dave, "proj")
+	if err := n.rooms[carol.UserID].Handle(bob.UserID, seal(chat)); !errors.Is(err, ErrUnexpected) {
+		t.Errorf("next epoch: got %v, want %v", err, ErrUnexpected)
+	}
+	if err := n.rooms[dave.UserID].Handle(bob.UserID, seal(chat)); !errors.Is(err, ErrUnexpected) {
+		t.Errorf("next epoch, new member: got %v, want %v", err, ErrUnexpected)
+	}
+	n.run()
+	if got := n.got[carol.UserID]; len(got) != 1 || got[0] != "hi" {
+		t.Errorf("carol got %q", got)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package room
+
+import (
+	"fmt"
+
+	"pqchat/src/internal/net"
+	"pqchat/src/internal/protocol"
+)
+
+// Topics carries room messages on one pubsub topic per room, such as
+// net.Gossip, instead of sending them over every session. Invites, joins
+// and commits still go over the sessions.
+type Topics interface {
+	Join(room string, validate net.Validate, deliver func(v any)) error
+	Publish(room string, data []byte) error
+	Leave(room string)
+}
+
+// UseTopics sends room messages over t. It must be called before any room
+// is created or joined; every member of a room has to use the same topics.
+func (rs *Rooms) UseTopics(t Topics) {
+	rs.topics = t
+}
+
+// subscribe joins the topic of a room, if any.
+func (rs *Rooms) subscribe(name string) error {
+	if rs.topics == nil {
+		return nil
+	}
+	return rs.topics.Join(name, rs.validator(name), rs.deliver)
+}
+
+func (rs *Rooms) unsubscribe(name string) {
+	if rs.topics != nil {
+		rs.topics.Leave(name)
+	}
+}
+
+// validator checks a room message like handleMessage does, before the
+// topic delivers or forwards it. Messages of an epoch we do not have are
+// ignored rather than rejected: commits may come after messages.
+func (rs *Rooms) validator(name string) net.Validate {
+	return func(data []byte) (any, error) {
+		var m protocol.RoomMessage
+		if err := protocol.Unmarshal(data, &m); err != nil || m.Type != "ROOM_MSG" {
+			return nil, protocol.ErrRoomEncoding
+		}
+		if m.Room != name {
+			return nil, ErrUnexpected
+		}
+
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		r := rs.rooms[name]
+		if r == nil {
+			return nil, net.ErrIgnore
+		}
+		e := r.cur
+		if r.prev != nil && m.Epoch == r.prev.n {
+			e = r.prev
+		}
+		if m.Epoch != e.n {
+			return nil, fmt.Errorf("%w: %w", net.ErrIgnore, ErrEpoch)
+		}
+		msg, err := rs.openMessage(e, &m)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			return nil, net.ErrIgnore
+		}
+		return msg, nil
+	}
+}
+
+func (rs *Rooms) deliver(v any) {
+	if msg, ok := v.(*protocol.ChatMessage); ok && rs.on.Message != nil {
+		rs.on.Message(msg)
+	}
+}
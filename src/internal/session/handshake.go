@@ -14,96 +14,316 @@
 package session
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"slices"
 
 	p2pnet "github.com/libp2p/go-libp2p/core/network"
 
 	"pqchat/src/internal/net"
 	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/protocol"
+)
+
+var (
+	ErrUnexpectedFrame = errors.New("session: unexpected frame")
+	ErrPeerMismatch    = errors.New("session: HELLO from another libp2p peer")
+	ErrHelloAlg        = errors.New("session: HELLO identity algorithm is not the negotiated one")
 )
 
 // This executes the ML-KEM handshake on the server side
-// (the peer who receives the stream first).
-func ServerHandshake(s p2pnet.Stream) (*Session, error) {
-	// Generate the ML-KEM keypair
-	kem, err := pqc.NewKEM()
+// (the peer who receives the stream first). A nil cfg means DefaultConfig.
+func ServerHandshake(s p2pnet.Stream, id *pqc.Identity, cfg *Config) (*Session, error) {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	th := newTranscript()
+	th.add([]byte(s.Protocol()))
+
+	// Offer the suites allowed by our policy. The stream is read directly
+	// (no bufio) so that nothing sent after the handshake gets swallowed.
+	offer, err := newSuiteOffer(cfg, id)
+	if err != nil {
+		return nil, err
+	}
+	offerRaw := offer.encode()
+	if err := writeHandshake(s, offerRaw); err != nil {
+		return nil, fmt.Errorf("send suite offer: %w", err)
+	}
+	th.add(offerRaw)
+
+	// Receive the client's choice
+	choiceRaw, err := readHandshake(s)
+	if err != nil {
+		return nil, fmt.Errorf("recv suite choice: %w", err)
+	}
+	choice, err := decodeSuiteSelect(choiceRaw)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(offer.kex, choice.kex) {
+		return nil, ErrNoCommonKex
+	}
+	if !slices.Contains(offer.sigs, choice.ownSig) {
+		return nil, fmt.Errorf("%w: %s", ErrSigRefused, choice.ownSig)
+	}
+	mode := choice.kex
+	th.add(choiceRaw)
+
+	// Generate the KEM keypair
+	kem, err := pqc.NewKEMWith(mode.kem())
 	if err != nil {
 		return nil, fmt.Errorf("new kem: %w", err)
 	}
 	defer kem.Clean()
 
-	// Keygen returns (pub, priv, err) - priv is stored in kem and used by Decapsulate
-	pub, _, err := kem.Keygen()
+	// The secret key stays in kem, used by Decapsulate and wiped by Clean
+	pub, err := kem.Keygen()
 	if err != nil {
 		return nil, fmt.Errorf("kem keygen: %w", err)
 	}
 
-	// Send the public key to the client
-	if err := net.WriteFrame(s, pub); err != nil {
+	// Send the public key(s) to the client
+	if err := writeHandshake(s, pub); err != nil {
 		return nil, fmt.Errorf("send pub: %w", err)
 	}
+	th.add(pub)
+
+	var x *pqc.X25519
+	if mode.hybrid() {
+		if x, err = pqc.NewX25519(); err != nil {
+			return nil, fmt.Errorf("x25519 keygen: %w", err)
+		}
+		if err := writeHandshake(s, x.Pub()); err != nil {
+			return nil, fmt.Errorf("send x25519 pub: %w", err)
+		}
+		th.add(x.Pub())
+	}
 
 	// Receive the ciphertext from the client
-	rd := bufio.NewReader(s)
-	ct, err := net.ReadFrame(rd)
+	ct, err := readHandshake(s)
 	if err != nil {
 		return nil, fmt.Errorf("recv ct: %w", err)
 	}
+	th.add(ct)
 
 	// Decapsulate the shared secret (uses the priv key stored in kem)
 	ss, err := kem.Decapsulate(ct)
 	if err != nil {
 		return nil, fmt.Errorf("kem decaps: %w", err)
 	}
+	defer func() { pqc.Wipe(ss) }()
 
-	// Derive the AES-GCM key
-	key, err := pqc.DeriveKey(ss, []byte("pqchat-handshake"))
-	if err != nil {
-		return nil, fmt.Errorf("derive key: %w", err)
+	if mode.hybrid() {
+		clientX, err := readHandshake(s)
+		if err != nil {
+			return nil, fmt.Errorf("recv x25519 pub: %w", err)
+		}
+		th.add(clientX)
+
+		xss, err := x.SharedSecret(clientX)
+		if err != nil {
+			return nil, fmt.Errorf("x25519: %w", err)
+		}
+		ss = pqc.CombineSecrets(ss, xss)
 	}
 
-	// Create the AES-GCM instance
-	aesgcm, err := pqc.NewAESGCM(key)
+	// Start the session ratchet, bound to the whole transcript
+	th.addPeers(s.Conn().LocalPeer(), s.Conn().RemotePeer())
+	sess, err := newSession(ss, th.sum(), true, cfg.Rekey, mode.kem())
 	if err != nil {
-		return nil, fmt.Errorf("new aesgcm: %w", err)
+		return nil, fmt.Errorf("derive keys: %w", err)
+	}
+	sess.Protocol = s.Protocol()
+	sess.Kex = mode
+	sess.RemoteSigAlg = choice.ownSig.String()
+
+	// Authenticate: send our HELLO first, then check the client's one
+
+	if err := sess.sendHello(s, id); err != nil {
+		sess.Close()
+		return nil, err
+	}
+	if err := sess.recvHello(s); err != nil {
+		sess.Close()
+		return nil, err
 	}
 
-	return &Session{Cipher: aesgcm}, nil
+	return sess, nil
 }
 
 // ClientHandshake executes the ML-KEM handshake on the client side
-// (the peer who initiates the stream).
-func ClientHandshake(s p2pnet.Stream) (*Session, error) {
-	rd := bufio.NewReader(s)
+// (the peer who initiates the stream). A nil cfg means DefaultConfig.
+func ClientHandshake(s p2pnet.Stream, id *pqc.Identity, cfg *Config) (*Session, error) {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	th := newTranscript()
+	th.add([]byte(s.Protocol()))
 
-	// 1. Receive the server's public key
-	pub, err := net.ReadFrame(rd)
+	// 1. Receive the server's suite offer and pick suites from it
+	offerRaw, err := readHandshake(s)
+	if err != nil {
+		return nil, fmt.Errorf("recv suite offer: %w", err)
+	}
+	th.add(offerRaw)
+	offer, err := decodeSuiteOffer(offerRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	choice, err := selectSuite(cfg, id, offer)
+	if err != nil {
+		return nil, err
+	}
+	choiceRaw := choice.encode()
+	if err := writeHandshake(s, choiceRaw); err != nil {
+		return nil, fmt.Errorf("send suite choice: %w", err)
+	}
+	th.add(choiceRaw)
+	mode := choice.kex
+
+	// 2. Receive the server's public key(s)
+	pub, err := readHandshake(s)
 	if err != nil {
 		return nil, fmt.Errorf("recv pub: %w", err)
 	}
+	th.add(pub)
+
+	var serverX []byte
+	if mode.hybrid() {
+		if serverX, err = readHandshake(s); err != nil {
+			return nil, fmt.Errorf("recv x25519 pub: %w", err)
+		}
+		th.add(serverX)
+	}
 
-	// 2. Encapsulate → ciphertext + shared secret
-	ct, ss, err := pqc.Encapsulate(pub)
+	// 3. Encapsulate → ciphertext + shared secret
+	ct, ss, err := pqc.EncapsulateWith(mode.kem(), pub)
 	if err != nil {
 		return nil, fmt.Errorf("kem encaps: %w", err)
 	}
+	defer func() { pqc.Wipe(ss) }()
 
-	// 3. Send the ciphertext to the server
-	if err := net.WriteFrame(s, ct); err != nil {
+	// 4. Send the ciphertext to the server
+	if err := writeHandshake(s, ct); err != nil {
 		return nil, fmt.Errorf("send ct: %w", err)
 	}
+	th.add(ct)
+
+	// 5. In hybrid mode, send our X25519 key and combine both shared secrets
+	if mode.hybrid() {
+		x, err := pqc.NewX25519()
+		if err != nil {
+			return nil, fmt.Errorf("x25519 keygen: %w", err)
+		}
+		if err := writeHandshake(s, x.Pub()); err != nil {
+			return nil, fmt.Errorf("send x25519 pub: %w", err)
+		}
+		th.add(x.Pub())
+
+		xss, err := x.SharedSecret(serverX)
+		if err != nil {
+			return nil, fmt.Errorf("x25519: %w", err)
+		}
+		ss = pqc.CombineSecrets(ss, xss)
+	}
 
-	// 4. Dérive la clé AES-GCM à partir du shared secret
-	key, err := pqc.DeriveKey(ss, []byte("pqchat-handshake"))
+	th.addPeers(s.Conn().RemotePeer(), s.Conn().LocalPeer())
+	sess, err := newSession(ss, th.sum(), false, cfg.Rekey, mode.kem())
 	if err != nil {
-		return nil, fmt.Errorf("derive key: %w", err)
+		return nil, fmt.Errorf("derive keys: %w", err)
 	}
+	sess.Protocol = s.Protocol()
+	sess.Kex = mode
+	sess.RemoteSigAlg = offer.ownSig.String()
 
-	aesgcm, err := pqc.NewAESGCM(key)
+	// 6. Authenticate: check the server's HELLO, then send ours
+
+	if err := sess.recvHello(s); err != nil {
+		sess.Close()
+		return nil, err
+	}
+	if err := sess.sendHello(s, id); err != nil {
+		sess.Close()
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+// sendHello sends our HELLO, signed over the handshake transcript and
+// encrypted with the new session key.
+func (sess *Session) sendHello(s p2pnet.Stream, id *pqc.Identity) error {
+	_, raw, err := protocol.BuildHello(id, s.Conn().LocalPeer().String(), sess.Transcript)
 	if err != nil {
-		return nil, fmt.Errorf("new aesgcm: %w", err)
+		return fmt.Errorf("build hello: %w", err)
+	}
+	if err := sess.Send(s, &net.Frame{Type: net.FrameHello, Payload: raw}); err != nil {
+		return fmt.Errorf("send hello: %w", err)
 	}
+	return nil
+}
+
+// recvHello reads the remote HELLO and aborts unless its signature is valid
+// for this transcript and it comes from the libp2p peer at the other end.
+func (sess *Session) recvHello(s p2pnet.Stream) error {
+	var raw []byte
+	for {
+		f, err := sess.Recv(s)
+		if err != nil {
+			return fmt.Errorf("recv hello: %w", err)
+		}
+		if f.Type == net.FrameHello {
+			raw = f.Payload
+			break
+		}
+		if f.Type.Known() {
+			return fmt.Errorf("%w: %s frame before hello", ErrUnexpectedFrame, f.Type)
+		}
+	}
+
+	var hello protocol.HelloMessage
+	if err := protocol.Unmarshal(raw, &hello); err != nil {
+		return fmt.Errorf("parse hello: %w", err)
+	}
+	pub, err := protocol.VerifyHello(&hello, sess.Transcript)
+	if err != nil {
+		return fmt.Errorf("verify hello: %w", err)
+	}
+	if hello.PeerID != s.Conn().RemotePeer().String() {
+		return fmt.Errorf("verify hello: %w", ErrPeerMismatch)
+	}
+	if hello.SigAlg() != sess.RemoteSigAlg {
+		return fmt.Errorf("verify hello: %w: %s, %s was negotiated", ErrHelloAlg, hello.SigAlg(), sess.RemoteSigAlg)
+	}
+
+	sess.RemoteUserID = hello.UserID
+	sess.RemotePseudo = hello.Pseudo
+	sess.RemotePub = pub
+	sess.RemotePeer = s.Conn().RemotePeer()
+	return nil
+}
 
-	return &Session{Cipher: aesgcm}, nil
+// writeHandshake sends one handshake message, in clear.
+func writeHandshake(w io.Writer, data []byte) error {
+	return net.Send(w, &net.Frame{Type: net.FrameHandshake, Payload: data})
+}
+
+// readHandshake reads the next handshake message, skipping frames of
+// unknown types.
+func readHandshake(rd io.Reader) ([]byte, error) {
+	for {
+		f, err := net.Recv(rd)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case f.Type == net.FrameHandshake && !f.Encrypted():
+			return f.Payload, nil
+		case f.Type.Known():
+			return nil, fmt.Errorf("%w: %s frame during handshake", ErrUnexpectedFrame, f.Type)
+		}
+	}
 }
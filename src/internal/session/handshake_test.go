@@ -0,0 +1,272 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	p2pnet "github.com/libp2p/go-libp2p/core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	"pqchat/src/internal/net"
+	"pqchat/src/internal/pqc"
+	"pqchat/src/internal/protocol"
+)
+
+// streamPair opens a stream between two mocknet hosts, and returns both
+// ends with the hosts.
+func streamPair(t *testing.T) (client, server p2pnet.Stream, ch, sh host.Host) {
+	t.Helper()
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = mn.Close() })
+	ch, sh = mn.Hosts()[0], mn.Hosts()[1]
+	pid := net.Versions()[0].ID()
+	accepted := make(chan p2pnet.Stream, 1)
+	sh.SetStreamHandler(pid, func(s p2pnet.Stream) { accepted <- s })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err = ch.NewStream(ctx, sh.ID(), pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server learns of the stream once we write
+	if err := writeHandshake(client, []byte("open")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case server = <-accepted:
+	case <-ctx.Done():
+		t.Fatal("stream never reached the server")
+	}
+	if _, err := readHandshake(server); err != nil {
+		t.Fatal(err)
+	}
+	return client, server, ch, sh
+}
+
+// handshake runs both sides of the handshake with their identities and
+// policies, and returns their errors. Either side resets the stream when
+// it fails, so that the other one stops too.
+func handshake(t *testing.T, clientID, serverID *pqc.Identity, clientCfg, serverCfg *Config) (clientErr, serverErr error) {
+	t.Helper()
+	client, server, _, _ := streamPair(t)
+	done := make(chan error, 1)
+	go func() {
+		sess, err := ServerHandshake(server, serverID, serverCfg)
+		if err != nil {
+			_ = server.Reset()
+		} else {
+			sess.Close()
+		}
+		done <- err
+	}()
+	sess, err := ClientHandshake(client, clientID, clientCfg)
+	if err != nil {
+		_ = client.Reset()
+	} else {
+		if sess.RemoteUserID != serverID.UserID {
+			t.Errorf("client authenticated %s, want %s", sess.RemoteUserID, serverID.UserID)
+		}
+		sess.Close()
+	}
+	return err, <-done
+}
+
+func TestHandshakeSuites(t *testing.T) {
+	alice, err := pqc.NewIdentity("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := pqc.NewIdentity("bob", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	// with returns the default policy, changed by fn
+	with := func(fn func(c *Config)) *Config {
+		c := DefaultConfig()
+		fn(c)
+		return c
+	}
+	// The client is the first to find out, the server then sees the stream reset
+	tests := []struct {
+		name           string
+		client, server *Config
+		err            error
+	}{
+		{"defaults", nil, nil, nil},
+		{"no common key exchange",
+			with(func(c *Config) { c.KexModes = []KexMode{KexX25519MLKEM768} }),
+			with(func(c *Config) { c.KexModes = []KexMode{KexMLKEM768} }),
+			ErrNoCommonKex},
+		{"server identity refused",
+			with(func(c *Config) { c.SigAlgs = []string{"ML-DSA-87"} }), nil,
+			ErrSigRefused},
+		{"client identity refused",
+			nil, with(func(c *Config) { c.SigAlgs = []string{"ML-DSA-87"} }),
+			ErrOwnSigRefused},
+	}
+	for _, tt := range tests {
+		clientErr, serverErr := handshake(t, alice, bob, tt.client, tt.server)
+		if !errors.Is(clientErr, tt.err) || (tt.err == nil && clientErr != nil) {
+			t.Errorf("%s: client got %v, want %v", tt.name, clientErr, tt.err)
+		}
+		if tt.err == nil && serverErr != nil {
+			t.Errorf("%s: server got %v", tt.name, serverErr)
+		}
+	}
+}
+
+// A client which does not follow the offer is stopped by the server.
+func TestHandshakeForgedChoice(t *testing.T) {
+	bob, err := pqc.NewIdentity("bob", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	weak, _ := sigSuiteOf("ML-DSA-44") // below the default level
+	own, _ := sigSuiteOf(bob.Alg)
+
+	tests := []struct {
+		name   string
+		choice func(o *suiteOffer) *suiteSelect
+		err    error
+	}{
+		{"key exchange not offered",
+			func(o *suiteOffer) *suiteSelect { return &suiteSelect{kex: KexMLKEM512, ownSig: own} },
+			ErrNoCommonKex},
+		{"signature not offered",
+			func(o *suiteOffer) *suiteSelect { return &suiteSelect{kex: o.kex[0], ownSig: weak} },
+			ErrSigRefused},
+	}
+	for _, tt := range tests {
+		client, server, _, _ := streamPair(t)
+		done := make(chan error, 1)
+		go func() {
+			_, err := ServerHandshake(server, bob, nil)
+			done <- err
+		}()
+		raw, err := readHandshake(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offer, err := decodeSuiteOffer(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeHandshake(client, tt.choice(offer).encode()); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestRecvHello(t *testing.T) {
+	alice, err := pqc.NewIdentity("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	transcript := []byte("transcript")
+
+	// hello returns a HELLO from alice, changed by edit once signed
+	hello := func(peerID string, transcript []byte, edit func(h *protocol.HelloMessage)) *net.Frame {
+		t.Helper()
+		h, raw, err := protocol.BuildHello(alice, peerID, transcript)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if edit != nil {
+			edit(h)
+			if raw, err = protocol.Marshal(h); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &net.Frame{Type: net.FrameHello, Payload: raw}
+	}
+
+	tests := []struct {
+		name   string
+		frames func(alicePeer string) []*net.Frame
+		alg    string // negotiated for alice
+		err    error
+	}{
+		{"valid", func(p string) []*net.Frame {
+			return []*net.Frame{hello(p, transcript, nil)}
+		}, alice.Alg, nil},
+		{"tampered", func(p string) []*net.Frame {
+			return []*net.Frame{hello(p, transcript, func(h *protocol.HelloMessage) { h.Pseudo = "mallory" })}
+		}, alice.Alg, protocol.ErrUserIDMismatch},
+		{"tampered peer id", func(p string) []*net.Frame {
+			return []*net.Frame{hello(p, transcript, func(h *protocol.HelloMessage) { h.PeerID += "x" })}
+		}, alice.Alg, protocol.ErrHelloSignature},
+		{"signed for another peer", func(p string) []*net.Frame {
+			return []*net.Frame{hello("12D3KooWSomeoneElse", transcript, nil)}
+		}, alice.Alg, ErrPeerMismatch},
+		{"signed for another handshake", func(p string) []*net.Frame {
+			return []*net.Frame{hello(p, []byte("another transcript"), nil)}
+		}, alice.Alg, protocol.ErrTranscriptMismatch},
+		{"not the negotiated algorithm", func(p string) []*net.Frame {
+			return []*net.Frame{hello(p, transcript, nil)}
+		}, "ML-DSA-87", ErrHelloAlg},
+		{"chat before hello", func(p string) []*net.Frame {
+			return []*net.Frame{{Type: net.FrameChat, Payload: []byte("{}")}, hello(p, transcript, nil)}
+		}, alice.Alg, ErrUnexpectedFrame},
+	}
+	for _, tt := range tests {
+		// Alice is the server, bob the client who checks her HELLO
+		bob, alicePeer := newPairOn(t, transcript)
+		client, server, _, sh := streamPair(t)
+		// Streams are not buffered: write while bob reads
+		frames := tt.frames(sh.ID().String())
+		go func() {
+			for _, f := range frames {
+				if alicePeer.Send(server, f) != nil {
+					return
+				}
+			}
+		}()
+		bob.RemoteSigAlg = tt.alg
+		err := bob.recvHello(client)
+		_ = client.Reset()
+		if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && (bob.RemoteUserID != alice.UserID || bob.RemotePeer != sh.ID()) {
+			t.Errorf("%s: authenticated %s on %s", tt.name, bob.RemoteUserID, bob.RemotePeer)
+		}
+	}
+}
+
+// newPairOn returns the client and server sessions of a handshake with
+// the given transcript.
+func newPairOn(t *testing.T, transcript []byte) (client, server *Session) {
+	t.Helper()
+	client, server = newPair(t, RekeyPolicy{})
+	client.Transcript, server.Transcript = transcript, transcript
+	return client, server
+}
@@ -0,0 +1,503 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"pqchat/src/internal/pqc"
+)
+
+// The session is a double ratchet, as in Signal, with ML-KEM in place of
+// Diffie-Hellman:
+//
+//   - every message advances a symmetric chain and is sealed under its own
+//     message key, deleted once used;
+//   - from time to time (see RekeyPolicy) the sender encapsulates to the
+//     peer's latest ratchet public key and mixes the shared secret into the
+//     root key, starting a new sending chain and publishing a fresh key of
+//     its own. The peer answers with the next step, so the steps alternate.
+//
+// A message is header || AES-GCM(message key, plaintext), the transcript,
+// the frame header (if any) and the header being the additional data.
+// Header (big endian):
+//
+//	step  4 bytes  ratchet step that opened the sending chain
+//	seen  4 bytes  1 + last peer step whose KEM material was received
+//	pn    4 bytes  messages sent on the previous sending chain
+//	n     4 bytes  message number in the chain
+//	ct    2 bytes length + KEM ciphertext of the step (may be empty)
+//	pub   2 bytes length + sender's ratchet public key (may be empty)
+//
+// ct and pub are repeated until the peer reports it has seen them.
+const (
+	headerFixedSize = 16
+	maxKEMField     = 4096 // larger than any ML-KEM key or ciphertext
+	maxSkip         = 256  // message keys kept for late or reordered messages
+)
+
+var (
+	ErrReplay         = errors.New("session: replayed message")
+	ErrTooOld         = errors.New("session: message key no longer available")
+	ErrTooManySkipped = errors.New("session: too many skipped messages")
+	ErrSeqOverflow    = errors.New("session: message counter exhausted")
+	ErrShortFrame     = errors.New("session: ciphertext too short")
+	ErrRatchetStep    = errors.New("session: unexpected ratchet step")
+	ErrClosed         = errors.New("session: closed")
+)
+
+// RekeyPolicy tells when a sender takes a KEM ratchet step, which needs a
+// fresh public key from the peer. A zero field disables that threshold.
+type RekeyPolicy struct {
+	Messages uint64
+	Bytes    uint64
+	Interval time.Duration
+}
+
+// DefaultRekeyPolicy steps every 100 messages, 1 MiB or 10 minutes.
+func DefaultRekeyPolicy() RekeyPolicy {
+	return RekeyPolicy{
+		Messages: 100,
+		Bytes:    1 << 20,
+		Interval: 10 * time.Minute,
+	}
+}
+
+type header struct {
+	step, seen, pn, n uint32
+	ct, pub           []byte
+}
+
+func (h *header) encode() []byte {
+	out := make([]byte, 0, headerFixedSize+4+len(h.ct)+len(h.pub))
+	out = binary.BigEndian.AppendUint32(out, h.step)
+	out = binary.BigEndian.AppendUint32(out, h.seen)
+	out = binary.BigEndian.AppendUint32(out, h.pn)
+	out = binary.BigEndian.AppendUint32(out, h.n)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(h.ct)))
+	out = append(out, h.ct...)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(h.pub)))
+	return append(out, h.pub...)
+}
+
+// decodeHeader returns the header, its raw bytes and the ciphertext.
+func decodeHeader(data []byte) (*header, []byte, []byte, error) {
+	if len(data) < headerFixedSize {
+		return nil, nil, nil, ErrShortFrame
+	}
+	h := &header{
+		step: binary.BigEndian.Uint32(data[0:4]),
+		seen: binary.BigEndian.Uint32(data[4:8]),
+		pn:   binary.BigEndian.Uint32(data[8:12]),
+		n:    binary.BigEndian.Uint32(data[12:16]),
+	}
+	off := headerFixedSize
+	field := func() ([]byte, error) {
+		if len(data) < off+2 {
+			return nil, ErrShortFrame
+		}
+		l := int(binary.BigEndian.Uint16(data[off:]))
+		off += 2
+		if l > maxKEMField || len(data) < off+l {
+			return nil, ErrShortFrame
+		}
+		f := data[off : off+l]
+		off += l
+		if l == 0 {
+			return nil, nil
+		}
+		return f, nil
+	}
+	var err error
+	if h.ct, err = field(); err != nil {
+		return nil, nil, nil, err
+	}
+	if h.pub, err = field(); err != nil {
+		return nil, nil, nil, err
+	}
+	return h, data[:off], data[off:], nil
+}
+
+type msgID struct {
+	step, n uint32
+}
+
+type ratchet struct {
+	mu         sync.Mutex
+	policy     RekeyPolicy
+	kemAlg     string
+	transcript []byte
+
+	root *pqc.Secret
+	step uint32 // last ratchet step, taken by either side
+
+	// Our sending chain
+	sendCK    *pqc.Secret
+	sendStep  uint32
+	sendN     uint32
+	prevN     uint32
+	sendBytes uint64
+	sendSince time.Time
+	sendCt    []byte   // KEM ciphertext of the step that opened the chain
+	ownKEM    *pqc.KEM // our ratchet key pair, until the peer steps with it
+	ownPub    []byte
+
+	// The peer's sending chain
+	recvCK   *pqc.Secret
+	recvStep uint32
+	recvN    uint32
+	peerPub  []byte // peer ratchet key we have not stepped with yet
+	seen     uint32
+	peerSeen uint32
+
+	skipped   map[msgID]*pqc.Secret
+	skipOrder []msgID
+
+	closed bool
+}
+
+// newRatchet sets up both chains from the handshake secret. The server
+// starts with a ratchet key pair, published in its first messages, so the
+// client can take the first step.
+func newRatchet(sharedSecret, transcript []byte, server bool, policy RekeyPolicy, kemAlg string) (*ratchet, error) {
+	root, c2s, s2c, err := pqc.DeriveRatchetKeys(sharedSecret, transcript)
+	if err != nil {
+		return nil, err
+	}
+	r := &ratchet{
+		policy:     policy,
+		kemAlg:     kemAlg,
+		transcript: transcript,
+		root:       pqc.NewSecret(root),
+		sendCK:     pqc.NewSecret(c2s),
+		recvCK:     pqc.NewSecret(s2c),
+		sendSince:  time.Now(),
+		skipped:    make(map[msgID]*pqc.Secret),
+	}
+	if server {
+		r.sendCK, r.recvCK = r.recvCK, r.sendCK
+		if r.ownKEM, r.ownPub, err = newRatchetKey(kemAlg); err != nil {
+			r.close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func newRatchetKey(alg string) (*pqc.KEM, []byte, error) {
+	kem, err := pqc.NewKEMWith(alg)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := kem.Keygen()
+	if err != nil {
+		kem.Clean()
+		return nil, nil, err
+	}
+	return kem, pub, nil
+}
+
+func (r *ratchet) encrypt(plaintext, frameHeader []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, ErrClosed
+	}
+	if r.peerPub != nil && r.due() {
+		if err := r.kemStep(); err != nil {
+			return nil, err
+		}
+	}
+	if r.sendN == math.MaxUint32 {
+		return nil, ErrSeqOverflow
+	}
+
+	next, mk := pqc.ChainKDF(r.sendCK.Bytes())
+	defer pqc.Wipe(mk)
+	r.sendCK.Close()
+	r.sendCK = pqc.NewSecret(next)
+
+	h := header{step: r.sendStep, seen: r.seen, pn: r.prevN, n: r.sendN}
+	if r.peerSeen <= r.sendStep {
+		h.ct, h.pub = r.sendCt, r.ownPub
+	}
+	raw := h.encode()
+	r.sendN++
+	r.sendBytes += uint64(len(plaintext))
+
+	ct, err := pqc.SealMessage(mk, plaintext, r.ad(frameHeader, raw))
+	if err != nil {
+		return nil, err
+	}
+	return append(raw, ct...), nil
+}
+
+func (r *ratchet) due() bool {
+	p := r.policy
+	return r.sendN == math.MaxUint32 ||
+		(p.Messages > 0 && uint64(r.sendN) >= p.Messages) ||
+		(p.Bytes > 0 && r.sendBytes >= p.Bytes) ||
+		(p.Interval > 0 && time.Since(r.sendSince) >= p.Interval)
+}
+
+// kemStep encapsulates to the peer's ratchet key and starts a new sending
+// chain, publishing a new key pair for the peer's next step.
+func (r *ratchet) kemStep() error {
+	if r.step == math.MaxUint32 {
+		return ErrSeqOverflow
+	}
+	ct, ss, err := pqc.EncapsulateWith(r.kemAlg, r.peerPub)
+	if err != nil {
+		return err
+	}
+	defer pqc.Wipe(ss)
+
+	kem, pub, err := newRatchetKey(r.kemAlg)
+	if err != nil {
+		return err
+	}
+	root, ck, err := pqc.RootKDF(r.root.Bytes(), ss)
+	if err != nil {
+		kem.Clean()
+		return err
+	}
+
+	r.root.Close()
+	r.sendCK.Close()
+	if r.ownKEM != nil {
+		r.ownKEM.Clean()
+	}
+	r.root, r.sendCK = pqc.NewSecret(root), pqc.NewSecret(ck)
+	r.step++
+	r.sendStep = r.step
+	r.prevN, r.sendN = r.sendN, 0
+	r.sendBytes, r.sendSince = 0, time.Now()
+	r.sendCt, r.ownKEM, r.ownPub = ct, kem, pub
+	r.peerPub = nil
+	return nil
+}
+
+// decrypt opens a message. Nothing changes in the ratchet state unless the
+// message authenticates.
+func (r *ratchet) decrypt(data, frameHeader []byte) ([]byte, error) {
+	h, raw, ct, err := decodeHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	ad := r.ad(frameHeader, raw)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, ErrClosed
+	}
+	id := msgID{h.step, h.n}
+	if mk, ok := r.skipped[id]; ok {
+		pt, err := pqc.OpenMessage(mk.Bytes(), ct, ad)
+		if err != nil {
+			return nil, err
+		}
+		r.dropSkipped(id)
+		r.ack(h)
+		return pt, nil
+	}
+
+	switch {
+	case h.step == r.recvStep:
+		if h.n < r.recvN {
+			return nil, ErrReplay
+		}
+		ck, mk, skipped, err := r.skip(r.recvCK.Bytes(), h.step, r.recvN, h.n)
+		if err != nil {
+			return nil, err
+		}
+		defer pqc.Wipe(mk)
+		pt, err := pqc.OpenMessage(mk, ct, ad)
+		if err != nil {
+			wipeSkipped(skipped)
+			pqc.Wipe(ck)
+			return nil, err
+		}
+		r.recvCK.Close()
+		r.recvCK, r.recvN = pqc.NewSecret(ck), h.n+1
+		r.storeSkipped(skipped)
+
+		// The server's first messages carry its initial ratchet key
+		if h.pub != nil && h.ct == nil && h.step == 0 && r.step == 0 && r.seen == 0 {
+			r.peerPub = bytes.Clone(h.pub)
+			r.seen = 1
+		}
+		r.ack(h)
+		return pt, nil
+
+	case h.step == r.step+1 && r.ownKEM != nil && h.ct != nil && h.pub != nil:
+		return r.peerStep(h, ct, ad)
+
+	case h.step < r.recvStep:
+		return nil, ErrTooOld
+	}
+	return nil, ErrRatchetStep
+}
+
+// peerStep follows a KEM ratchet step taken by the peer with our key.
+func (r *ratchet) peerStep(h *header, ct, ad []byte) ([]byte, error) {
+	// Keep the keys of the old chain's missing messages
+	if h.pn < r.recvN {
+		return nil, ErrRatchetStep
+	}
+	ck, last, oldSkipped, err := r.skip(r.recvCK.Bytes(), r.recvStep, r.recvN, h.pn)
+	if err != nil {
+		return nil, err
+	}
+	// skip stops on message pn itself, which does not exist
+	pqc.Wipe(ck)
+	pqc.Wipe(last)
+
+	ss, err := r.ownKEM.Decapsulate(h.ct)
+	if err != nil {
+		wipeSkipped(oldSkipped)
+		return nil, err
+	}
+	root, chain, err := pqc.RootKDF(r.root.Bytes(), ss)
+	pqc.Wipe(ss)
+	if err != nil {
+		wipeSkipped(oldSkipped)
+		return nil, err
+	}
+	ck, mk, newSkipped, err := r.skip(chain, h.step, 0, h.n)
+	pqc.Wipe(chain)
+	if err != nil {
+		wipeSkipped(oldSkipped)
+		pqc.Wipe(root)
+		return nil, err
+	}
+	defer pqc.Wipe(mk)
+
+	pt, err := pqc.OpenMessage(mk, ct, ad)
+	if err != nil {
+		wipeSkipped(oldSkipped)
+		wipeSkipped(newSkipped)
+		pqc.Wipe(root)
+		pqc.Wipe(ck)
+		return nil, err
+	}
+
+	// Switch atomically and forget the consumed keys
+	r.root.Close()
+	r.recvCK.Close()
+	r.ownKEM.Clean()
+	r.ownKEM, r.ownPub, r.sendCt = nil, nil, nil
+	r.root, r.step = pqc.NewSecret(root), h.step
+	r.recvCK, r.recvStep, r.recvN = pqc.NewSecret(ck), h.step, h.n+1
+	r.peerPub = bytes.Clone(h.pub)
+	r.seen = h.step + 1
+	r.storeSkipped(oldSkipped)
+	r.storeSkipped(newSkipped)
+	r.ack(h)
+	return pt, nil
+}
+
+type skippedKey struct {
+	id msgID
+	mk []byte
+}
+
+// skip runs a chain from message from up to message to, returning the
+// chain key after to, the message key of to and the keys in between.
+func (r *ratchet) skip(ck []byte, step, from, to uint32) ([]byte, []byte, []skippedKey, error) {
+	if to-from > maxSkip {
+		return nil, nil, nil, ErrTooManySkipped
+	}
+	var skipped []skippedKey
+	ck = bytes.Clone(ck)
+	for n := from; ; n++ {
+		next, mk := pqc.ChainKDF(ck)
+		pqc.Wipe(ck)
+		ck = next
+		if n == to {
+			return ck, mk, skipped, nil
+		}
+		skipped = append(skipped, skippedKey{msgID{step, n}, mk})
+	}
+}
+
+// storeSkipped keeps message keys for late messages, forgetting the oldest
+// ones beyond maxSkip.
+func (r *ratchet) storeSkipped(keys []skippedKey) {
+	for _, k := range keys {
+		r.skipped[k.id] = pqc.NewSecret(k.mk)
+		r.skipOrder = append(r.skipOrder, k.id)
+	}
+	for len(r.skipOrder) > maxSkip {
+		r.dropSkipped(r.skipOrder[0])
+	}
+}
+
+func (r *ratchet) dropSkipped(id msgID) {
+	if mk, ok := r.skipped[id]; ok {
+		mk.Close()
+		delete(r.skipped, id)
+	}
+	for i, o := range r.skipOrder {
+		if o == id {
+			r.skipOrder = append(r.skipOrder[:i], r.skipOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+func wipeSkipped(keys []skippedKey) {
+	for _, k := range keys {
+		pqc.Wipe(k.mk)
+	}
+}
+
+// ack records how far the peer got with our ratchet keys.
+func (r *ratchet) ack(h *header) {
+	if h.seen > r.peerSeen {
+		r.peerSeen = h.seen
+	}
+}
+
+func (r *ratchet) ad(frameHeader, header []byte) []byte {
+	ad := make([]byte, 0, len(r.transcript)+len(frameHeader)+len(header))
+	ad = append(ad, r.transcript...)
+	ad = append(ad, frameHeader...)
+	return append(ad, header...)
+}
+
+// close wipes every key of the ratchet. It may be called more than once.
+func (r *ratchet) close() {
+	r.closed = true
+	r.root.Close()
+	r.sendCK.Close()
+	r.recvCK.Close()
+	for id, mk := range r.skipped {
+		mk.Close()
+		delete(r.skipped, id)
+	}
+	r.skipOrder = nil
+	if r.ownKEM != nil {
+		r.ownKEM.Clean()
+		r.ownKEM = nil
+	}
+	r.peerPub, r.ownPub, r.sendCt = nil, nil, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package session
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"pqchat/src/internal/pqc"
+)
+
+// newPair returns the client and server sessions of a handshake that
+// agreed on a fixed secret.
+func newPair(t *testing.T, policy RekeyPolicy) (client, server *Session) {
+	t.Helper()
+	secret := bytes.Repeat([]byte{0x42}, 32)
+	transcript := []byte("transcript")
+	client, err := newSession(secret, transcript, false, policy, pqc.DefaultKEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = newSession(secret, transcript, true, policy, pqc.DefaultKEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// seal encrypts n messages from s, numbered after their index.
+func seal(t *testing.T, s *Session, n int) [][]byte {
+	t.Helper()
+	out := make([][]byte, n)
+	for i := range out {
+		ct, err := s.Encrypt(fmt.Appendf(nil, "msg %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[i] = ct
+	}
+	return out
+}
+
+func open(t *testing.T, s *Session, ct []byte, i int) {
+	t.Helper()
+	pt, err := s.Decrypt(ct)
+	if err != nil {
+		t.Fatalf("message %d: %v", i, err)
+	}
+	if want := fmt.Sprintf("msg %d", i); string(pt) != want {
+		t.Fatalf("got %q, want %q", pt, want)
+	}
+}
+
+func TestRatchetRekey(t *testing.T) {
+	client, server := newPair(t, RekeyPolicy{Messages: 3})
+
+	// The server publishes its ratchet key first, then both sides take
+	// turns, each past several KEM steps.
+	for round := 0; round < 4; round++ {
+		for i, ct := range seal(t, server, 5) {
+			open(t, client, ct, i)
+		}
+		for i, ct := range seal(t, client, 5) {
+			open(t, server, ct, i)
+		}
+	}
+	if client.r.step < 4 || client.r.step != server.r.step {
+		t.Errorf("ratchet steps: client %d, server %d, want the same and at least 4", client.r.step, server.r.step)
+	}
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	client, server := newPair(t, RekeyPolicy{Messages: 4})
+	for i, ct := range seal(t, server, 1) {
+		open(t, client, ct, i)
+	}
+
+	// Messages 4 to 7 are sent on a new KEM step, delivered first
+	cts := seal(t, client, 8)
+	for _, i := range []int{5, 1, 7, 0, 4, 3, 6, 2} {
+		open(t, server, cts[i], i)
+	}
+}
+
+func TestRatchetReplay(t *testing.T) {
+	client, server := newPair(t, RekeyPolicy{})
+	cts := seal(t, client, 3)
+	open(t, server, cts[2], 2)
+	open(t, server, cts[0], 0) // from the skipped keys
+
+	for _, i := range []int{2, 0} {
+		if _, err := server.Decrypt(cts[i]); err == nil {
+			t.Errorf("message %d accepted twice", i)
+		}
+	}
+	if _, err := server.Decrypt(cts[2]); !errors.Is(err, ErrReplay) {
+		t.Errorf("replay: got %v, want %v", err, ErrReplay)
+	}
+	open(t, server, cts[1], 1)
+}
+
+func TestRatchetMaxSkip(t *testing.T) {
+	client, server := newPair(t, RekeyPolicy{})
+	cts := seal(t, client, maxSkip+2)
+
+	if _, err := server.Decrypt(cts[maxSkip+1]); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("skipping %d messages: got %v, want %v", maxSkip+1, err, ErrTooManySkipped)
+	}
+	// The failed message changed nothing, and maxSkip is still allowed
+	open(t, server, cts[maxSkip], maxSkip)
+	open(t, server, cts[0], 0)
+	open(t, server, cts[maxSkip+1], maxSkip+1)
+}
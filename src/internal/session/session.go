@@ -13,24 +13,96 @@
 // limitations under the License.
 package session
 
-import "pqchat/src/internal/pqc"
+import (
+	"errors"
+	"io"
+	"sync"
 
-// Session represents a symmetric session derived from a ML-KEM shared secret.
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"pqchat/src/internal/net"
+)
+
+var ErrPlaintextFrame = errors.New("session: unencrypted frame")
+
+// Session represents a ratcheting session started from a ML-KEM shared secret.
 type Session struct {
-	Cipher *pqc.AESGCM
+	r      *ratchet
+	sendMu sync.Mutex // keeps the chunks of a frame together
+
+	// Negotiated stream protocol (bound into the transcript) and key exchange
+	Protocol protocol.ID
+	Kex      KexMode
+
+	// Hash of the handshake transcript, signed by both HELLOs
+	Transcript []byte
+
+	// Authenticated remote identity (set once its HELLO is verified)
+	RemoteUserID string
+	RemotePseudo string
+	RemoteSigAlg string
+	RemotePub    []byte
+	RemotePeer   peer.ID
+}
+
+// newSession starts the double ratchet from the handshake secret, its KEM
+// steps using kemAlg.
+func newSession(sharedSecret, transcript []byte, server bool, policy RekeyPolicy, kemAlg string) (*Session, error) {
+	r, err := newRatchet(sharedSecret, transcript, server, policy, kemAlg)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{r: r, Transcript: transcript}, nil
 }
 
-// This encrypts an application message.
+// This encrypts an application message with the next message key.
 func (s *Session) Encrypt(plaintext []byte) ([]byte, error) {
-	return s.Cipher.Encrypt(plaintext)
+	return s.r.encrypt(plaintext, nil)
 }
 
-// This decrypts an application message.
+// This decrypts an application message, rejecting replays.
 func (s *Session) Decrypt(ciphertext []byte) ([]byte, error) {
-	return s.Cipher.Decrypt(ciphertext)
+	return s.r.decrypt(ciphertext, nil)
+}
+
+// Send encrypts the payload of f and writes the frame to w. The frame
+// header is authenticated along with the payload.
+func (s *Session) Send(w io.Writer, f *net.Frame) error {
+	out := *f
+	out.Flags |= net.FlagEncrypted
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	ct, err := s.r.encrypt(f.Payload, out.Header())
+	if err != nil {
+		return err
+	}
+	out.Payload = ct
+	return net.Send(w, &out)
+}
+
+// Recv reads the next frame from rd and decrypts its payload. Frames of
+// unknown types are returned as well once authenticated, for the caller to
+// skip.
+func (s *Session) Recv(rd io.Reader) (*net.Frame, error) {
+	f, err := net.Recv(rd)
+	if err != nil {
+		return nil, err
+	}
+	if !f.Encrypted() {
+		return nil, ErrPlaintextFrame
+	}
+	if f.Payload, err = s.r.decrypt(f.Payload, f.Header()); err != nil {
+		return nil, err
+	}
+	return f, nil
 }
 
-// This returns a copy of the raw AES key (for debugging purposes).
-func (s *Session) CipherKeyDebug() []byte {
-	return s.Cipher.RawKey()
+// Close wipes the session keys. Encrypt and Decrypt fail afterwards.
+func (s *Session) Close() {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	s.r.close()
 }
@@ -0,0 +1,29 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+
+//go:build debug
+
+package session
+
+import (
+	"bytes"
+)
+
+// This returns a copy of the current sending chain key (for debugging
+// purposes, only in builds made with -tags debug).
+func (s *Session) CipherKeyDebug() []byte {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	return bytes.Clone(s.r.sendCK.Bytes())
+}
@@ -0,0 +1,66 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package session
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"pqchat/src/internal/net"
+)
+
+// The typed header of a frame sits after its 4-byte length on the wire.
+const typedHeader = 4
+
+func TestSendHeaderBound(t *testing.T) {
+	client, server := newPair(t, RekeyPolicy{})
+	f := &net.Frame{Type: net.FrameRoom, Channel: 7, Payload: []byte("secret")}
+	var buf bytes.Buffer
+	if err := client.Send(&buf, f); err != nil {
+		t.Fatal(err)
+	}
+	wire := buf.Bytes()
+	if bytes.Contains(wire, f.Payload) {
+		t.Fatal("payload sent in clear")
+	}
+
+	tests := []struct {
+		name string
+		off  int
+		mask byte
+		want error
+	}{
+		{"type", 1, 0x0f, nil},
+		{"unknown flag", 2, 0x80, nil},
+		{"encrypted flag", 3, byte(net.FlagEncrypted), ErrPlaintextFrame},
+		{"channel", 7, 0x01, nil},
+	}
+	for _, tt := range tests {
+		altered := bytes.Clone(wire)
+		altered[typedHeader+tt.off] ^= tt.mask
+		_, err := server.Recv(bytes.NewReader(altered))
+		if err == nil || (tt.want != nil && !errors.Is(err, tt.want)) {
+			t.Errorf("%s altered: got %v, want an error", tt.name, err)
+		}
+	}
+
+	got, err := server.Recv(bytes.NewReader(wire))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != f.Type || got.Channel != f.Channel || !bytes.Equal(got.Payload, f.Payload) {
+		t.Errorf("got %+v, want %+v", got, f)
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package session
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"pqchat/src/internal/pqc"
+)
+
+// KexMode is a key exchange suite negotiated at the start of the handshake.
+// Codes are part of the wire format and must never be reused.
+type KexMode byte
+
+const (
+	KexMLKEM768       KexMode = 1 // pure ML-KEM-768
+	KexX25519MLKEM768 KexMode = 2 // X25519 + ML-KEM-768 hybrid
+	KexMLKEM512       KexMode = 3
+	KexMLKEM1024      KexMode = 4
+)
+
+type kexSuite struct {
+	name   string
+	kem    string // liboqs KEM name
+	hybrid bool   // X25519 runs alongside the KEM
+}
+
+var kexSuites = map[KexMode]kexSuite{
+	KexMLKEM768:       {"ML-KEM-768", "ML-KEM-768", false},
+	KexX25519MLKEM768: {"X25519MLKEM768", "ML-KEM-768", true},
+	KexMLKEM512:       {"ML-KEM-512", "ML-KEM-512", false},
+	KexMLKEM1024:      {"ML-KEM-1024", "ML-KEM-1024", false},
+}
+
+// SigSuite identifies an identity signature algorithm on the wire.
+type SigSuite byte
+
+var sigSuites = map[SigSuite]string{
+	1: "ML-DSA-65",
+	2: "ML-DSA-44",
+	3: "ML-DSA-87",
+	4: "Falcon-512",
+	5: "Falcon-1024",
+	6: "SLH_DSA_PURE_SHA2_128S",
+	7: "SLH_DSA_PURE_SHA2_192S",
+	8: "SLH_DSA_PURE_SHA2_256S",
+}
+
+var (
+	ErrNoCommonKex   = errors.New("session: no common key exchange mode")
+	ErrSigRefused    = errors.New("session: peer identity algorithm refused by local policy")
+	ErrOwnSigRefused = errors.New("session: our identity algorithm is refused by the peer")
+	ErrBadOffer      = errors.New("session: malformed suite offer")
+)
+
+func (m KexMode) String() string {
+	if s, ok := kexSuites[m]; ok {
+		return s.name
+	}
+	return fmt.Sprintf("kex(%d)", byte(m))
+}
+
+func (m KexMode) kem() string {
+	return kexSuites[m].kem
+}
+
+func (m KexMode) hybrid() bool {
+	return kexSuites[m].hybrid
+}
+
+func (s SigSuite) String() string {
+	if name, ok := sigSuites[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("sig(%d)", byte(s))
+}
+
+func sigSuiteOf(alg string) (SigSuite, bool) {
+	for code, name := range sigSuites {
+		if name == alg {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// Config holds the local handshake policy.
+type Config struct {
+	// Accepted key exchange modes, most preferred first
+	KexModes []KexMode
+
+	// Accepted identity signature algorithms of the remote peer
+	SigAlgs []string
+
+	// Minimum NIST security level of both the KEM and the peer signature
+	MinLevel int
+
+	// When to move our sending direction to a new key
+	Rekey RekeyPolicy
+}
+
+// DefaultConfig prefers the hybrid mode but still accepts pure ML-KEM peers,
+// at NIST level 3 or above.
+func DefaultConfig() *Config {
+	return &Config{
+		KexModes: []KexMode{KexX25519MLKEM768, KexMLKEM768, KexMLKEM1024, KexMLKEM512},
+		SigAlgs:  pqc.SigAlgorithms,
+		MinLevel: 3,
+		Rekey:    DefaultRekeyPolicy(),
+	}
+}
+
+// ParseKexPolicy maps a -kex flag value to the accepted modes:
+// "hybrid" (hybrid only), "mlkem" (pure ML-KEM only) or "any".
+func ParseKexPolicy(s string) ([]KexMode, error) {
+	all := DefaultConfig().KexModes
+	switch s {
+	case "hybrid":
+		return filterKex(all, func(m KexMode) bool { return m.hybrid() }), nil
+	case "mlkem":
+		return filterKex(all, func(m KexMode) bool { return !m.hybrid() }), nil
+	case "any", "":
+		return all, nil
+	}
+	return nil, fmt.Errorf("unknown kex policy %q (want hybrid, mlkem or any)", s)
+}
+
+// ParseKexList parses a comma separated preference list of suite names,
+// e.g. "ML-KEM-512,ML-KEM-768".
+func ParseKexList(s string) ([]KexMode, error) {
+	var out []KexMode
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for m, suite := range kexSuites {
+			if strings.EqualFold(suite.name, name) {
+				out = append(out, m)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown key exchange %q", name)
+		}
+	}
+	return out, nil
+}
+
+// usableKex returns the configured modes that liboqs supports at the
+// required security level, in preference order.
+func (c *Config) usableKex() []KexMode {
+	return filterKex(c.KexModes, func(m KexMode) bool {
+		lvl, err := pqc.KEMLevel(m.kem())
+		return err == nil && lvl >= c.MinLevel
+	})
+}
+
+// acceptsSig tells whether a remote identity using alg is allowed.
+func (c *Config) acceptsSig(alg string) bool {
+	if !slices.Contains(c.SigAlgs, alg) {
+		return false
+	}
+	lvl, err := pqc.SigLevel(alg)
+	return err == nil && lvl >= c.MinLevel
+}
+
+func filterKex(modes []KexMode, keep func(KexMode) bool) []KexMode {
+	var out []KexMode
+	for _, m := range modes {
+		if keep(m) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// suiteOffer is the first handshake frame, sent by the server:
+//
+//	n | n kex modes | m | m accepted signature suites | own signature suite
+type suiteOffer struct {
+	kex    []KexMode
+	sigs   []SigSuite
+	ownSig SigSuite
+}
+
+func (o *suiteOffer) encode() []byte {
+	out := []byte{byte(len(o.kex))}
+	for _, m := range o.kex {
+		out = append(out, byte(m))
+	}
+	out = append(out, byte(len(o.sigs)))
+	for _, s := range o.sigs {
+		out = append(out, byte(s))
+	}
+	return append(out, byte(o.ownSig))
+}
+
+func decodeSuiteOffer(b []byte) (*suiteOffer, error) {
+	o := &suiteOffer{}
+	if len(b) < 1 {
+		return nil, ErrBadOffer
+	}
+	n := int(b[0])
+	b = b[1:]
+	if len(b) < n+1 {
+		return nil, ErrBadOffer
+	}
+	for _, m := range b[:n] {
+		o.kex = append(o.kex, KexMode(m))
+	}
+	b = b[n:]
+	n = int(b[0])
+	b = b[1:]
+	if len(b) != n+1 {
+		return nil, ErrBadOffer
+	}
+	for _, s := range b[:n] {
+		o.sigs = append(o.sigs, SigSuite(s))
+	}
+	o.ownSig = SigSuite(b[n])
+	return o, nil
+}
+
+// newSuiteOffer builds the server offer from the local policy.
+func newSuiteOffer(cfg *Config, id *pqc.Identity) (*suiteOffer, error) {
+	own, ok := sigSuiteOf(id.Alg)
+	if !ok {
+		return nil, fmt.Errorf("session: identity algorithm %s has no suite code", id.Alg)
+	}
+	o := &suiteOffer{kex: cfg.usableKex(), ownSig: own}
+	if len(o.kex) == 0 {
+		return nil, ErrNoCommonKex
+	}
+	for _, alg := range cfg.SigAlgs {
+		if code, ok := sigSuiteOf(alg); ok && cfg.acceptsSig(alg) {
+			o.sigs = append(o.sigs, code)
+		}
+	}
+	return o, nil
+}
+
+// suiteSelect is the client answer: chosen kex mode | own signature suite.
+type suiteSelect struct {
+	kex    KexMode
+	ownSig SigSuite
+}
+
+func (s *suiteSelect) encode() []byte {
+	return []byte{byte(s.kex), byte(s.ownSig)}
+}
+
+func decodeSuiteSelect(b []byte) (*suiteSelect, error) {
+	if len(b) != 2 {
+		return nil, ErrBadOffer
+	}
+	return &suiteSelect{kex: KexMode(b[0]), ownSig: SigSuite(b[1])}, nil
+}
+
+// selectSuite answers a server offer following the local policy.
+func selectSuite(cfg *Config, id *pqc.Identity, o *suiteOffer) (*suiteSelect, error) {
+	if !cfg.acceptsSig(o.ownSig.String()) {
+		return nil, fmt.Errorf("%w: %s", ErrSigRefused, o.ownSig)
+	}
+	own, ok := sigSuiteOf(id.Alg)
+	if !ok || !slices.Contains(o.sigs, own) {
+		return nil, fmt.Errorf("%w: %s", ErrOwnSigRefused, id.Alg)
+	}
+	for _, m := range cfg.usableKex() {
+		if slices.Contains(o.kex, m) {
+			return &suiteSelect{kex: m, ownSig: own}, nil
+		}
+	}
+	return nil, ErrNoCommonKex
+}
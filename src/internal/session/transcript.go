@@ -0,0 +1,53 @@
+// Copyright 2025 Oleg Lodygensky
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions AND
+// limitations under the License.
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const transcriptLabel = "pqchat-handshake-v1"
+
+// transcript accumulates the handshake messages. Every field is length
+// prefixed so that two different transcripts never hash the same.
+type transcript struct {
+	h hash.Hash
+}
+
+func newTranscript() *transcript {
+	t := &transcript{h: sha256.New()}
+	t.add([]byte(transcriptLabel))
+	return t
+}
+
+func (t *transcript) add(field []byte) {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(field)))
+	t.h.Write(l[:])
+	t.h.Write(field)
+}
+
+// addPeers binds the libp2p identities of both ends, server first.
+func (t *transcript) addPeers(server, client peer.ID) {
+	t.add([]byte(server))
+	t.add([]byte(client))
+}
+
+func (t *transcript) sum() []byte {
+	return t.h.Sum(nil)
+}